@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// AdminUser is a user as admins see them, with counts of what they own.
+type AdminUser struct {
+	*User
+	Tasks        int
+	Completions  int
+	Sessions     int
+	LastActiveAt *time.Time
+}
+
+type AdminUserResponse struct {
+	ID           int        `json:"id"`
+	Username     string     `json:"username"`
+	Email        *string    `json:"email"`
+	Timezone     string     `json:"timezone"`
+	IsAdmin      bool       `json:"is_admin"`
+	Disabled     bool       `json:"disabled"`
+	DisabledAt   *time.Time `json:"disabled_at"`
+	Tasks        int        `json:"tasks"`
+	Completions  int        `json:"completions"`
+	Sessions     int        `json:"sessions"`
+	LastActiveAt *time.Time `json:"last_active_at"`
+	CreatedAt    time.Time  `json:"created_at"`
+}
+
+func newAdminUserResponse(user *AdminUser) AdminUserResponse {
+	resp := AdminUserResponse{
+		ID:           user.ID,
+		Username:     user.Username,
+		Timezone:     user.Timezone,
+		IsAdmin:      user.IsAdmin,
+		Disabled:     user.DisabledAt != nil,
+		DisabledAt:   user.DisabledAt,
+		Tasks:        user.Tasks,
+		Completions:  user.Completions,
+		Sessions:     user.Sessions,
+		LastActiveAt: user.LastActiveAt,
+		CreatedAt:    user.CreatedAt,
+	}
+	if user.Email != "" {
+		resp.Email = &user.Email
+	}
+
+	return resp
+}
+
+// InstanceStats summarises the whole instance. Active users are those who
+// completed a task in the last 7 days, and recent completions are from the
+// same window.
+type InstanceStats struct {
+	Users             int   `json:"users"`
+	Admins            int   `json:"admins"`
+	DisabledUsers     int   `json:"disabled_users"`
+	ActiveUsers       int   `json:"active_users"`
+	Tasks             int   `json:"tasks"`
+	Completions       int   `json:"completions"`
+	RecentCompletions int   `json:"recent_completions"`
+	Sessions          int   `json:"sessions"`
+	DatabaseBytes     int64 `json:"database_bytes"`
+}
+
+// withAdmin is withUser for routes only admins may use.
+func withAdmin(conn *pgxpool.Pool, h http.HandlerFunc) http.HandlerFunc {
+	return withUser(conn, func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		if !user.IsAdmin {
+			writeError(w, http.StatusForbidden, CodeForbidden, "admin access is required")
+			loggerFrom(r.Context()).Error("User is not an admin", "error", "admin access is required")
+			return
+		}
+
+		h(w, r)
+	})
+}
+
+// userFromPath loads the user named by the userId path value, writing an
+// error response and returning false if they do not exist. Admins may not
+// act on their own account through these routes, so that an instance is
+// never left without an admin by mistake.
+func userFromPath(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool) (*User, bool) {
+	admin := r.Context().Value(UserKey("user")).(*User)
+
+	userID, err := strconv.Atoi(r.PathValue("userId"))
+	if err != nil {
+		writeFieldErrors(w, FieldErrors{"user_id": "user_id must be an integer"})
+		return nil, false
+	}
+	if userID == admin.ID {
+		writeFieldErrors(w, FieldErrors{"user_id": "admins cannot change their own account here"})
+		return nil, false
+	}
+
+	user, err := getUserByID(r.Context(), conn, userID)
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get user")
+		return nil, false
+	}
+
+	return user, true
+}
+
+func handleAdminGetUsers(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		users, err := getAdminUsers(r.Context(), conn)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get users")
+			return
+		}
+
+		responses := make([]AdminUserResponse, len(users))
+		for i, user := range users {
+			responses[i] = newAdminUserResponse(user)
+		}
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+// handleAdminUpdateUser disables or enables a user and grants or revokes
+// admin access.
+func handleAdminUpdateUser(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Disabled *bool `json:"disabled"`
+			IsAdmin  *bool `json:"is_admin"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if body.Disabled != nil {
+			if err := updateUserDisabled(r.Context(), conn, user.ID, *body.Disabled); err != nil {
+				writeStoreError(w, r, err, "Unable to update disabled")
+				return
+			}
+		}
+
+		if body.IsAdmin != nil {
+			if err := updateUserAdmin(r.Context(), conn, user.ID, *body.IsAdmin); err != nil {
+				writeStoreError(w, r, err, "Unable to update admin")
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminLogoutUser deletes every session of a user.
+func handleAdminLogoutUser(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		if _, err := deleteSessions(r.Context(), conn, user.ID, time.Now()); err != nil {
+			writeStoreError(w, r, err, "Unable to delete sessions")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleAdminDeleteUser deletes a user along with everything they own.
+func handleAdminDeleteUser(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, ok := userFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		if err := deleteUser(r.Context(), conn, user.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete user")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func handleAdminStats(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		stats, err := getInstanceStats(r.Context(), conn)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get instance stats")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, stats)
+	}
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// calendarHistory is how far back completions are marked in a feed.
+	calendarHistory = 90 * 24 * time.Hour
+	// calendarLineLength is the longest a content line may be before it is
+	// folded, in octets.
+	calendarLineLength = 75
+)
+
+// CalendarFeed is a secret URL serving the user's tasks as iCalendar. Calendar
+// apps cannot send cookies or headers, so the token in the URL is the only
+// credential and feeds can be revoked one at a time.
+type CalendarFeed struct {
+	ID         int
+	UserID     int
+	Token      string
+	LastUsedAt *time.Time
+	CreatedAt  time.Time
+}
+
+type CalendarFeedResponse struct {
+	ID         int        `json:"id"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+	// URL is only returned when the feed is created, since it holds the
+	// token.
+	URL string `json:"url,omitempty"`
+}
+
+func newCalendarFeedResponse(feed *CalendarFeed) CalendarFeedResponse {
+	return CalendarFeedResponse{
+		ID:         feed.ID,
+		LastUsedAt: feed.LastUsedAt,
+		CreatedAt:  feed.CreatedAt,
+	}
+}
+
+// calendarWriter writes iCalendar content lines, escaping and folding them as
+// RFC 5545 requires.
+type calendarWriter struct {
+	buf bytes.Buffer
+}
+
+// line writes a content line, folding it onto continuation lines that start
+// with a space so that no line is longer than calendarLineLength octets.
+func (cw *calendarWriter) line(name, value string) {
+	s := name + ":" + value
+	limit := calendarLineLength
+	for len(s) > limit {
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(s[cut]) {
+			cut--
+		}
+		cw.buf.WriteString(s[:cut])
+		cw.buf.WriteString("\r\n ")
+		s = s[cut:]
+		// The leading space counts towards the length of the line.
+		limit = calendarLineLength - 1
+	}
+	cw.buf.WriteString(s)
+	cw.buf.WriteString("\r\n")
+}
+
+var calendarEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`, "\r", "")
+
+// text writes a property with a TEXT value.
+func (cw *calendarWriter) text(name, value string) {
+	cw.line(name, calendarEscaper.Replace(value))
+}
+
+// calendarOccurrence returns the start of the calendar entry for the
+// interval containing t. Hourly tasks take up their hour and daily tasks
+// their day; weekly and monthly tasks show on the last day of the interval,
+// when they are due.
+func calendarOccurrence(i Interval, t time.Time) time.Time {
+	start, end := i.bounds(t)
+	switch i {
+	case Hourly, Daily:
+		return start
+	default:
+		return end.AddDate(0, 0, -1)
+	}
+}
+
+// calendarTime writes a date or date-time property for an occurrence. Hourly
+// entries are in UTC; the rest are whole days, which calendars show on the
+// same date whatever their time zone.
+func (cw *calendarWriter) time(name string, i Interval, t time.Time) {
+	if i == Hourly {
+		cw.line(name, t.UTC().Format("20060102T150405Z"))
+		return
+	}
+	cw.line(name+";VALUE=DATE", t.Format("20060102"))
+}
+
+// event writes one entry of a task. The recurring entry has an RRULE and
+// entries for completed intervals override a single occurrence of it.
+func (cw *calendarWriter) event(task *Task, stamp, start time.Time, completedAt *time.Time) {
+	end := start.AddDate(0, 0, 1)
+	if task.Interval == Hourly {
+		end = start.Add(time.Hour)
+	}
+
+	cw.line("BEGIN", "VEVENT")
+	cw.line("UID", fmt.Sprintf("task-%d@didt", task.ID))
+	cw.line("DTSTAMP", stamp.UTC().Format("20060102T150405Z"))
+	if completedAt != nil {
+		cw.time("RECURRENCE-ID", task.Interval, start)
+	}
+	cw.time("DTSTART", task.Interval, start)
+	cw.time("DTEND", task.Interval, end)
+
+	description := task.Description
+	if completedAt == nil {
+		cw.line("RRULE", map[Interval]string{
+			Hourly:  "FREQ=HOURLY",
+			Daily:   "FREQ=DAILY",
+			Weekly:  "FREQ=WEEKLY",
+			Monthly: "FREQ=MONTHLY;BYMONTHDAY=-1",
+		}[task.Interval])
+		cw.text("SUMMARY", task.Name)
+	} else {
+		cw.text("SUMMARY", "✓ "+task.Name)
+		description = strings.TrimSpace("Done " + completedAt.Format("Mon 2 Jan 2006 15:04 MST") + "\n\n" + description)
+	}
+	if description != "" {
+		cw.text("DESCRIPTION", description)
+	}
+	cw.line("TRANSP", "TRANSPARENT")
+	cw.line("END", "VEVENT")
+}
+
+// writeCalendar writes the user's tasks as an iCalendar feed, with a
+// recurring event per task and the intervals completed in the last
+// calendarHistory marked with a tick.
+func writeCalendar(ctx context.Context, conn *pgxpool.Pool, cw *calendarWriter, user *User, now time.Time) error {
+	tasks, err := getTasks(ctx, conn, user.ID, TaskFilter{})
+	if err != nil {
+		return err
+	}
+	loc := user.location()
+
+	cw.line("BEGIN", "VCALENDAR")
+	cw.line("VERSION", "2.0")
+	cw.line("PRODID", "-//DidIDoThat//Tasks//EN")
+	cw.line("CALSCALE", "GREGORIAN")
+	cw.line("METHOD", "PUBLISH")
+	cw.text("X-WR-CALNAME", "Did I Do That? ("+user.Username+")")
+	cw.line("X-WR-TIMEZONE", loc.String())
+	cw.line("REFRESH-INTERVAL;VALUE=DURATION", "PT1H")
+	cw.line("X-PUBLISHED-TTL", "PT1H")
+
+	for _, task := range tasks {
+		if task.Interval < Hourly || task.Interval > Monthly {
+			continue
+		}
+
+		first := calendarOccurrence(task.Interval, task.CreatedAt.In(loc))
+		cw.event(task, now, first, nil)
+
+		completions, err := getCompletionTimes(ctx, conn, task.ID, now.Add(-calendarHistory), now)
+		if err != nil {
+			return err
+		}
+
+		marked := map[int64]bool{}
+		for _, completedAt := range completions {
+			completedAt = completedAt.In(loc)
+			start := calendarOccurrence(task.Interval, completedAt)
+			if start.Before(first) || marked[start.Unix()] {
+				continue
+			}
+			marked[start.Unix()] = true
+			cw.event(task, now, start, &completedAt)
+		}
+	}
+
+	cw.line("END", "VCALENDAR")
+	return nil
+}
+
+// handleCalendar serves the feed for the token in the path. It is not behind
+// withUser since calendar apps only have the URL.
+func handleCalendar(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := useCalendarFeed(r.Context(), conn, r.PathValue("token"))
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get calendar feed")
+			return
+		}
+		if refuseDisabled(w, r, user) {
+			return
+		}
+
+		cw := &calendarWriter{}
+		if err := writeCalendar(r.Context(), conn, cw, user, time.Now()); err != nil {
+			writeStoreError(w, r, err, "Unable to write calendar feed")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+		w.Header().Set("Cache-Control", "private, no-cache")
+		if _, err := w.Write(cw.buf.Bytes()); err != nil {
+			loggerFrom(r.Context()).Error("Unable to write calendar feed", "error", err.Error())
+		}
+	}
+}
+
+func handleGetCalendarFeeds(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		feeds, err := getCalendarFeeds(r.Context(), conn, user.ID)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get calendar feeds")
+			return
+		}
+
+		resp := make([]CalendarFeedResponse, 0, len(feeds))
+		for _, feed := range feeds {
+			resp = append(resp, newCalendarFeedResponse(feed))
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+// handleCreateCalendarFeed creates a feed and returns its URL, which is
+// absolute when public_url is configured.
+func handleCreateCalendarFeed(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		feed := &CalendarFeed{UserID: user.ID, Token: newToken() + newToken()}
+		if err := insertCalendarFeed(r.Context(), conn, feed); err != nil {
+			writeStoreError(w, r, err, "Unable to insert calendar feed")
+			return
+		}
+
+		resp := newCalendarFeedResponse(feed)
+		resp.URL = cfg.PublicURL + "/api/calendar/" + feed.Token + "/tasks.ics"
+
+		w.Header().Set("Location", fmt.Sprintf("/api/calendar/feeds/%d", feed.ID))
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+func handleDeleteCalendarFeed(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		feedID, err := strconv.Atoi(r.PathValue("feedId"))
+		if err != nil {
+			writeFieldErrors(w, FieldErrors{"feed_id": "feed_id must be an integer"})
+			return
+		}
+
+		if err := deleteCalendarFeed(r.Context(), conn, user.ID, feedID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete calendar feed")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// unfoldCalendar joins folded lines back together and splits the content
+// lines.
+func unfoldCalendar(s string) []string {
+	return strings.Split(strings.TrimSuffix(strings.ReplaceAll(s, "\r\n ", ""), "\r\n"), "\r\n")
+}
+
+func TestCalendarLineFolding(t *testing.T) {
+	tests := map[string]string{
+		"short":             "Stretch",
+		"exactly one line":  strings.Repeat("a", calendarLineLength-len("SUMMARY:")),
+		"ascii":             strings.Repeat("abcdefghij", 20),
+		"two byte runes":    "x" + strings.Repeat("é", 120),
+		"three byte runes":  strings.Repeat("✓", 80),
+		"four byte runes":   "ab" + strings.Repeat("🏃", 60),
+		"mixed multibyte":   strings.Repeat("aé✓🏃", 30),
+		"rune at the limit": strings.Repeat("a", calendarLineLength-len("SUMMARY:")-1) + "é" + strings.Repeat("a", 80),
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			var cw calendarWriter
+			cw.line("SUMMARY", value)
+			out := cw.buf.String()
+
+			if !strings.HasSuffix(out, "\r\n") {
+				t.Fatalf("line does not end with CRLF: %q", out)
+			}
+			lines := strings.Split(strings.TrimSuffix(out, "\r\n"), "\r\n")
+			for i, line := range lines {
+				if len(line) > calendarLineLength {
+					t.Errorf("line %d is %d octets: %q", i, len(line), line)
+				}
+				if i > 0 && !strings.HasPrefix(line, " ") {
+					t.Errorf("continuation line %d does not start with a space: %q", i, line)
+				}
+				if !utf8.ValidString(line) {
+					t.Errorf("line %d splits a rune: %q", i, line)
+				}
+			}
+			if len(out) <= calendarLineLength+2 && len(lines) != 1 {
+				t.Errorf("a line that fits was folded into %d", len(lines))
+			}
+
+			if got := unfoldCalendar(out); len(got) != 1 || got[0] != "SUMMARY:"+value {
+				t.Errorf("unfolded to %q", got)
+			}
+		})
+	}
+}
+
+func TestCalendarText(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"Stretch", `Stretch`},
+		{"Eat, sleep; repeat", `Eat\, sleep\; repeat`},
+		{`C:\Users\me`, `C:\\Users\\me`},
+		{"one\ntwo\r\nthree\rfour", `one\ntwo\nthreefour`},
+		{`\,`, `\\\,`},
+	}
+
+	for _, tt := range tests {
+		var cw calendarWriter
+		cw.text("DESCRIPTION", tt.value)
+		if got := cw.buf.String(); got != "DESCRIPTION:"+tt.want+"\r\n" {
+			t.Errorf("text(%q) = %q, want %q", tt.value, got, "DESCRIPTION:"+tt.want+"\r\n")
+		}
+	}
+}
+
+// calendarProperties returns the value of each property of a single event,
+// keyed by its name and parameters.
+func calendarProperties(t *testing.T, out string) map[string]string {
+	t.Helper()
+	props := map[string]string{}
+	for _, line := range unfoldCalendar(out) {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			t.Fatalf("line has no value: %q", line)
+		}
+		props[name] = value
+	}
+	return props
+}
+
+func TestCalendarEvent(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stamp := time.Date(2024, 3, 6, 9, 0, 0, 0, time.UTC)
+	// A Wednesday in a leap year, an hour ahead of UTC.
+	created := time.Date(2024, 2, 7, 14, 20, 0, 0, berlin)
+
+	tests := []struct {
+		interval Interval
+		start    string
+		end      string
+		rrule    string
+	}{
+		{Hourly, "DTSTART:20240207T130000Z", "DTEND:20240207T140000Z", "FREQ=HOURLY"},
+		{Daily, "DTSTART;VALUE=DATE:20240207", "DTEND;VALUE=DATE:20240208", "FREQ=DAILY"},
+		// Weekly tasks are due on the Sunday ending their week.
+		{Weekly, "DTSTART;VALUE=DATE:20240211", "DTEND;VALUE=DATE:20240212", "FREQ=WEEKLY"},
+		{Monthly, "DTSTART;VALUE=DATE:20240229", "DTEND;VALUE=DATE:20240301", "FREQ=MONTHLY;BYMONTHDAY=-1"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.interval.String(), func(t *testing.T) {
+			task := &Task{ID: 3, Name: "Stretch", Description: "Ten minutes", Interval: tt.interval}
+			start := calendarOccurrence(tt.interval, created)
+
+			var cw calendarWriter
+			cw.event(task, stamp, start, nil)
+			props := calendarProperties(t, cw.buf.String())
+
+			startName, startValue, _ := strings.Cut(tt.start, ":")
+			endName, endValue, _ := strings.Cut(tt.end, ":")
+			if props[startName] != startValue || props[endName] != endValue {
+				t.Errorf("got %s:%s and %s:%s, want %s and %s", startName, props[startName], endName, props[endName], tt.start, tt.end)
+			}
+			if props["RRULE"] != tt.rrule {
+				t.Errorf("got RRULE %q, want %q", props["RRULE"], tt.rrule)
+			}
+			if props["UID"] != "task-3@didt" || props["DTSTAMP"] != "20240306T090000Z" || props["SUMMARY"] != "Stretch" || props["DESCRIPTION"] != "Ten minutes" {
+				t.Errorf("got %v", props)
+			}
+			if _, ok := props["RECURRENCE-ID"]; ok {
+				t.Error("the recurring event has a RECURRENCE-ID")
+			}
+
+			// A completed interval overrides its occurrence of the
+			// recurring event.
+			completedAt := created.Add(10 * time.Minute)
+			cw = calendarWriter{}
+			cw.event(task, stamp, start, &completedAt)
+			props = calendarProperties(t, cw.buf.String())
+
+			recurrenceName := strings.Replace(startName, "DTSTART", "RECURRENCE-ID", 1)
+			if props[recurrenceName] != startValue || props[startName] != startValue {
+				t.Errorf("got %s:%s for start %s", recurrenceName, props[recurrenceName], tt.start)
+			}
+			if _, ok := props["RRULE"]; ok {
+				t.Error("a completed occurrence has an RRULE")
+			}
+			if props["SUMMARY"] != "✓ Stretch" || props["DESCRIPTION"] != `Done Wed 7 Feb 2024 14:30 CET\n\nTen minutes` {
+				t.Errorf("got %v", props)
+			}
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// These mirror the layouts of the intervals_map keys in the server.
+const (
+	layoutHourly = "2006-01-02T15Z07:00"
+	layout       = "2006-01-02Z07:00"
+)
+
+// Task is a task as returned by the API.
+type Task struct {
+	ID           int             `json:"id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Interval     string          `json:"interval"`
+	IntervalsMap map[string]bool `json:"intervals_map"`
+	ArchivedAt   *time.Time      `json:"archived_at"`
+	Paused       bool            `json:"paused"`
+	// PausedIntervals are the keys of IntervalsMap that fall in a pause.
+	PausedIntervals []string `json:"paused_intervals"`
+	Streak          int      `json:"streak"`
+	GroupID         *int     `json:"group_id"`
+}
+
+// Group is a group that tasks are filed under.
+type Group struct {
+	ID    int    `json:"id"`
+	Name  string `json:"name"`
+	Tasks int    `json:"tasks"`
+}
+
+// Interval is one entry of a task's intervals_map.
+type Interval struct {
+	Start  time.Time
+	Done   bool
+	Paused bool
+}
+
+// history returns the task's recent intervals oldest first, leaving out
+// those that ended before the task was created.
+func (t *Task) history() []Interval {
+	l, length := layout, 24*time.Hour
+	switch t.Interval {
+	case "Hourly":
+		l, length = layoutHourly, time.Hour
+	case "Weekly":
+		length = 7 * 24 * time.Hour
+	case "Monthly":
+		length = 30 * 24 * time.Hour
+	}
+
+	intervals := []Interval{}
+	for key, done := range t.IntervalsMap {
+		start, err := time.Parse(l, key)
+		if err != nil || !start.Add(length).After(t.CreatedAt) {
+			continue
+		}
+		intervals = append(intervals, Interval{Start: start, Done: done, Paused: slices.Contains(t.PausedIntervals, key)})
+	}
+	sort.Slice(intervals, func(i, j int) bool { return intervals[i].Start.Before(intervals[j].Start) })
+
+	return intervals
+}
+
+// APIError is an error response from the API.
+type APIError struct {
+	Status      int               `json:"-"`
+	Code        string            `json:"code"`
+	Message     string            `json:"message"`
+	FieldErrors map[string]string `json:"field_errors"`
+}
+
+func (e *APIError) Error() string {
+	if len(e.FieldErrors) == 0 {
+		return e.Message
+	}
+
+	fields := make([]string, 0, len(e.FieldErrors))
+	for _, message := range e.FieldErrors {
+		fields = append(fields, message)
+	}
+	sort.Strings(fields)
+	return strings.Join(fields, "; ")
+}
+
+// client calls the DidIDoThat API with a bearer token.
+type client struct {
+	server string
+	token  string
+	http   *http.Client
+}
+
+func newClient(server, token string) *client {
+	return &client{
+		server: strings.TrimRight(server, "/"),
+		token:  token,
+		http:   &http.Client{Timeout: 30 * time.Second},
+	}
+}
+
+// do sends body as JSON and decodes the response into out, if it is not nil.
+// Error responses are returned as an *APIError.
+func (c *client) do(ctx context.Context, method, path string, body, out any) error {
+	var reader io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(b)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, c.server+path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		apiErr := &APIError{Status: resp.StatusCode}
+		if err := json.NewDecoder(resp.Body).Decode(apiErr); err != nil || apiErr.Message == "" {
+			apiErr.Message = fmt.Sprintf("%s %s: %s", method, path, resp.Status)
+		}
+		if resp.StatusCode == http.StatusUnauthorized && c.token != "" {
+			apiErr.Message += "; run didt login"
+		}
+		return apiErr
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func (c *client) login(ctx context.Context, username, password string) (string, error) {
+	var resp struct {
+		Token string `json:"token"`
+	}
+	err := c.do(ctx, http.MethodPost, "/api/auth/token", map[string]string{
+		"username": username,
+		"password": password,
+	}, &resp)
+	return resp.Token, err
+}
+
+func (c *client) logout(ctx context.Context) error {
+	return c.do(ctx, http.MethodDelete, "/api/auth/token", nil, nil)
+}
+
+// tasks lists the user's tasks. The query takes the include, group and sort
+// parameters of the API; without a sort the tasks come in the user's order.
+func (c *client) tasks(ctx context.Context, query url.Values) ([]*Task, error) {
+	path := "/api/tasks"
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+
+	tasks := []*Task{}
+	if err := c.do(ctx, http.MethodGet, path, nil, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// reorder moves the tasks in ids to the top of the user's list in that
+// order.
+func (c *client) reorder(ctx context.Context, ids []int) error {
+	return c.do(ctx, http.MethodPut, "/api/tasks/order", map[string][]int{"task_ids": ids}, nil)
+}
+
+func (c *client) groups(ctx context.Context) ([]*Group, error) {
+	groups := []*Group{}
+	if err := c.do(ctx, http.MethodGet, "/api/groups", nil, &groups); err != nil {
+		return nil, err
+	}
+	return groups, nil
+}
+
+func (c *client) task(ctx context.Context, id int) (*Task, error) {
+	task := &Task{}
+	err := c.do(ctx, http.MethodGet, fmt.Sprintf("/api/tasks/%d", id), nil, task)
+	return task, err
+}
+
+func (c *client) complete(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodPost, fmt.Sprintf("/api/tasks/%d/complete", id), nil, nil)
+}
+
+func (c *client) createTask(ctx context.Context, name, description, interval string) (*Task, error) {
+	task := &Task{}
+	err := c.do(ctx, http.MethodPost, "/api/tasks", map[string]string{
+		"name":        name,
+		"description": description,
+		"interval":    interval,
+	}, task)
+	return task, err
+}
+
+// updateTask changes only the fields set in changes.
+func (c *client) updateTask(ctx context.Context, id int, changes map[string]any) (*Task, error) {
+	task := &Task{}
+	err := c.do(ctx, http.MethodPatch, fmt.Sprintf("/api/tasks/%d", id), changes, task)
+	return task, err
+}
+
+func (c *client) deleteTask(ctx context.Context, id int) error {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/api/tasks/%d", id), nil, nil)
+}
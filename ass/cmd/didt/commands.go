@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"os/exec"
+	"slices"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+// parseArgs parses fs allowing flags after positional arguments, as in
+// didt create Stretch -i daily, and returns the positional arguments.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+// taskArg finds the task named by the positional arguments, joined so that
+// names with spaces do not need quoting. Archived tasks are only searched
+// when archived is set.
+func (a *app) taskArg(ctx context.Context, args []string, archived bool) (*Task, error) {
+	if len(args) == 0 {
+		return nil, errors.New("a task ID or name is required")
+	}
+
+	var query url.Values
+	if archived {
+		query = url.Values{"include": {"archived"}}
+	}
+	tasks, err := a.client.tasks(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return findTask(tasks, strings.Join(args, " "))
+}
+
+// groupArg turns a group name or ID into the group's ID. The name none is
+// passed through, as it stands for the tasks without a group.
+func (a *app) groupArg(ctx context.Context, name string) (string, error) {
+	if _, err := strconv.Atoi(name); err == nil || name == "none" {
+		return name, nil
+	}
+
+	groups, err := a.client.groups(ctx)
+	if err != nil {
+		return "", err
+	}
+	for _, g := range groups {
+		if strings.EqualFold(g.Name, name) {
+			return strconv.Itoa(g.ID), nil
+		}
+	}
+	return "", fmt.Errorf("no group is called %q", name)
+}
+
+func isTerminal(r io.Reader) bool {
+	f, ok := r.(*os.File)
+	if !ok {
+		return false
+	}
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// readPassword reads a password from DIDT_PASSWORD or a line of stdin. Echo
+// is turned off with stty when stdin is a terminal, which keeps the client
+// free of dependencies; where stty is missing the password is echoed.
+func (a *app) readPassword() (string, error) {
+	if password := os.Getenv("DIDT_PASSWORD"); password != "" {
+		return password, nil
+	}
+
+	fmt.Fprint(a.stderr, "Password: ")
+	if isTerminal(a.stdin) {
+		stty := func(arg string) error {
+			cmd := exec.Command("stty", arg)
+			cmd.Stdin = a.stdin
+			return cmd.Run()
+		}
+		if stty("-echo") == nil {
+			defer func() {
+				_ = stty("echo")
+				fmt.Fprintln(a.stderr)
+			}()
+		}
+	}
+
+	line, err := bufio.NewReader(a.stdin).ReadString('\n')
+	if err != nil && !(errors.Is(err, io.EOF) && line != "") {
+		return "", errors.New("a password is required")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+func cmdLogin(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("login", flag.ContinueOnError)
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return errors.New("usage: didt login <username>")
+	}
+
+	password, err := a.readPassword()
+	if err != nil {
+		return err
+	}
+
+	token, err := a.client.login(ctx, args[0], password)
+	if err != nil {
+		return err
+	}
+
+	a.cfg.Token = token
+	if err := a.cfg.save(); err != nil {
+		return fmt.Errorf("unable to save token: %w", err)
+	}
+
+	return a.print(map[string]string{"username": args[0], "server": a.cfg.Server}, func() {
+		fmt.Fprintf(a.stdout, "Logged in to %s as %s\n", a.cfg.Server, args[0])
+	})
+}
+
+func cmdLogout(ctx context.Context, a *app, _ []string) error {
+	if a.cfg.Token == "" {
+		return errors.New("not logged in")
+	}
+
+	// Forget the token even if the server no longer knows it.
+	var apiErr *APIError
+	if err := a.client.logout(ctx); err != nil && !(errors.As(err, &apiErr) && apiErr.Status == 401) {
+		return err
+	}
+
+	a.cfg.Token = ""
+	if err := a.cfg.save(); err != nil {
+		return fmt.Errorf("unable to forget token: %w", err)
+	}
+
+	return a.print(map[string]bool{"logged_out": true}, func() {
+		fmt.Fprintln(a.stdout, "Logged out")
+	})
+}
+
+// grid draws a task's recent history oldest first: # for a completed
+// interval, - for a paused one, . for a missed one and _ for the current
+// interval when it is still to do.
+func grid(t *Task) string {
+	history := t.history()
+
+	var b strings.Builder
+	for i, interval := range history {
+		switch {
+		case interval.Done:
+			b.WriteByte('#')
+		case interval.Paused:
+			b.WriteByte('-')
+		case i == len(history)-1:
+			b.WriteByte('_')
+		default:
+			b.WriteByte('.')
+		}
+	}
+	return b.String()
+}
+
+// status describes a task that is archived or paused, and is empty
+// otherwise.
+func status(t *Task) string {
+	switch {
+	case t.ArchivedAt != nil:
+		return "archived"
+	case t.Paused:
+		return "paused"
+	}
+	return ""
+}
+
+func writeTasks(w io.Writer, tasks []*Task) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tTASK\tINTERVAL\tHISTORY\tSTATUS")
+	for _, t := range tasks {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%s\n", t.ID, t.Name, t.Interval, grid(t), status(t))
+	}
+	tw.Flush()
+}
+
+func cmdList(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("list", flag.ContinueOnError)
+	archived := fs.Bool("a", false, "include archived tasks")
+	sort := fs.String("s", "", "sort by name, created_at, interval, next_due or streak, with a leading - to reverse")
+	group := fs.String("g", "", "only list the tasks of this group, or none for those without one")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if *archived {
+		query.Set("include", "archived")
+	}
+	if *sort != "" {
+		query.Set("sort", *sort)
+	}
+	if *group != "" {
+		id, err := a.groupArg(ctx, *group)
+		if err != nil {
+			return err
+		}
+		query.Set("group", id)
+	}
+
+	tasks, err := a.client.tasks(ctx, query)
+	if err != nil {
+		return err
+	}
+
+	return a.print(tasks, func() {
+		if len(tasks) == 0 {
+			fmt.Fprintln(a.stdout, "No tasks yet; add one with didt create")
+			return
+		}
+		writeTasks(a.stdout, tasks)
+	})
+}
+
+func cmdDone(ctx context.Context, a *app, args []string) error {
+	task, err := a.taskArg(ctx, args, false)
+	if err != nil {
+		return err
+	}
+
+	history := task.history()
+	already := len(history) > 0 && history[len(history)-1].Done
+	if !already {
+		if err := a.client.complete(ctx, task.ID); err != nil {
+			return err
+		}
+		if task, err = a.client.task(ctx, task.ID); err != nil {
+			return err
+		}
+	}
+
+	return a.print(task, func() {
+		if already {
+			fmt.Fprintf(a.stdout, "%s was already done this interval\n", task.Name)
+			return
+		}
+		fmt.Fprintf(a.stdout, "Done: %s  %s\n", task.Name, grid(task))
+	})
+}
+
+func cmdCreate(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("create", flag.ContinueOnError)
+	description := fs.String("d", "", "description")
+	interval := fs.String("i", "daily", "hourly, daily, weekly or monthly")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: didt create [-d text] [-i interval] <name>")
+	}
+
+	task, err := a.client.createTask(ctx, strings.Join(args, " "), *description, *interval)
+	if err != nil {
+		return err
+	}
+
+	return a.print(task, func() {
+		fmt.Fprintf(a.stdout, "Created %s (%d), %s\n", task.Name, task.ID, strings.ToLower(task.Interval))
+	})
+}
+
+func cmdEdit(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("edit", flag.ContinueOnError)
+	fs.String("name", "", "new name")
+	fs.String("d", "", "new description")
+	fs.String("i", "", "new interval")
+	group := fs.String("g", "", "group to file the task under, or none")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	fields := map[string]string{"name": "name", "d": "description", "i": "interval"}
+	changes := map[string]any{}
+	fs.Visit(func(f *flag.Flag) {
+		if field, ok := fields[f.Name]; ok {
+			changes[field] = f.Value.String()
+		}
+	})
+	switch *group {
+	case "":
+	case "none":
+		changes["group_id"] = nil
+	default:
+		id, err := a.groupArg(ctx, *group)
+		if err != nil {
+			return err
+		}
+		changes["group_id"], _ = strconv.Atoi(id)
+	}
+	if len(changes) == 0 {
+		return errors.New("usage: didt edit [-name name] [-d text] [-i interval] [-g group] <task>")
+	}
+
+	task, err := a.taskArg(ctx, args, true)
+	if err != nil {
+		return err
+	}
+	if task, err = a.client.updateTask(ctx, task.ID, changes); err != nil {
+		return err
+	}
+
+	return a.print(task, func() {
+		fmt.Fprintf(a.stdout, "Updated %s (%d)\n", task.Name, task.ID)
+	})
+}
+
+func cmdDelete(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("delete", flag.ContinueOnError)
+	yes := fs.Bool("y", false, "do not ask for confirmation")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	task, err := a.taskArg(ctx, args, true)
+	if err != nil {
+		return err
+	}
+
+	if !*yes {
+		if !isTerminal(a.stdin) {
+			return errors.New("pass -y to delete without a terminal to confirm on")
+		}
+		fmt.Fprintf(a.stderr, "Delete %s and all of its history? [y/N] ", task.Name)
+		answer, _ := bufio.NewReader(a.stdin).ReadString('\n')
+		if !strings.EqualFold(strings.TrimSpace(answer), "y") {
+			return errors.New("not deleted")
+		}
+	}
+
+	if err := a.client.deleteTask(ctx, task.ID); err != nil {
+		return err
+	}
+
+	return a.print(map[string]int{"deleted": task.ID}, func() {
+		fmt.Fprintf(a.stdout, "Deleted %s\n", task.Name)
+	})
+}
+
+func cmdMove(ctx context.Context, a *app, args []string) error {
+	fs := flag.NewFlagSet("move", flag.ContinueOnError)
+	to := fs.Int("to", 1, "place in the list to move the task to, counting from 1")
+	args, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return errors.New("usage: didt move [-to n] <task>")
+	}
+
+	tasks, err := a.client.tasks(ctx, nil)
+	if err != nil {
+		return err
+	}
+	task, err := findTask(tasks, strings.Join(args, " "))
+	if err != nil {
+		return err
+	}
+
+	ids := []int{}
+	for _, t := range tasks {
+		if t.ID != task.ID {
+			ids = append(ids, t.ID)
+		}
+	}
+	place := min(max(*to, 1), len(tasks))
+	ids = slices.Insert(ids, place-1, task.ID)
+
+	if err := a.client.reorder(ctx, ids); err != nil {
+		return err
+	}
+
+	return a.print(map[string]int{"moved": task.ID, "place": place}, func() {
+		fmt.Fprintf(a.stdout, "Moved %s to %d\n", task.Name, place)
+	})
+}
+
+// setTask turns the archived or paused field of the task named by args on
+// or off, printing done as what happened to it.
+func setTask(ctx context.Context, a *app, args []string, field string, on bool, done string) error {
+	// Only archived tasks can be unarchived, and the others are searched
+	// without them so that an archived namesake does not make a name
+	// ambiguous.
+	task, err := a.taskArg(ctx, args, field == "archived" && !on)
+	if err != nil {
+		return err
+	}
+	if task, err = a.client.updateTask(ctx, task.ID, map[string]any{field: on}); err != nil {
+		return err
+	}
+
+	return a.print(task, func() {
+		fmt.Fprintf(a.stdout, "%s %s\n", done, task.Name)
+	})
+}
+
+func cmdArchive(ctx context.Context, a *app, args []string) error {
+	return setTask(ctx, a, args, "archived", true, "Archived")
+}
+
+func cmdUnarchive(ctx context.Context, a *app, args []string) error {
+	return setTask(ctx, a, args, "archived", false, "Unarchived")
+}
+
+func cmdPause(ctx context.Context, a *app, args []string) error {
+	return setTask(ctx, a, args, "paused", true, "Paused")
+}
+
+func cmdResume(ctx context.Context, a *app, args []string) error {
+	return setTask(ctx, a, args, "paused", false, "Resumed")
+}
+
+// TaskStats summarises a task over the intervals the API returns, which
+// are the last 30.
+type TaskStats struct {
+	ID            int     `json:"id"`
+	Name          string  `json:"name"`
+	Interval      string  `json:"interval"`
+	Intervals     int     `json:"intervals"`
+	Completed     int     `json:"completed"`
+	Rate          float64 `json:"completion_rate"`
+	CurrentStreak int     `json:"current_streak"`
+	LongestStreak int     `json:"longest_streak"`
+}
+
+type Stats struct {
+	Tasks     []TaskStats `json:"tasks"`
+	Intervals int         `json:"intervals"`
+	Completed int         `json:"completed"`
+	Rate      float64     `json:"completion_rate"`
+}
+
+// taskStats counts a task's completed intervals and streaks. The current
+// interval only counts once it is done, so an open interval neither lowers
+// the rate nor breaks the current streak. Paused intervals are left out
+// unless they were done anyway.
+func taskStats(t *Task) TaskStats {
+	history := t.history()
+	if n := len(history); n > 0 && !history[n-1].Done {
+		history = history[:n-1]
+	}
+	history = slices.DeleteFunc(history, func(interval Interval) bool { return interval.Paused && !interval.Done })
+
+	s := TaskStats{ID: t.ID, Name: t.Name, Interval: t.Interval, Intervals: len(history)}
+	streak := 0
+	for _, interval := range history {
+		if !interval.Done {
+			streak = 0
+			continue
+		}
+		s.Completed++
+		streak++
+		s.LongestStreak = max(s.LongestStreak, streak)
+	}
+	s.CurrentStreak = streak
+	if s.Intervals > 0 {
+		s.Rate = float64(s.Completed) / float64(s.Intervals)
+	}
+
+	return s
+}
+
+func cmdStats(ctx context.Context, a *app, _ []string) error {
+	tasks, err := a.client.tasks(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	stats := Stats{Tasks: []TaskStats{}}
+	for _, t := range tasks {
+		s := taskStats(t)
+		stats.Tasks = append(stats.Tasks, s)
+		stats.Intervals += s.Intervals
+		stats.Completed += s.Completed
+	}
+	if stats.Intervals > 0 {
+		stats.Rate = float64(stats.Completed) / float64(stats.Intervals)
+	}
+
+	return a.print(stats, func() {
+		tw := tabwriter.NewWriter(a.stdout, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(tw, "TASK\tINTERVAL\tDONE\tRATE\tSTREAK\tBEST")
+		for _, s := range stats.Tasks {
+			fmt.Fprintf(tw, "%s\t%s\t%d/%d\t%.0f%%\t%d\t%d\n", s.Name, s.Interval, s.Completed, s.Intervals, 100*s.Rate, s.CurrentStreak, s.LongestStreak)
+		}
+		fmt.Fprintf(tw, "All tasks\t\t%d/%d\t%.0f%%\t\t\n", stats.Completed, stats.Intervals, 100*stats.Rate)
+		tw.Flush()
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+const defaultServer = "http://localhost:8019"
+
+// config is saved by didt login. DIDT_SERVER and DIDT_TOKEN take precedence
+// over it, so scripts can run without logging in.
+type config struct {
+	Server string `json:"server"`
+	Token  string `json:"token"`
+}
+
+// configPath returns where the config is saved, under the user's config
+// directory.
+func configPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "didt", "config.json"), nil
+}
+
+func loadConfig() (*config, error) {
+	cfg := &config{Server: defaultServer}
+
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if err == nil {
+		if err := json.Unmarshal(b, cfg); err != nil {
+			return nil, err
+		}
+	}
+
+	if server := os.Getenv("DIDT_SERVER"); server != "" {
+		cfg.Server = server
+	}
+	if token := os.Getenv("DIDT_TOKEN"); token != "" {
+		cfg.Token = token
+	}
+
+	return cfg, nil
+}
+
+// save writes the config readable only by the user, since it holds the
+// token. It is written to a new file that replaces the old one, so that a
+// config created with looser permissions does not keep them.
+func (c *config) save() error {
+	path, err := configPath()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return err
+	}
+
+	b, err := json.MarshalIndent(c, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// CreateTemp makes the file readable only by the user.
+	f, err := os.CreateTemp(filepath.Dir(path), ".config-*.json")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestConfigSave(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("the config directory is only moved with XDG_CONFIG_HOME on Linux")
+	}
+	t.Setenv("XDG_CONFIG_HOME", t.TempDir())
+	t.Setenv("DIDT_SERVER", "")
+	t.Setenv("DIDT_TOKEN", "")
+
+	path, err := configPath()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A config written by an older version may be readable by others.
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(`{"server": "http://old.example"}`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := &config{Server: "https://didt.example.com", Token: "didt_secret"}
+	if err := cfg.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if perm := info.Mode().Perm(); perm != 0o600 {
+		t.Errorf("config has permissions %o, want 600", perm)
+	}
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("config directory holds %d files, want 1", len(entries))
+	}
+
+	loaded, err := loadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *loaded != *cfg {
+		t.Errorf("loaded %+v, want %+v", loaded, cfg)
+	}
+}
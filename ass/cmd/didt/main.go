@@ -0,0 +1,130 @@
+// Command didt is a command-line client for DidIDoThat. It talks to the
+// server's HTTP API with a token saved by didt login.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+)
+
+const usage = `Usage: didt [-server URL] [-json] <command> [arguments]
+
+Commands:
+  login <username>                 log in and save an API token
+  logout                           revoke and forget the saved token
+  list [-a] [-s sort] [-g group]   list tasks with their recent history,
+                                   and archived ones with -a
+  done <task>                      complete a task for the current interval
+  create [-d text] [-i interval] <name>
+                                   create a task (interval defaults to daily)
+  edit [-name name] [-d text] [-i interval] [-g group] <task>
+                                   change a task
+  move [-to n] <task>              move a task to a place in the list
+  delete [-y] <task>               delete a task and its history
+  archive <task>                   hide a task without losing its history
+  unarchive <task>                 bring back an archived task
+  pause <task>                     pause a task from today, so that missed
+                                   intervals do not break its streak
+  resume <task>                    end the pause of a task
+  stats                            show completion rates and streaks
+
+A task is its ID or any unambiguous part of its name. The server and token
+can also be set with DIDT_SERVER and DIDT_TOKEN.
+`
+
+// app holds what every command needs.
+type app struct {
+	cfg    *config
+	client *client
+	json   bool
+	stdin  io.Reader
+	stdout io.Writer
+	stderr io.Writer
+}
+
+// print writes v as JSON when -json is set and otherwise calls text.
+func (a *app) print(v any, text func()) error {
+	if !a.json {
+		text()
+		return nil
+	}
+
+	enc := json.NewEncoder(a.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+var commands = map[string]func(context.Context, *app, []string) error{
+	"login":     cmdLogin,
+	"logout":    cmdLogout,
+	"list":      cmdList,
+	"ls":        cmdList,
+	"done":      cmdDone,
+	"create":    cmdCreate,
+	"edit":      cmdEdit,
+	"delete":    cmdDelete,
+	"rm":        cmdDelete,
+	"move":      cmdMove,
+	"archive":   cmdArchive,
+	"unarchive": cmdUnarchive,
+	"pause":     cmdPause,
+	"resume":    cmdResume,
+	"stats":     cmdStats,
+}
+
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) error {
+	cfg, err := loadConfig()
+	if err != nil {
+		return fmt.Errorf("unable to load config: %w", err)
+	}
+
+	fs := flag.NewFlagSet("didt", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() { fmt.Fprint(stderr, usage) }
+	server := fs.String("server", cfg.Server, "URL of the DidIDoThat server")
+	asJSON := fs.Bool("json", false, "print JSON for scripting")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	cfg.Server = *server
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return errors.New("a command is required")
+	}
+	cmd, ok := commands[fs.Arg(0)]
+	if !ok {
+		fs.Usage()
+		return fmt.Errorf("unknown command %q", fs.Arg(0))
+	}
+
+	a := &app{
+		cfg:    cfg,
+		client: newClient(cfg.Server, cfg.Token),
+		json:   *asJSON,
+		stdin:  stdin,
+		stdout: stdout,
+		stderr: stderr,
+	}
+	return cmd(ctx, a, fs.Args()[1:])
+}
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+
+	err := run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "didt:", err)
+		os.Exit(1)
+	}
+}
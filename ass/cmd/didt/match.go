@@ -0,0 +1,68 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// findTask picks the task the user meant by query, which is either an ID or
+// part of a name. Matches are tried from exact to loose: the whole name, a
+// prefix, a substring and finally the letters of query in order, ignoring
+// case. A query matching several tasks equally well is an error listing
+// them.
+func findTask(tasks []*Task, query string) (*Task, error) {
+	if id, err := strconv.Atoi(query); err == nil {
+		for _, t := range tasks {
+			if t.ID == id {
+				return t, nil
+			}
+		}
+	}
+
+	q := strings.ToLower(strings.TrimSpace(query))
+	matchers := []func(name string) bool{
+		func(name string) bool { return name == q },
+		func(name string) bool { return strings.HasPrefix(name, q) },
+		func(name string) bool { return strings.Contains(name, q) },
+		func(name string) bool { return subsequence(name, q) },
+	}
+
+	for _, match := range matchers {
+		var found []*Task
+		for _, t := range tasks {
+			if match(strings.ToLower(t.Name)) {
+				found = append(found, t)
+			}
+		}
+
+		switch len(found) {
+		case 0:
+			continue
+		case 1:
+			return found[0], nil
+		default:
+			names := make([]string, len(found))
+			for i, t := range found {
+				names[i] = fmt.Sprintf("%q (%d)", t.Name, t.ID)
+			}
+			return nil, fmt.Errorf("%q matches %s; use more of the name or the ID", query, strings.Join(names, ", "))
+		}
+	}
+
+	return nil, fmt.Errorf("no task matches %q", query)
+}
+
+// subsequence reports whether the runes of q appear in s in order.
+func subsequence(s, q string) bool {
+	rest := []rune(q)
+	for _, r := range s {
+		if len(rest) == 0 {
+			break
+		}
+		if r == rest[0] {
+			rest = rest[1:]
+		}
+	}
+	return len(rest) == 0
+}
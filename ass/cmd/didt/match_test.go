@@ -0,0 +1,83 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestFindTask(t *testing.T) {
+	tasks := []*Task{
+		{ID: 1, Name: "Stretch"},
+		{ID: 2, Name: "Stretch hamstrings"},
+		{ID: 3, Name: "Read"},
+		{ID: 4, Name: "Water the plants"},
+		{ID: 5, Name: "Water the garden"},
+		{ID: 42, Name: "Practise piano"},
+		{ID: 7, Name: "2024 taxes"},
+	}
+
+	tests := []struct {
+		query string
+		want  int
+		// err is part of the error expected instead of a task.
+		err string
+	}{
+		{"42", 42, ""},
+		{"2024 taxes", 7, ""},
+
+		// An exact name wins over a longer name it is a prefix of.
+		{"stretch", 1, ""},
+		{"  STRETCH ", 1, ""},
+		{"stretch h", 2, ""},
+		{"rea", 3, ""},
+		{"water the p", 4, ""},
+		{"garden", 5, ""},
+		{"hams", 2, ""},
+		{"ppo", 42, ""},
+		{"wtg", 5, ""},
+
+		{"water", 0, `"Water the plants" (4), "Water the garden" (5)`},
+		{"str", 0, `"Stretch" (1), "Stretch hamstrings" (2)`},
+		{"the", 0, "use more of the name or the ID"},
+		{"99", 0, `no task matches "99"`},
+		{"yoga", 0, `no task matches "yoga"`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.query, func(t *testing.T) {
+			got, err := findTask(tasks, tt.query)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("got %v, %v, want an error mentioning %q", got, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != tt.want {
+				t.Fatalf("got %q (%d), want %d", got.Name, got.ID, tt.want)
+			}
+		})
+	}
+}
+
+func TestSubsequence(t *testing.T) {
+	tests := []struct {
+		s, q string
+		want bool
+	}{
+		{"stretch", "", true},
+		{"stretch", "sth", true},
+		{"stretch", "stretch", true},
+		{"stretch", "hs", false},
+		{"stretch", "stretchy", false},
+		{"läsa böcker", "lbk", true},
+	}
+
+	for _, tt := range tests {
+		if got := subsequence(tt.s, tt.q); got != tt.want {
+			t.Errorf("subsequence(%q, %q) = %v, want %v", tt.s, tt.q, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,390 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// command is an administrative subcommand of the binary. It runs with the
+// same config and store as the server, so operations that used to need raw
+// SQL go through the same code.
+type command struct {
+	usage string
+	run   func(ctx context.Context, conn *pgxpool.Pool, args []string) error
+}
+
+var commands map[string]command
+
+// The commands are registered in init as they look up their own usage.
+func init() {
+	commands = map[string]command{
+		"migrate": {
+			usage: "migrate",
+			run:   cmdMigrate,
+		},
+		"user list": {
+			usage: "user list",
+			run:   cmdUserList,
+		},
+		"user create": {
+			usage: "user create [-password-stdin] [-timezone zone] [-admin] <username>",
+			run:   cmdUserCreate,
+		},
+		"user reset-password": {
+			usage: "user reset-password [-password-stdin] <username>",
+			run:   cmdUserResetPassword,
+		},
+		"user admin": {
+			usage: "user admin [-revoke] <username>",
+			run:   cmdUserAdmin,
+		},
+		"user delete": {
+			usage: "user delete -y <username>",
+			run:   cmdUserDelete,
+		},
+		"sessions purge": {
+			usage: "sessions purge [-user username] [-older-than duration]",
+			run:   cmdSessionsPurge,
+		},
+		"export-user": {
+			usage: "export-user [-format json|csv|bundle] [-o file] <username>",
+			run:   cmdExportUser,
+		},
+	}
+}
+
+// usage describes the flags and subcommands of the binary.
+func usage() {
+	out := flag.CommandLine.Output()
+	fmt.Fprintf(out, "Usage: %s [flags] [command]\n\nWith no command, or serve, the server is started.\n\nCommands:\n", os.Args[0])
+
+	names := make([]string, 0, len(commands))
+	for name := range commands {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Fprintf(out, "  %s\n", commands[name].usage)
+	}
+
+	fmt.Fprintf(out, "\nFlags:\n")
+	flag.PrintDefaults()
+}
+
+// lookupCommand finds the command named by the first one or two arguments,
+// returning it with the arguments that follow its name.
+func lookupCommand(args []string) (command, []string, bool) {
+	if len(args) >= 2 {
+		if cmd, ok := commands[args[0]+" "+args[1]]; ok {
+			return cmd, args[2:], true
+		}
+	}
+	cmd, ok := commands[args[0]]
+	return cmd, args[1:], ok
+}
+
+// runCommand connects to the database and runs the command named by args.
+func runCommand(ctx context.Context, cfg *Config, args []string) error {
+	cmd, rest, ok := lookupCommand(args)
+	if !ok {
+		flag.Usage()
+		return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+	}
+
+	conn, err := pgxpool.New(ctx, cfg.DatabaseURL)
+	if err != nil {
+		return fmt.Errorf("unable to connect to database: %w", err)
+	}
+	defer conn.Close()
+
+	return cmd.run(ctx, conn, rest)
+}
+
+// parseCommandFlags parses the flags of a command, which come before its
+// arguments, and checks it was given want arguments.
+func parseCommandFlags(fs *flag.FlagSet, args []string, want int) ([]string, error) {
+	if err := fs.Parse(args); err != nil {
+		return nil, err
+	}
+	if fs.NArg() != want {
+		usage := commands[fs.Name()].usage
+		return nil, fmt.Errorf("usage: %s", usage)
+	}
+	return fs.Args(), nil
+}
+
+// newPassword reads a password from the first line of stdin when fromStdin
+// is set, and otherwise generates one. Generated passwords are returned with
+// generated set so that they can be shown once.
+func newPassword(fromStdin bool) (password string, generated bool, err error) {
+	if !fromStdin {
+		return newToken(), true, nil
+	}
+
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", false, err
+	}
+	return strings.TrimRight(line, "\r\n"), false, nil
+}
+
+func cmdMigrate(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("migrate", flag.ContinueOnError)
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	if err := migrate(ctx, conn); err != nil {
+		return err
+	}
+
+	fmt.Printf("Database is at version %d\n", schemaVersion())
+	return nil
+}
+
+func cmdUserList(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("user list", flag.ContinueOnError)
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	users, err := getUsers(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	tw := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "ID\tUSERNAME\tTIMEZONE\tEMAIL\tADMIN\tDISABLED\tCREATED")
+	for _, user := range users {
+		fmt.Fprintf(tw, "%d\t%s\t%s\t%s\t%t\t%t\t%s\n", user.ID, user.Username, user.Timezone, user.Email, user.IsAdmin, user.DisabledAt != nil, user.CreatedAt.UTC().Format(time.DateTime))
+	}
+	return tw.Flush()
+}
+
+func cmdUserCreate(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("user create", flag.ContinueOnError)
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	timezone := fs.String("timezone", "UTC", "IANA time zone of the user")
+	admin := fs.Bool("admin", false, "make the user an admin")
+	args, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	username := args[0]
+
+	password, generated, err := newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+
+	fe := validateCredentials(username, password)
+	for field, message := range validateTimezone(*timezone) {
+		fe.add(field, message)
+	}
+	if len(fe) > 0 {
+		return fieldErrorsError(fe)
+	}
+
+	user, err := insertUser(ctx, conn, username, password)
+	if err != nil {
+		return err
+	}
+	if err := updateUserTimezone(ctx, conn, user.ID, *timezone); err != nil {
+		return err
+	}
+	if *admin {
+		if err := updateUserAdmin(ctx, conn, user.ID, true); err != nil {
+			return err
+		}
+	}
+
+	fmt.Printf("Created user %s (%d)\n", user.Username, user.ID)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return nil
+}
+
+func cmdUserResetPassword(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("user reset-password", flag.ContinueOnError)
+	passwordStdin := fs.Bool("password-stdin", false, "read the password from stdin instead of generating one")
+	args, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	user, err := commandUser(ctx, conn, args[0])
+	if err != nil {
+		return err
+	}
+
+	password, generated, err := newPassword(*passwordStdin)
+	if err != nil {
+		return err
+	}
+	if fe := validateCredentials(user.Username, password); len(fe) > 0 {
+		return fieldErrorsError(fe)
+	}
+
+	if err := updateUserPassword(ctx, conn, user.ID, password); err != nil {
+		return err
+	}
+
+	fmt.Printf("Reset the password of %s and logged them out everywhere\n", user.Username)
+	if generated {
+		fmt.Printf("Password: %s\n", password)
+	}
+	return nil
+}
+
+func cmdUserAdmin(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("user admin", flag.ContinueOnError)
+	revoke := fs.Bool("revoke", false, "revoke admin access instead of granting it")
+	args, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	user, err := commandUser(ctx, conn, args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := updateUserAdmin(ctx, conn, user.ID, !*revoke); err != nil {
+		return err
+	}
+
+	if *revoke {
+		fmt.Printf("%s is no longer an admin\n", user.Username)
+	} else {
+		fmt.Printf("%s is now an admin\n", user.Username)
+	}
+	return nil
+}
+
+func cmdUserDelete(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("user delete", flag.ContinueOnError)
+	yes := fs.Bool("y", false, "confirm that the user and all of their data should be deleted")
+	args, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+	if !*yes {
+		return errors.New("deleting a user removes all of their data; pass -y to confirm")
+	}
+
+	user, err := commandUser(ctx, conn, args[0])
+	if err != nil {
+		return err
+	}
+
+	if err := deleteUser(ctx, conn, user.ID); err != nil {
+		return err
+	}
+
+	fmt.Printf("Deleted user %s (%d)\n", user.Username, user.ID)
+	return nil
+}
+
+func cmdSessionsPurge(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("sessions purge", flag.ContinueOnError)
+	username := fs.String("user", "", "only purge the sessions of this user")
+	olderThan := fs.Duration("older-than", 0, "only purge sessions at least this old")
+	if _, err := parseCommandFlags(fs, args, 0); err != nil {
+		return err
+	}
+
+	userID := 0
+	if *username != "" {
+		user, err := commandUser(ctx, conn, *username)
+		if err != nil {
+			return err
+		}
+		userID = user.ID
+	}
+
+	purged, err := deleteSessions(ctx, conn, userID, time.Now().Add(-*olderThan))
+	if err != nil {
+		return err
+	}
+
+	fmt.Printf("Purged %d sessions\n", purged)
+	return nil
+}
+
+func cmdExportUser(ctx context.Context, conn *pgxpool.Pool, args []string) error {
+	fs := flag.NewFlagSet("export-user", flag.ContinueOnError)
+	format := fs.String("format", "json", "json, csv or bundle")
+	output := fs.String("o", "", "file to write the export to instead of stdout")
+	args, err := parseCommandFlags(fs, args, 1)
+	if err != nil {
+		return err
+	}
+
+	var write func(context.Context, *pgxpool.Pool, *exportWriter, *User) error
+	switch *format {
+	case "json":
+		write = writeJSONExport
+	case "csv":
+		write = writeCSVExport
+	case "bundle":
+		write = writeBundleExport
+	default:
+		return errors.New("format must be json, csv or bundle")
+	}
+
+	user, err := commandUser(ctx, conn, args[0])
+	if err != nil {
+		return err
+	}
+
+	out := os.Stdout
+	if *output != "" {
+		if out, err = os.OpenFile(*output, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	bw := bufio.NewWriter(out)
+	if err := write(ctx, conn, &exportWriter{w: bw, beforeFlush: func() { _ = bw.Flush() }}, user); err != nil {
+		return err
+	}
+	if err := bw.Flush(); err != nil {
+		return err
+	}
+	return out.Sync()
+}
+
+// commandUser loads a user by name, with an error that says which user was
+// not found.
+func commandUser(ctx context.Context, conn *pgxpool.Pool, username string) (*User, error) {
+	user, err := getUser(ctx, conn, username)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, fmt.Errorf("no user is called %q", username)
+	}
+	return user, err
+}
+
+// fieldErrorsError joins validation messages into one error, in a stable
+// order.
+func fieldErrorsError(fe FieldErrors) error {
+	messages := make([]string, 0, len(fe))
+	for _, message := range fe {
+		messages = append(messages, message)
+	}
+	sort.Strings(messages)
+	return errors.New(strings.Join(messages, "; "))
+}
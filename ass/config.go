@@ -0,0 +1,421 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/mail"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "REDACTED"
+
+// Config is loaded once at startup from the defaults, then the optional
+// config file, then the environment, with later sources taking precedence.
+type Config struct {
+	Port        int    `yaml:"port"`
+	Env         string `yaml:"env"`
+	DatabaseURL string `yaml:"database_url"`
+	// AutoMigrate applies any pending migrations at startup. With it off the
+	// server refuses to start on a schema that is behind, so that the
+	// migrate command can be run separately.
+	AutoMigrate bool `yaml:"auto_migrate"`
+	// FirstRun is the old switch for migrating at startup, kept so that
+	// existing config files still load. Setting it migrates even when
+	// AutoMigrate is off.
+	FirstRun bool `yaml:"first_run"`
+
+	LogLevel slog.Level `yaml:"log_level"`
+
+	// StaticDir holds the built frontend, unless EmbedStatic is set and the
+	// binary was built with the embed tag.
+	StaticDir   string `yaml:"static_dir"`
+	EmbedStatic bool   `yaml:"embed_static"`
+
+	// TrustedOrigins may send cookie authenticated requests that change
+	// state, in addition to the server's own origin.
+	TrustedOrigins []string `yaml:"trusted_origins"`
+	// CORSAllowedOrigins may call the API from a browser using bearer
+	// tokens. "*" allows any origin.
+	CORSAllowedOrigins []string `yaml:"cors_allowed_origins"`
+
+	// MetricsPort serves /metrics on its own port when set. Otherwise
+	// /metrics is only served on Port, and only when MetricsToken is set.
+	MetricsPort int `yaml:"metrics_port"`
+	// MetricsToken is the bearer token required to read /metrics.
+	MetricsToken string `yaml:"metrics_token"`
+
+	IdempotencyTTL time.Duration `yaml:"idempotency_ttl"`
+
+	ReadTimeout  time.Duration `yaml:"read_timeout"`
+	WriteTimeout time.Duration `yaml:"write_timeout"`
+	IdleTimeout  time.Duration `yaml:"idle_timeout"`
+	// ShutdownDelay is how long /api/health reports failure before the
+	// server stops accepting connections, giving load balancers time to
+	// notice.
+	ShutdownDelay   time.Duration `yaml:"shutdown_delay"`
+	ShutdownTimeout time.Duration `yaml:"shutdown_timeout"`
+
+	// RemindersEnabled runs the scheduler that sends reminders for tasks
+	// that are about to be missed, checking every ReminderCheckInterval.
+	RemindersEnabled      bool          `yaml:"reminders_enabled"`
+	ReminderCheckInterval time.Duration `yaml:"reminder_check_interval"`
+
+	// WebhooksEnabled runs the worker that delivers queued webhook events,
+	// polling every WebhookPollInterval. A delivery is retried with backoff
+	// until it succeeds or has been attempted WebhookMaxAttempts times.
+	WebhooksEnabled     bool          `yaml:"webhooks_enabled"`
+	WebhookPollInterval time.Duration `yaml:"webhook_poll_interval"`
+	WebhookTimeout      time.Duration `yaml:"webhook_timeout"`
+	WebhookMaxAttempts  int           `yaml:"webhook_max_attempts"`
+
+	// VAPIDPrivateKey enables Web Push reminders. It identifies this server
+	// to browser push services; generate one with -generate-vapid-key.
+	// VAPIDSubject is a mailto: or https: URL push services can use to
+	// contact the operator.
+	VAPIDPrivateKey string `yaml:"vapid_private_key"`
+	VAPIDSubject    string `yaml:"vapid_subject"`
+
+	// SMTPHost enables reminder emails and the weekly digest, sent from
+	// SMTPFrom. Links in emails point at PublicURL, the origin the app is
+	// served from.
+	SMTPHost     string `yaml:"smtp_host"`
+	SMTPPort     int    `yaml:"smtp_port"`
+	SMTPUsername string `yaml:"smtp_username"`
+	SMTPPassword string `yaml:"smtp_password"`
+	SMTPFrom     string `yaml:"smtp_from"`
+	PublicURL    string `yaml:"public_url"`
+
+	// Admins are the usernames made admins at startup, so that a new
+	// instance has someone who can manage it. Admin access granted this way
+	// is not revoked when a name is removed.
+	Admins []string `yaml:"admins"`
+
+	// ReadyAcquireThreshold is the longest acquiring a database connection
+	// may take before /api/health/ready reports the server as not ready.
+	ReadyAcquireThreshold time.Duration `yaml:"ready_acquire_threshold"`
+}
+
+func defaultConfig() *Config {
+	return &Config{
+		Port:            8019,
+		Env:             "development",
+		AutoMigrate:     true,
+		LogLevel:        slog.LevelInfo,
+		StaticDir:       "/dist",
+		IdempotencyTTL:  24 * time.Hour,
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		IdleTimeout:     60 * time.Second,
+		ShutdownDelay:   2 * time.Second,
+		ShutdownTimeout: 5 * time.Second,
+
+		RemindersEnabled:      true,
+		ReminderCheckInterval: time.Minute,
+
+		WebhooksEnabled:     true,
+		WebhookPollInterval: 5 * time.Second,
+		WebhookTimeout:      10 * time.Second,
+		WebhookMaxAttempts:  8,
+
+		SMTPPort: 587,
+
+		ReadyAcquireThreshold: 250 * time.Millisecond,
+	}
+}
+
+// loadConfig builds the Config from the file at path, if any, and the
+// environment. The file may be given by DIDT_CONFIG instead of path.
+func loadConfig(path string) (*Config, error) {
+	cfg := defaultConfig()
+
+	if path == "" {
+		path = os.Getenv("DIDT_CONFIG")
+	}
+	if path != "" {
+		if err := cfg.loadFile(path); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cfg.loadEnv(); err != nil {
+		return nil, err
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+func (c *Config) loadFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("unable to open config file: %w", err)
+	}
+	defer f.Close()
+
+	decoder := yaml.NewDecoder(f)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(c); err != nil {
+		return fmt.Errorf("unable to parse config file %s: %w", path, err)
+	}
+
+	return nil
+}
+
+func (c *Config) loadEnv() error {
+	var errs []error
+
+	setString := func(name string, dst *string) {
+		if res, ok := os.LookupEnv(name); ok {
+			*dst = res
+		}
+	}
+	setInt := func(name string, dst *int) {
+		if res, ok := os.LookupEnv(name); ok {
+			v, err := strconv.Atoi(res)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be an integer, got %q", name, res))
+				return
+			}
+			*dst = v
+		}
+	}
+	setBool := func(name string, dst *bool) {
+		if res, ok := os.LookupEnv(name); ok {
+			v, err := strconv.ParseBool(res)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be true or false, got %q", name, res))
+				return
+			}
+			*dst = v
+		}
+	}
+	setList := func(name string, dst *[]string) {
+		if res, ok := os.LookupEnv(name); ok {
+			*dst = nil
+			for _, v := range strings.Split(res, ",") {
+				if v = strings.TrimSpace(v); v != "" {
+					*dst = append(*dst, v)
+				}
+			}
+		}
+	}
+	setDuration := func(name string, dst *time.Duration) {
+		if res, ok := os.LookupEnv(name); ok {
+			v, err := time.ParseDuration(res)
+			if err != nil {
+				errs = append(errs, fmt.Errorf("%s must be a duration such as 5s, got %q", name, res))
+				return
+			}
+			*dst = v
+		}
+	}
+
+	setInt("DIDT_APP_PORT", &c.Port)
+	setString("ENV", &c.Env)
+	setString("DATABASE_URL", &c.DatabaseURL)
+	setBool("FIRST_RUN", &c.FirstRun)
+	setBool("DIDT_AUTO_MIGRATE", &c.AutoMigrate)
+	if res, ok := os.LookupEnv("DIDT_LOG_LEVEL"); ok {
+		if err := c.LogLevel.UnmarshalText([]byte(res)); err != nil {
+			errs = append(errs, fmt.Errorf("DIDT_LOG_LEVEL must be debug, info, warn or error, got %q", res))
+		}
+	}
+	setString("DIDT_STATIC_DIR", &c.StaticDir)
+	setBool("DIDT_EMBED_STATIC", &c.EmbedStatic)
+	setList("DIDT_TRUSTED_ORIGINS", &c.TrustedOrigins)
+	setList("DIDT_CORS_ALLOWED_ORIGINS", &c.CORSAllowedOrigins)
+	setList("DIDT_ADMINS", &c.Admins)
+	setInt("DIDT_METRICS_PORT", &c.MetricsPort)
+	setString("DIDT_METRICS_TOKEN", &c.MetricsToken)
+	setDuration("DIDT_IDEMPOTENCY_TTL", &c.IdempotencyTTL)
+	setDuration("DIDT_READ_TIMEOUT", &c.ReadTimeout)
+	setDuration("DIDT_WRITE_TIMEOUT", &c.WriteTimeout)
+	setDuration("DIDT_IDLE_TIMEOUT", &c.IdleTimeout)
+	setDuration("DIDT_SHUTDOWN_DELAY", &c.ShutdownDelay)
+	setDuration("DIDT_SHUTDOWN_TIMEOUT", &c.ShutdownTimeout)
+	setDuration("DIDT_READY_ACQUIRE_THRESHOLD", &c.ReadyAcquireThreshold)
+	setBool("DIDT_REMINDERS_ENABLED", &c.RemindersEnabled)
+	setDuration("DIDT_REMINDER_CHECK_INTERVAL", &c.ReminderCheckInterval)
+	setBool("DIDT_WEBHOOKS_ENABLED", &c.WebhooksEnabled)
+	setDuration("DIDT_WEBHOOK_POLL_INTERVAL", &c.WebhookPollInterval)
+	setDuration("DIDT_WEBHOOK_TIMEOUT", &c.WebhookTimeout)
+	setInt("DIDT_WEBHOOK_MAX_ATTEMPTS", &c.WebhookMaxAttempts)
+	setString("DIDT_VAPID_PRIVATE_KEY", &c.VAPIDPrivateKey)
+	setString("DIDT_VAPID_SUBJECT", &c.VAPIDSubject)
+	setString("DIDT_SMTP_HOST", &c.SMTPHost)
+	setInt("DIDT_SMTP_PORT", &c.SMTPPort)
+	setString("DIDT_SMTP_USERNAME", &c.SMTPUsername)
+	setString("DIDT_SMTP_PASSWORD", &c.SMTPPassword)
+	setString("DIDT_SMTP_FROM", &c.SMTPFrom)
+	setString("DIDT_PUBLIC_URL", &c.PublicURL)
+
+	return errors.Join(errs...)
+}
+
+func (c *Config) validate() error {
+	var errs []error
+
+	if c.Port < 1 || c.Port > 65535 {
+		errs = append(errs, fmt.Errorf("port must be between 1 and 65535, got %d", c.Port))
+	}
+
+	if c.MetricsPort != 0 && (c.MetricsPort < 1 || c.MetricsPort > 65535) {
+		errs = append(errs, fmt.Errorf("metrics_port must be between 1 and 65535, got %d", c.MetricsPort))
+	} else if c.MetricsPort == c.Port {
+		errs = append(errs, errors.New("metrics_port must differ from port"))
+	}
+
+	if c.Env != "development" && c.Env != "production" {
+		errs = append(errs, fmt.Errorf("env must be development or production, got %q", c.Env))
+	}
+
+	if c.DatabaseURL == "" {
+		errs = append(errs, errors.New("database_url is required"))
+	} else if _, err := pgxpool.ParseConfig(c.DatabaseURL); err != nil {
+		errs = append(errs, errors.New("database_url is not a valid connection string"))
+	}
+
+	if c.EmbedStatic {
+		if _, ok := embeddedStatic(); !ok {
+			errs = append(errs, errors.New("embed_static requires a binary built with the embed tag"))
+		}
+	} else if c.StaticDir == "" {
+		errs = append(errs, errors.New("static_dir is required unless embed_static is set"))
+	}
+
+	for _, origin := range c.TrustedOrigins {
+		if !isOrigin(origin) {
+			errs = append(errs, fmt.Errorf("trusted origin %q must look like https://example.com", origin))
+		}
+	}
+	for _, origin := range c.CORSAllowedOrigins {
+		if origin != "*" && !isOrigin(origin) {
+			errs = append(errs, fmt.Errorf("CORS allowed origin %q must be * or look like https://example.com", origin))
+		}
+	}
+
+	positive := map[string]time.Duration{
+		"idempotency_ttl":         c.IdempotencyTTL,
+		"read_timeout":            c.ReadTimeout,
+		"write_timeout":           c.WriteTimeout,
+		"idle_timeout":            c.IdleTimeout,
+		"shutdown_timeout":        c.ShutdownTimeout,
+		"ready_acquire_threshold": c.ReadyAcquireThreshold,
+		"reminder_check_interval": c.ReminderCheckInterval,
+		"webhook_poll_interval":   c.WebhookPollInterval,
+		"webhook_timeout":         c.WebhookTimeout,
+	}
+	for name, d := range positive {
+		if d <= 0 {
+			errs = append(errs, fmt.Errorf("%s must be positive, got %s", name, d))
+		}
+	}
+
+	if c.VAPIDPrivateKey != "" {
+		if _, err := parseVAPIDKey(c.VAPIDPrivateKey, c.VAPIDSubject); err != nil {
+			errs = append(errs, err)
+		}
+		if !strings.HasPrefix(c.VAPIDSubject, "mailto:") && !strings.HasPrefix(c.VAPIDSubject, "https://") {
+			errs = append(errs, fmt.Errorf("vapid_subject must be a mailto: or https: URL, got %q", c.VAPIDSubject))
+		}
+	}
+
+	if c.SMTPHost != "" {
+		if c.SMTPPort < 1 || c.SMTPPort > 65535 {
+			errs = append(errs, fmt.Errorf("smtp_port must be between 1 and 65535, got %d", c.SMTPPort))
+		}
+		if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+			errs = append(errs, fmt.Errorf("smtp_from must be an email address, got %q", c.SMTPFrom))
+		}
+		if !isOrigin(c.PublicURL) {
+			errs = append(errs, fmt.Errorf("public_url must look like https://example.com when smtp_host is set, got %q", c.PublicURL))
+		}
+	}
+
+	if c.WebhookMaxAttempts < 1 {
+		errs = append(errs, fmt.Errorf("webhook_max_attempts must be at least 1, got %d", c.WebhookMaxAttempts))
+	}
+
+	if c.ShutdownDelay < 0 {
+		errs = append(errs, fmt.Errorf("shutdown_delay must not be negative, got %s", c.ShutdownDelay))
+	}
+
+	return errors.Join(errs...)
+}
+
+func isOrigin(s string) bool {
+	u, err := url.Parse(s)
+	return err == nil && u.Scheme != "" && u.Host != "" && u.Path == "" && u.RawQuery == ""
+}
+
+func (c *Config) IsProduction() bool {
+	return c.Env == "production"
+}
+
+// vapidKey returns the Web Push key, or nil if push is not configured.
+func (c *Config) vapidKey() *vapidKey {
+	if c.VAPIDPrivateKey == "" {
+		return nil
+	}
+	// The key was checked by validate.
+	key, _ := parseVAPIDKey(c.VAPIDPrivateKey, c.VAPIDSubject)
+	return key
+}
+
+// Redacted returns a copy of the config that is safe to print.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.DatabaseURL = redactDatabaseURL(c.DatabaseURL)
+	if r.MetricsToken != "" {
+		r.MetricsToken = redacted
+	}
+	if r.VAPIDPrivateKey != "" {
+		r.VAPIDPrivateKey = redacted
+	}
+	if r.SMTPPassword != "" {
+		r.SMTPPassword = redacted
+	}
+	return &r
+}
+
+var dsnPassword = regexp.MustCompile(`password=('[^']*'|\S*)`)
+
+func redactDatabaseURL(dsn string) string {
+	u, err := url.Parse(dsn)
+	if err == nil && u.Scheme != "" {
+		if _, ok := u.User.Password(); ok {
+			u.User = url.UserPassword(u.User.Username(), redacted)
+		}
+		q := u.Query()
+		if q.Has("password") {
+			q.Set("password", redacted)
+			u.RawQuery = q.Encode()
+		}
+		return u.String()
+	}
+
+	return dsnPassword.ReplaceAllString(dsn, "password="+redacted)
+}
+
+func printConfig(w io.Writer, cfg *Config) error {
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	if err := encoder.Encode(cfg.Redacted()); err != nil {
+		return err
+	}
+
+	return encoder.Close()
+}
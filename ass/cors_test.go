@@ -0,0 +1,83 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	tests := []struct {
+		name      string
+		allowed   []string
+		method    string
+		path      string
+		origin    string
+		preflight bool
+		// wantAllowed is whether the origin is allowed and wantHandler
+		// whether the request reaches the API.
+		wantAllowed bool
+		wantHandler bool
+	}{
+		{"preflight from an allowed origin", []string{"https://client.example"}, http.MethodOptions, "/api/tasks", "https://client.example", true, true, false},
+		{"preflight from a disallowed origin", []string{"https://client.example"}, http.MethodOptions, "/api/tasks", "https://evil.example", true, false, true},
+		{"preflight with any origin allowed", []string{"*"}, http.MethodOptions, "/api/tasks", "https://evil.example", true, true, false},
+		{"request from an allowed origin", []string{"https://client.example"}, http.MethodPost, "/api/tasks", "https://client.example", false, true, true},
+		{"request from a disallowed origin", []string{"https://client.example"}, http.MethodPost, "/api/tasks", "https://evil.example", false, false, true},
+		{"OPTIONS that is not a preflight", []string{"https://client.example"}, http.MethodOptions, "/api/tasks", "https://client.example", false, true, true},
+		{"request outside the API", []string{"*"}, http.MethodGet, "/index.html", "https://client.example", false, false, true},
+		{"no origins configured", nil, http.MethodOptions, "/api/tasks", "https://client.example", true, false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.CORSAllowedOrigins = tt.allowed
+			handled := false
+			h := withCORS(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				handled = true
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.preflight {
+				r.Header.Set("Access-Control-Request-Method", http.MethodPost)
+				r.Header.Set("Access-Control-Request-Headers", "authorization, content-type")
+			}
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			header := w.Header()
+
+			if handled != tt.wantHandler {
+				t.Errorf("handler ran is %v, want %v", handled, tt.wantHandler)
+			}
+			if got := header.Get("Access-Control-Allow-Origin"); (got == tt.origin) != tt.wantAllowed || got != "" && got != tt.origin {
+				t.Errorf("got Access-Control-Allow-Origin %q", got)
+			}
+			if header.Get("Access-Control-Allow-Credentials") != "" {
+				t.Error("credentials are allowed")
+			}
+			if api := tt.path != "/index.html"; slices.Contains(header.Values("Vary"), "Origin") != api {
+				t.Errorf("got Vary %q", header.Values("Vary"))
+			}
+
+			allowedPreflight := tt.preflight && tt.wantAllowed
+			if allowedPreflight {
+				if w.Code != http.StatusNoContent {
+					t.Errorf("preflight got %d", w.Code)
+				}
+				if header.Get("Access-Control-Allow-Methods") == "" || header.Get("Access-Control-Allow-Headers") == "" || header.Get("Access-Control-Max-Age") != "600" {
+					t.Errorf("preflight got headers %v", header)
+				}
+			} else if header.Get("Access-Control-Allow-Methods") != "" {
+				t.Errorf("got Access-Control-Allow-Methods %q", header.Get("Access-Control-Allow-Methods"))
+			}
+
+			if exposed := header.Get("Access-Control-Expose-Headers") != ""; exposed != (tt.wantAllowed && !allowedPreflight) {
+				t.Errorf("Access-Control-Expose-Headers set is %v", exposed)
+			}
+		})
+	}
+}
@@ -0,0 +1,480 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"embed"
+	"encoding/json"
+	"fmt"
+	htmltemplate "html/template"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/smtp"
+	"net/textproto"
+	"slices"
+	"strconv"
+	"strings"
+	texttemplate "text/template"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// emailVerificationTTL is how long the link in a verification email works.
+	emailVerificationTTL = 24 * time.Hour
+	// digestCheckInterval is how often users are checked for a weekly digest
+	// that has not been sent yet.
+	digestCheckInterval = time.Hour
+	// smtpTimeout bounds the whole conversation with the SMTP server.
+	smtpTimeout = 30 * time.Second
+
+	digestDateLayout = "Mon Jan 2"
+	dueLayout        = "Mon Jan 2 15:04 MST"
+)
+
+//go:embed emails
+var emailFS embed.FS
+
+// emailTemplates holds the templates of each email, parsed at startup. Each
+// email has a .txt template defining "subject" and "text" and a .html
+// template defining "html".
+var emailTemplates = parseEmailTemplates("reminder", "digest", "verify")
+
+type emailTemplate struct {
+	text *texttemplate.Template
+	html *htmltemplate.Template
+}
+
+func parseEmailTemplates(names ...string) map[string]emailTemplate {
+	templates := make(map[string]emailTemplate, len(names))
+	for _, name := range names {
+		templates[name] = emailTemplate{
+			text: texttemplate.Must(texttemplate.ParseFS(emailFS, "emails/"+name+".txt")),
+			html: htmltemplate.Must(htmltemplate.ParseFS(emailFS, "emails/"+name+".html")),
+		}
+	}
+	return templates
+}
+
+type email struct {
+	To      string
+	Subject string
+	Text    string
+	HTML    string
+}
+
+// renderEmail renders the email named name, such as "digest", with data.
+func renderEmail(name, to string, data any) (*email, error) {
+	t, ok := emailTemplates[name]
+	if !ok {
+		return nil, fmt.Errorf("no email template named %q", name)
+	}
+
+	var subject, text, html bytes.Buffer
+	if err := t.text.ExecuteTemplate(&subject, "subject", data); err != nil {
+		return nil, err
+	}
+	if err := t.text.ExecuteTemplate(&text, "text", data); err != nil {
+		return nil, err
+	}
+	if err := t.html.ExecuteTemplate(&html, "html", data); err != nil {
+		return nil, err
+	}
+
+	return &email{
+		To:      to,
+		Subject: strings.TrimSpace(subject.String()),
+		Text:    text.String(),
+		HTML:    html.String(),
+	}, nil
+}
+
+// bytes returns the email as a multipart/alternative MIME message.
+func (e *email) bytes(from string, now time.Time) ([]byte, error) {
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	for _, part := range []struct {
+		contentType string
+		content     string
+	}{
+		{"text/plain; charset=utf-8", e.Text},
+		{"text/html; charset=utf-8", e.HTML},
+	} {
+		pw, err := mw.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {part.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qw := quotedprintable.NewWriter(pw)
+		if _, err := qw.Write([]byte(part.content)); err != nil {
+			return nil, err
+		}
+		if err := qw.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := mw.Close(); err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", from)
+	fmt.Fprintf(&msg, "To: %s\r\n", e.To)
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", e.Subject))
+	fmt.Fprintf(&msg, "Date: %s\r\n", now.Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "Message-ID: <%s@didt>\r\n", newToken())
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/alternative; boundary=%s\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+
+	return msg.Bytes(), nil
+}
+
+// mailer sends email through an SMTP server, upgrading the connection with
+// STARTTLS whenever the server offers it.
+type mailer struct {
+	host     string
+	port     int
+	username string
+	password string
+	from     string
+}
+
+// newMailer returns the mailer configured by cfg, or nil if email is not
+// configured.
+func newMailer(cfg *Config) *mailer {
+	if cfg.SMTPHost == "" {
+		return nil
+	}
+	return &mailer{
+		host:     cfg.SMTPHost,
+		port:     cfg.SMTPPort,
+		username: cfg.SMTPUsername,
+		password: cfg.SMTPPassword,
+		from:     cfg.SMTPFrom,
+	}
+}
+
+func (m *mailer) send(ctx context.Context, e *email) error {
+	msg, err := e.bytes(m.from, time.Now())
+	if err != nil {
+		return err
+	}
+
+	addr := net.JoinHostPort(m.host, strconv.Itoa(m.port))
+	conn, err := (&net.Dialer{Timeout: smtpTimeout}).DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	if err := conn.SetDeadline(time.Now().Add(smtpTimeout)); err != nil {
+		return err
+	}
+
+	c, err := smtp.NewClient(conn, m.host)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: m.host}); err != nil {
+			return err
+		}
+	}
+	if m.username != "" {
+		if err := c.Auth(smtp.PlainAuth("", m.username, m.password, m.host)); err != nil {
+			return err
+		}
+	}
+
+	if err := c.Mail(m.from); err != nil {
+		return err
+	}
+	if err := c.Rcpt(e.To); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
+
+// emailNotifier sends reminders to users with a verified email address.
+type emailNotifier struct {
+	mailer    *mailer
+	publicURL string
+}
+
+func (emailNotifier) Name() string {
+	return "email"
+}
+
+func (en emailNotifier) Notify(ctx context.Context, r Reminder) error {
+	if r.User.Email == "" {
+		return nil
+	}
+
+	e, err := renderEmail("reminder", r.User.Email, struct {
+		User *User
+		Task *Task
+		Due  string
+		URL  string
+	}{
+		User: r.User,
+		Task: r.Task,
+		Due:  r.IntervalEnd.Format(dueLayout),
+		URL:  en.publicURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	return en.mailer.send(ctx, e)
+}
+
+// DigestTask is the completion rate of one task over the week of a digest.
+// Only intervals that closed during the week count towards Total, and paused
+// intervals only count if they were completed anyway.
+type DigestTask struct {
+	Name      string
+	Interval  string
+	Completed int
+	Total     int
+	Rate      int
+}
+
+// digestIntervals returns the [start, end) bounds of each interval of the
+// task that closed in the week from weekStart to weekEnd, skipping those
+// before the task was created.
+func digestIntervals(task *Task, weekStart, weekEnd time.Time) [][2]time.Time {
+	created, _ := task.Interval.bounds(task.CreatedAt.In(weekStart.Location()))
+
+	var intervals [][2]time.Time
+	start, end := task.Interval.bounds(weekStart)
+	for end.After(start) && !end.After(weekEnd) {
+		if !start.Before(created) {
+			intervals = append(intervals, [2]time.Time{start, end})
+		}
+		start, end = task.Interval.bounds(end)
+	}
+	return intervals
+}
+
+func newDigestTask(ctx context.Context, conn *pgxpool.Pool, task *Task, weekStart, weekEnd time.Time) (DigestTask, error) {
+	dt := DigestTask{Name: task.Name, Interval: task.Interval.String()}
+
+	intervals := digestIntervals(task, weekStart, weekEnd)
+	if len(intervals) == 0 {
+		return dt, nil
+	}
+
+	completions, err := getCompletionTimes(ctx, conn, task.ID, intervals[0][0], intervals[len(intervals)-1][1])
+	if err != nil {
+		return dt, err
+	}
+
+	pauses, err := getTaskPauses(ctx, conn, task.ID)
+	if err != nil {
+		return dt, err
+	}
+
+	for _, interval := range intervals {
+		done := slices.ContainsFunc(completions, func(c time.Time) bool {
+			return !c.Before(interval[0]) && c.Before(interval[1])
+		})
+		switch {
+		case done:
+			dt.Completed++
+			dt.Total++
+		case !paused(pauses, weekStart.Location(), interval[0], interval[1]):
+			dt.Total++
+		}
+	}
+	if dt.Total > 0 {
+		dt.Rate = dt.Completed * 100 / dt.Total
+	}
+
+	return dt, nil
+}
+
+// runDigests sends each user with a verified email a digest of the previous
+// week, checking every digestCheckInterval until ctx is cancelled.
+func runDigests(ctx context.Context, cfg *Config, conn *pgxpool.Pool, m *mailer) {
+	ticker := time.NewTicker(digestCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := checkDigests(ctx, conn, m, cfg.PublicURL, time.Now()); err != nil {
+			logger.Error("Unable to send digests", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkDigests sends the digest of the week before now, in each user's time
+// zone, to every user who has not been sent it yet.
+func checkDigests(ctx context.Context, conn *pgxpool.Pool, m *mailer, publicURL string, now time.Time) error {
+	users, err := getDigestRecipients(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, user := range users {
+		current, _ := Weekly.bounds(now.In(user.location()))
+		weekStart, weekEnd := Weekly.bounds(current.Add(-time.Nanosecond))
+
+		if user.CreatedAt.After(weekEnd) {
+			continue
+		}
+
+		claimed, err := claimDigest(ctx, conn, user.ID, weekStart)
+		if err != nil {
+			return err
+		}
+		if !claimed {
+			continue
+		}
+
+		if err := sendDigest(ctx, conn, m, publicURL, user, weekStart, weekEnd); err != nil {
+			logger.Error("Unable to send digest", "user_id", user.ID, "error", err.Error())
+			if err := releaseDigest(ctx, conn, user.ID, weekStart); err != nil {
+				logger.Error("Unable to release digest", "user_id", user.ID, "error", err.Error())
+			}
+		}
+	}
+
+	return nil
+}
+
+func sendDigest(ctx context.Context, conn *pgxpool.Pool, m *mailer, publicURL string, user *User, weekStart, weekEnd time.Time) error {
+	tasks, err := getTasks(ctx, conn, user.ID, TaskFilter{})
+	if err != nil {
+		return err
+	}
+
+	digestTasks := make([]DigestTask, len(tasks))
+	for i, task := range tasks {
+		digestTasks[i], err = newDigestTask(ctx, conn, task, weekStart, weekEnd)
+		if err != nil {
+			return err
+		}
+	}
+
+	e, err := renderEmail("digest", user.Email, struct {
+		User      *User
+		WeekStart string
+		WeekEnd   string
+		Tasks     []DigestTask
+		URL       string
+	}{
+		User:      user,
+		WeekStart: weekStart.Format(digestDateLayout),
+		WeekEnd:   weekEnd.AddDate(0, 0, -1).Format(digestDateLayout),
+		Tasks:     digestTasks,
+		URL:       publicURL,
+	})
+	if err != nil {
+		return err
+	}
+
+	return m.send(ctx, e)
+}
+
+// handleSetEmail sends a verification link to the address in the body. The
+// address is only saved on the account once the link is opened.
+func handleSetEmail(cfg *Config, conn *pgxpool.Pool, m *mailer) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		if m == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, "email is not configured")
+			return
+		}
+
+		var body struct {
+			Email string `json:"email"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if fe := validateEmail(body.Email); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		token := newToken()
+		if err := insertEmailVerification(r.Context(), conn, token, user.ID, body.Email, time.Now().Add(emailVerificationTTL)); err != nil {
+			writeStoreError(w, r, err, "Unable to insert email verification")
+			return
+		}
+
+		e, err := renderEmail("verify", body.Email, struct {
+			User *User
+			URL  string
+		}{
+			User: user,
+			URL:  cfg.PublicURL + "/api/account/email/verify/" + token,
+		})
+		if err == nil {
+			err = m.send(r.Context(), e)
+		}
+		if err != nil {
+			writeError(w, http.StatusBadGateway, CodeUnavailable, "Unable to send verification email")
+			loggerFrom(r.Context()).Error("Unable to send verification email", "error", err.Error())
+			return
+		}
+
+		w.WriteHeader(http.StatusAccepted)
+	}
+}
+
+// handleVerifyEmail saves the address a verification link was sent to on the
+// account that asked for it.
+func handleVerifyEmail(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := verifyEmail(r.Context(), conn, r.PathValue("token")); err != nil {
+			writeStoreError(w, r, err, "Unable to verify email")
+			return
+		}
+
+		http.Redirect(w, r, "/", http.StatusFound)
+	}
+}
+
+func handleDeleteEmail(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		if err := deleteUserEmail(r.Context(), conn, user.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete email")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func testReminderEmail(t *testing.T) *email {
+	t.Helper()
+	e, err := renderEmail("reminder", "ada@example.com", struct {
+		User *User
+		Task *Task
+		Due  string
+		URL  string
+	}{
+		User: &User{Username: "ada"},
+		Task: &Task{Name: "Stretch & <rest>"},
+		Due:  "Mon Mar 9 17:00 UTC",
+		URL:  "https://didt.example.com",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func TestRenderEmail(t *testing.T) {
+	e := testReminderEmail(t)
+
+	if e.To != "ada@example.com" || e.Subject != "Reminder: Stretch & <rest>" {
+		t.Fatalf("got To %q and Subject %q", e.To, e.Subject)
+	}
+	if !strings.Contains(e.Text, `You have not done "Stretch & <rest>" yet. It is due by Mon Mar 9 17:00 UTC.`) {
+		t.Fatalf("text part is %q", e.Text)
+	}
+	if !strings.Contains(e.HTML, "<strong>Stretch &amp; &lt;rest&gt;</strong>") {
+		t.Fatalf("html part does not escape the task name: %q", e.HTML)
+	}
+
+	if _, err := renderEmail("missing", "ada@example.com", nil); err == nil {
+		t.Fatal("an unknown template was rendered")
+	}
+}
+
+// smtpMessage is what smtpSink received in one session.
+type smtpMessage struct {
+	auth string
+	from string
+	to   []string
+	data []byte
+}
+
+// smtpSink accepts one SMTP session on a local port and sends what it
+// received on the returned channel. It offers AUTH PLAIN but not STARTTLS.
+func smtpSink(t *testing.T) (string, <-chan smtpMessage) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+
+	received := make(chan smtpMessage, 1)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		tp := textproto.NewConn(conn)
+		var msg smtpMessage
+		_ = tp.PrintfLine("220 sink ESMTP")
+		for {
+			line, err := tp.ReadLine()
+			if err != nil {
+				return
+			}
+			verb, arg, _ := strings.Cut(line, " ")
+
+			switch strings.ToUpper(verb) {
+			case "EHLO":
+				_ = tp.PrintfLine("250-sink")
+				_ = tp.PrintfLine("250 AUTH PLAIN")
+			case "AUTH":
+				msg.auth = arg
+				_ = tp.PrintfLine("235 accepted")
+			case "MAIL":
+				msg.from = arg
+				_ = tp.PrintfLine("250 ok")
+			case "RCPT":
+				msg.to = append(msg.to, arg)
+				_ = tp.PrintfLine("250 ok")
+			case "DATA":
+				_ = tp.PrintfLine("354 go ahead")
+				if msg.data, err = tp.ReadDotBytes(); err != nil {
+					return
+				}
+				_ = tp.PrintfLine("250 queued")
+			case "QUIT":
+				_ = tp.PrintfLine("221 bye")
+				received <- msg
+				return
+			default:
+				_ = tp.PrintfLine("502 not implemented")
+			}
+		}
+	}()
+
+	return ln.Addr().String(), received
+}
+
+func TestMailerSend(t *testing.T) {
+	addr, received := smtpSink(t)
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cfg := defaultConfig()
+	cfg.SMTPHost = host
+	if cfg.SMTPPort, err = strconv.Atoi(port); err != nil {
+		t.Fatal(err)
+	}
+	cfg.SMTPUsername = "didt"
+	cfg.SMTPPassword = "secret"
+	cfg.SMTPFrom = "reminders@example.com"
+
+	if err := newMailer(cfg).send(context.Background(), testReminderEmail(t)); err != nil {
+		t.Fatal(err)
+	}
+	msg := <-received
+
+	if want := "PLAIN " + base64.StdEncoding.EncodeToString([]byte("\x00didt\x00secret")); msg.auth != want {
+		t.Fatalf("got AUTH %q, want %q", msg.auth, want)
+	}
+	if msg.from != "FROM:<reminders@example.com>" || len(msg.to) != 1 || msg.to[0] != "TO:<ada@example.com>" {
+		t.Fatalf("got envelope %q to %q", msg.from, msg.to)
+	}
+
+	m, err := mail.ReadMessage(strings.NewReader(string(msg.data)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	subject, err := new(mime.WordDecoder).DecodeHeader(m.Header.Get("Subject"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if subject != "Reminder: Stretch & <rest>" || m.Header.Get("To") != "ada@example.com" {
+		t.Fatalf("got headers %v", m.Header)
+	}
+
+	mediaType, params, err := mime.ParseMediaType(m.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/alternative" {
+		t.Fatalf("got content type %q: %v", m.Header.Get("Content-Type"), err)
+	}
+	parts := map[string]string{}
+	mr := multipart.NewReader(m.Body, params["boundary"])
+	for {
+		p, err := mr.NextRawPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(quotedprintable.NewReader(p))
+		if err != nil {
+			t.Fatal(err)
+		}
+		parts[p.Header.Get("Content-Type")] = string(body)
+	}
+
+	if !strings.Contains(parts["text/plain; charset=utf-8"], `"Stretch & <rest>"`) {
+		t.Fatalf("text part is %q", parts["text/plain; charset=utf-8"])
+	}
+	if !strings.Contains(parts["text/html; charset=utf-8"], "Stretch &amp; &lt;rest&gt;") {
+		t.Fatalf("html part is %q", parts["text/html; charset=utf-8"])
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgconn"
+)
+
+const (
+	CodeBadRequest       = "bad_request"
+	CodeValidationFailed = "validation_failed"
+	CodeUnauthorized     = "unauthorized"
+	CodeForbidden        = "forbidden"
+	CodeNotFound         = "not_found"
+	CodeConflict         = "conflict"
+	CodeUnsupportedMedia = "unsupported_media_type"
+	CodeTooLarge         = "too_large"
+	CodeInternal         = "internal"
+	CodeUnavailable      = "unavailable"
+)
+
+// uniqueViolation is the Postgres error code for a unique constraint failure.
+const uniqueViolation = "23505"
+
+type ErrorResponse struct {
+	Code        string      `json:"code"`
+	Message     string      `json:"message"`
+	FieldErrors FieldErrors `json:"field_errors,omitempty"`
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		logger.Error("Unable to encode response", "error", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, code, message string) {
+	writeJSON(w, status, ErrorResponse{
+		Code:    code,
+		Message: message,
+	})
+}
+
+func writeFieldErrors(w http.ResponseWriter, fieldErrors FieldErrors) {
+	writeJSON(w, http.StatusUnprocessableEntity, ErrorResponse{
+		Code:        CodeValidationFailed,
+		Message:     "request failed validation",
+		FieldErrors: fieldErrors,
+	})
+}
+
+// writeStoreError maps an error returned by the store to a response without
+// exposing the underlying database error to the client. message describes
+// what failed and is logged along with err.
+func writeStoreError(w http.ResponseWriter, r *http.Request, err error, message string) {
+	var pgErr *pgconn.PgError
+	switch {
+	case errors.Is(err, pgx.ErrNoRows):
+		writeError(w, http.StatusNotFound, CodeNotFound, "resource not found")
+	case errors.As(err, &pgErr) && pgErr.Code == uniqueViolation:
+		writeError(w, http.StatusConflict, CodeConflict, "resource already exists")
+	default:
+		loggerFrom(r.Context()).Error(message, "error", err.Error())
+		writeError(w, http.StatusInternalServerError, CodeInternal, message)
+	}
+}
@@ -0,0 +1,444 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// exportFormat and exportVersion identify the JSON export. Bump the
+	// version whenever a field changes meaning or is removed; adding fields
+	// does not need a new version.
+	exportFormat  = "didt-export"
+	exportVersion = 1
+	// exportFlushRows is how many rows are written between flushes.
+	exportFlushRows = 500
+)
+
+// Export is version 1 of the JSON export. Tasks and completions are listed
+// oldest first and every time is in UTC.
+type Export struct {
+	Format     string       `json:"format"`
+	Version    int          `json:"version"`
+	ExportedAt time.Time    `json:"exported_at"`
+	User       ExportUser   `json:"user"`
+	Tasks      []ExportTask `json:"tasks,omitempty"`
+}
+
+type ExportUser struct {
+	Username string `json:"username"`
+	Timezone string `json:"timezone"`
+}
+
+// ExportAccount is everything kept about the user besides their tasks and
+// completions. It is only part of the bundle export.
+type ExportAccount struct {
+	Username          string                   `json:"username"`
+	Timezone          string                   `json:"timezone"`
+	Email             *string                  `json:"email"`
+	WeeklyDigest      bool                     `json:"weekly_digest"`
+	IsAdmin           bool                     `json:"is_admin"`
+	CreatedAt         time.Time                `json:"created_at"`
+	Reminders         []ExportReminderSettings `json:"reminders"`
+	Pauses            []ExportTaskPause        `json:"pauses"`
+	Groups            []TaskGroupResponse      `json:"groups"`
+	Webhooks          []WebhookResponse        `json:"webhooks"`
+	PushSubscriptions []ExportPushSubscription `json:"push_subscriptions"`
+	CalendarFeeds     []CalendarFeedResponse   `json:"calendar_feeds"`
+}
+
+type ExportReminderSettings struct {
+	TaskID int `json:"task_id"`
+	ReminderSettingsResponse
+}
+
+type ExportTaskPause struct {
+	TaskID int `json:"task_id"`
+	TaskPauseResponse
+}
+
+type ExportPushSubscription struct {
+	Endpoint  string    `json:"endpoint"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type ExportTask struct {
+	ID          int         `json:"id"`
+	Name        string      `json:"name"`
+	Description string      `json:"description"`
+	Interval    string      `json:"interval"`
+	CreatedAt   time.Time   `json:"created_at"`
+	ArchivedAt  *time.Time  `json:"archived_at,omitempty"`
+	Group       string      `json:"group,omitempty"`
+	Completions []time.Time `json:"completions,omitempty"`
+}
+
+var exportCSVHeader = []string{"task_id", "task_name", "task_description", "interval", "task_created_at", "completed_at"}
+
+// exportWriter writes an export to a response, flushing every
+// exportFlushRows rows and pushing the write deadline back each time so
+// that large histories are not cut off by the server's WriteTimeout.
+type exportWriter struct {
+	w io.Writer
+	// rc is nil when the export is not written to a response.
+	rc      *http.ResponseController
+	timeout time.Duration
+	rows    int
+	// beforeFlush, if set, is called to write out anything buffered above
+	// the exportWriter.
+	beforeFlush func()
+}
+
+func (ew *exportWriter) Write(p []byte) (int, error) {
+	return ew.w.Write(p)
+}
+
+func (ew *exportWriter) row() error {
+	ew.rows++
+	if ew.rows%exportFlushRows != 0 {
+		return nil
+	}
+	return ew.flush()
+}
+
+func (ew *exportWriter) flush() error {
+	if ew.beforeFlush != nil {
+		ew.beforeFlush()
+	}
+	// Exports written to a file rather than a response have nothing more to
+	// flush.
+	if ew.rc == nil {
+		return nil
+	}
+	if err := ew.rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	if err := ew.rc.SetWriteDeadline(time.Now().Add(ew.timeout)); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		return err
+	}
+	return nil
+}
+
+// openObject returns the JSON encoding of v without its closing brace, so
+// that more fields can be streamed after it.
+func openObject(v any) ([]byte, error) {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	return b[:len(b)-1], nil
+}
+
+// writeJSONExport streams the export of the user as JSON.
+func writeJSONExport(ctx context.Context, conn *pgxpool.Pool, ew *exportWriter, user *User) error {
+	groups, err := getTaskGroups(ctx, conn, user.ID)
+	if err != nil {
+		return err
+	}
+	return encodeJSONExport(ew, user, groups, func(fn func(*Task, *time.Time) error) error {
+		return streamExport(ctx, conn, user.ID, fn)
+	})
+}
+
+// encodeJSONExport writes the JSON export of the user's groups and the rows
+// passed to fn by stream, which come in the order streamExport reads them.
+// Each task is written once its first row arrives and its completions as
+// they are read.
+func encodeJSONExport(ew *exportWriter, user *User, groups []*TaskGroup, stream func(fn func(*Task, *time.Time) error) error) error {
+	groupNames := make(map[int]string, len(groups))
+	for _, g := range groups {
+		groupNames[g.ID] = g.Name
+	}
+
+	head, err := openObject(Export{
+		Format:     exportFormat,
+		Version:    exportVersion,
+		ExportedAt: time.Now().UTC(),
+		User:       ExportUser{Username: user.Username, Timezone: user.Timezone},
+	})
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(ew, `%s,"tasks":[`, head); err != nil {
+		return err
+	}
+
+	lastTaskID := 0
+	completions := 0
+	err = stream(func(task *Task, completedAt *time.Time) error {
+		if task.ID != lastTaskID {
+			if lastTaskID != 0 {
+				if _, err := io.WriteString(ew, "]},"); err != nil {
+					return err
+				}
+			}
+			lastTaskID = task.ID
+			completions = 0
+
+			et := ExportTask{
+				ID:          task.ID,
+				Name:        task.Name,
+				Description: task.Description,
+				Interval:    task.Interval.String(),
+				CreatedAt:   task.CreatedAt.UTC(),
+				ArchivedAt:  task.ArchivedAt,
+			}
+			if task.GroupID != nil {
+				et.Group = groupNames[*task.GroupID]
+			}
+			head, err := openObject(et)
+			if err != nil {
+				return err
+			}
+			if _, err := fmt.Fprintf(ew, `%s,"completions":[`, head); err != nil {
+				return err
+			}
+		}
+
+		if completedAt == nil {
+			return nil
+		}
+
+		sep := ","
+		if completions == 0 {
+			sep = ""
+		}
+		completions++
+
+		b, err := json.Marshal(completedAt.UTC())
+		if err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(ew, "%s%s", sep, b); err != nil {
+			return err
+		}
+		return ew.row()
+	})
+	if err != nil {
+		return err
+	}
+
+	if lastTaskID != 0 {
+		if _, err := io.WriteString(ew, "]}"); err != nil {
+			return err
+		}
+	}
+	_, err = io.WriteString(ew, "]}\n")
+	return err
+}
+
+// writeCSVExport streams the export of the user as CSV with one row per
+// completion. Tasks without completions have a single row with an empty
+// completed_at.
+func writeCSVExport(ctx context.Context, conn *pgxpool.Pool, ew *exportWriter, user *User) error {
+	cw := csv.NewWriter(ew)
+	beforeFlush := ew.beforeFlush
+	ew.beforeFlush = func() {
+		cw.Flush()
+		if beforeFlush != nil {
+			beforeFlush()
+		}
+	}
+	if err := cw.Write(exportCSVHeader); err != nil {
+		return err
+	}
+
+	err := streamExport(ctx, conn, user.ID, func(task *Task, completedAt *time.Time) error {
+		record := []string{
+			strconv.Itoa(task.ID),
+			task.Name,
+			task.Description,
+			task.Interval.String(),
+			task.CreatedAt.UTC().Format(time.RFC3339Nano),
+			"",
+		}
+		if completedAt != nil {
+			record[5] = completedAt.UTC().Format(time.RFC3339Nano)
+		}
+		if err := cw.Write(record); err != nil {
+			return err
+		}
+		return ew.row()
+	})
+	if err != nil {
+		return err
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
+
+func getAccountExport(ctx context.Context, conn *pgxpool.Pool, user *User) (*ExportAccount, error) {
+	account := &ExportAccount{
+		Username:          user.Username,
+		Timezone:          user.Timezone,
+		WeeklyDigest:      user.WeeklyDigest,
+		IsAdmin:           user.IsAdmin,
+		CreatedAt:         user.CreatedAt.UTC(),
+		Reminders:         []ExportReminderSettings{},
+		Pauses:            []ExportTaskPause{},
+		Groups:            []TaskGroupResponse{},
+		Webhooks:          []WebhookResponse{},
+		PushSubscriptions: []ExportPushSubscription{},
+		CalendarFeeds:     []CalendarFeedResponse{},
+	}
+	if user.Email != "" {
+		account.Email = &user.Email
+	}
+
+	settings, err := getUserReminderSettings(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, rs := range settings {
+		account.Reminders = append(account.Reminders, ExportReminderSettings{TaskID: rs.TaskID, ReminderSettingsResponse: newReminderSettingsResponse(rs)})
+	}
+
+	pauses, err := getUserPauses(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, p := range pauses {
+		account.Pauses = append(account.Pauses, ExportTaskPause{TaskID: p.TaskID, TaskPauseResponse: newTaskPauseResponse(p)})
+	}
+
+	groups, err := getTaskGroups(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, g := range groups {
+		account.Groups = append(account.Groups, newTaskGroupResponse(g))
+	}
+
+	hooks, err := getWebhooks(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, hook := range hooks {
+		account.Webhooks = append(account.Webhooks, newWebhookResponse(hook))
+	}
+
+	subs, err := getPushSubscriptions(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range subs {
+		account.PushSubscriptions = append(account.PushSubscriptions, ExportPushSubscription{Endpoint: sub.Endpoint, CreatedAt: sub.CreatedAt.UTC()})
+	}
+
+	feeds, err := getCalendarFeeds(ctx, conn, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	for _, feed := range feeds {
+		account.CalendarFeeds = append(account.CalendarFeeds, newCalendarFeedResponse(feed))
+	}
+
+	return account, nil
+}
+
+func writeAccountExport(ctx context.Context, conn *pgxpool.Pool, ew *exportWriter, user *User) error {
+	account, err := getAccountExport(ctx, conn, user)
+	if err != nil {
+		return err
+	}
+
+	enc := json.NewEncoder(ew)
+	enc.SetIndent("", "  ")
+	return enc.Encode(account)
+}
+
+func writeCalendarExport(ctx context.Context, conn *pgxpool.Pool, ew *exportWriter, user *User) error {
+	cw := &calendarWriter{}
+	if err := writeCalendar(ctx, conn, cw, user, time.Now()); err != nil {
+		return err
+	}
+
+	_, err := ew.Write(cw.buf.Bytes())
+	return err
+}
+
+// bundleFiles are the files of the bundle export, in the order they are
+// written. The JSON export can be imported again as it is.
+var bundleFiles = []struct {
+	name  string
+	write func(context.Context, *pgxpool.Pool, *exportWriter, *User) error
+}{
+	{"account.json", writeAccountExport},
+	{"didt-export.json", writeJSONExport},
+	{"didt-export.csv", writeCSVExport},
+	{"tasks.ics", writeCalendarExport},
+}
+
+// writeBundleExport streams a zip of everything kept about the user: their
+// account and settings, and their tasks as JSON, CSV and iCalendar.
+func writeBundleExport(ctx context.Context, conn *pgxpool.Pool, ew *exportWriter, user *User) error {
+	zw := zip.NewWriter(ew)
+	modified := time.Now()
+
+	for _, file := range bundleFiles {
+		fw, err := zw.CreateHeader(&zip.FileHeader{Name: file.name, Method: zip.Deflate, Modified: modified})
+		if err != nil {
+			return err
+		}
+
+		part := &exportWriter{w: fw, rc: ew.rc, timeout: ew.timeout, beforeFlush: func() { _ = zw.Flush() }}
+		if err := file.write(ctx, conn, part, user); err != nil {
+			return fmt.Errorf("%s: %w", file.name, err)
+		}
+	}
+
+	return zw.Close()
+}
+
+// handleExport streams all of the user's tasks and their completions as JSON
+// or CSV, or everything kept about them as a zip bundle. Errors after the
+// response has started can only be logged, leaving the client with a
+// truncated download.
+func handleExport(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		format := r.URL.Query().Get("format")
+		if format == "" {
+			format = "json"
+		}
+
+		var write func(context.Context, *pgxpool.Pool, *exportWriter, *User) error
+		ext := format
+		switch format {
+		case "json":
+			write = writeJSONExport
+			w.Header().Set("Content-Type", "application/json")
+		case "csv":
+			write = writeCSVExport
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		case "bundle":
+			write = writeBundleExport
+			ext = "zip"
+			w.Header().Set("Content-Type", "application/zip")
+		default:
+			writeFieldErrors(w, FieldErrors{"format": "format must be json, csv or bundle"})
+			return
+		}
+
+		filename := fmt.Sprintf("didt-export-%s.%s", time.Now().UTC().Format(time.DateOnly), ext)
+		w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+		w.Header().Set("Cache-Control", "no-store")
+
+		ew := &exportWriter{w: w, rc: http.NewResponseController(w), timeout: cfg.WriteTimeout}
+		if err := write(r.Context(), conn, ew, user); err != nil {
+			loggerFrom(r.Context()).Error("Unable to export", "format", format, "error", err.Error())
+		}
+	}
+}
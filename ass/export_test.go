@@ -0,0 +1,110 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"testing"
+	"time"
+)
+
+// exportRow is one row as streamExport passes it on.
+type exportRow struct {
+	task        *Task
+	completedAt *time.Time
+}
+
+// encodeTestExport returns the JSON export of rows.
+func encodeTestExport(t *testing.T, groups []*TaskGroup, rows []exportRow) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	user := &User{ID: 1, Username: "alice", Timezone: "Europe/Berlin"}
+	err := encodeJSONExport(&exportWriter{w: &buf}, user, groups, func(fn func(*Task, *time.Time) error) error {
+		for _, row := range rows {
+			if err := fn(row.task, row.completedAt); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !json.Valid(buf.Bytes()) {
+		t.Fatalf("export is not valid JSON: %s", buf.Bytes())
+	}
+	return buf.Bytes()
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(value string) *time.Time {
+		t, _ := time.ParseInLocation(time.DateTime, value, berlin)
+		return &t
+	}
+
+	groupID := 3
+	stretch := &Task{ID: 1, Name: "Stretch", Description: "Ten minutes, \"properly\"", Interval: Daily, CreatedAt: *at("2024-01-01 09:00:00"), GroupID: &groupID}
+	old := &Task{ID: 2, Name: "Old habit", Interval: Weekly, CreatedAt: *at("2023-06-01 18:30:00"), ArchivedAt: at("2024-02-01 08:00:00")}
+	read := &Task{ID: 4, Name: "Läsa", Interval: Monthly, CreatedAt: *at("2024-01-15 12:00:00")}
+
+	rows := []exportRow{
+		{stretch, at("2024-03-01 07:15:00")},
+		{stretch, at("2024-03-02 23:45:00")},
+		{old, nil},
+		{read, at("2024-03-31 22:30:00")},
+	}
+	groups := []*TaskGroup{{ID: groupID, Name: "Health"}}
+
+	s := newImportSource(berlin)
+	if err := parseDIDTImport(s, encodeTestExport(t, groups, rows)); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.warnings) > 0 {
+		t.Errorf("got warnings %q", s.warnings)
+	}
+
+	want := []*importTask{
+		{Name: stretch.Name, Description: stretch.Description, Interval: Daily, CreatedAt: stretch.CreatedAt, Group: "Health", Completions: []time.Time{*rows[0].completedAt, *rows[1].completedAt}},
+		{Name: old.Name, Interval: Weekly, CreatedAt: old.CreatedAt, ArchivedAt: old.ArchivedAt},
+		{Name: read.Name, Interval: Monthly, CreatedAt: read.CreatedAt, Completions: []time.Time{*rows[3].completedAt}},
+	}
+	if len(s.tasks) != len(want) {
+		t.Fatalf("got %d tasks, want %d", len(s.tasks), len(want))
+	}
+	for i, got := range s.tasks {
+		w := want[i]
+		if got.Name != w.Name || got.Description != w.Description || got.Interval != w.Interval || got.Group != w.Group || !got.CreatedAt.Equal(w.CreatedAt) {
+			t.Errorf("task %d: got %+v, want %+v", i, got, w)
+		}
+		if (got.ArchivedAt == nil) != (w.ArchivedAt == nil) || got.ArchivedAt != nil && !got.ArchivedAt.Equal(*w.ArchivedAt) {
+			t.Errorf("%q: got archived at %v, want %v", got.Name, got.ArchivedAt, w.ArchivedAt)
+		}
+		if !slices.EqualFunc(got.Completions, w.Completions, time.Time.Equal) {
+			t.Errorf("%q: got completions %v, want %v", got.Name, got.Completions, w.Completions)
+		}
+	}
+}
+
+func TestExportEmpty(t *testing.T) {
+	data := encodeTestExport(t, nil, nil)
+
+	var export Export
+	if err := json.Unmarshal(data, &export); err != nil {
+		t.Fatal(err)
+	}
+	if export.Format != exportFormat || export.Version != exportVersion || export.User.Username != "alice" || len(export.Tasks) != 0 {
+		t.Fatalf("got %+v", export)
+	}
+
+	s := newImportSource(time.UTC)
+	if err := parseDIDTImport(s, data); err != nil {
+		t.Fatal(err)
+	}
+	if len(s.tasks) != 0 {
+		t.Fatalf("got tasks %+v", s.tasks)
+	}
+}
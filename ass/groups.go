@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TaskGroup is a category the user files tasks under. A task is in at most
+// one group, and deleting a group leaves its tasks ungrouped.
+type TaskGroup struct {
+	ID        int
+	UserID    int
+	Name      string
+	CreatedAt time.Time
+	// Tasks counts the tasks in the group, archived ones included.
+	Tasks int
+}
+
+type TaskGroupResponse struct {
+	ID        int       `json:"id"`
+	Name      string    `json:"name"`
+	Tasks     int       `json:"tasks"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newTaskGroupResponse(g *TaskGroup) TaskGroupResponse {
+	return TaskGroupResponse{
+		ID:        g.ID,
+		Name:      g.Name,
+		Tasks:     g.Tasks,
+		CreatedAt: g.CreatedAt,
+	}
+}
+
+type TaskGroupRequest struct {
+	Name string `json:"name"`
+}
+
+func groupFromPath(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool) (*TaskGroup, bool) {
+	user := r.Context().Value(UserKey("user")).(*User)
+
+	groupID, err := strconv.Atoi(r.PathValue("groupId"))
+	if err != nil {
+		writeFieldErrors(w, FieldErrors{"group_id": "group_id must be an integer"})
+		return nil, false
+	}
+
+	g, err := getTaskGroup(r.Context(), conn, groupID)
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get group")
+		return nil, false
+	}
+	if g.UserID != user.ID {
+		writeError(w, http.StatusNotFound, CodeNotFound, "resource not found")
+		return nil, false
+	}
+
+	return g, true
+}
+
+// checkGroup makes sure groupID is one of the user's groups, writing a
+// validation error against field and returning false if it is not.
+func checkGroup(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool, field string, groupID int) bool {
+	user := r.Context().Value(UserKey("user")).(*User)
+
+	g, err := getTaskGroup(r.Context(), conn, groupID)
+	if errors.Is(err, pgx.ErrNoRows) || err == nil && g.UserID != user.ID {
+		writeFieldErrors(w, FieldErrors{field: fmt.Sprintf("%s must be one of your groups", field)})
+		return false
+	}
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get group")
+		return false
+	}
+
+	return true
+}
+
+// decodeGroupRequest reads and validates the body of a request that names a
+// group, writing an error response and returning false if it is invalid.
+func decodeGroupRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	var body TaskGroupRequest
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+		loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+		return "", false
+	}
+
+	name := strings.TrimSpace(body.Name)
+	if fe := validateTaskGroup(name); len(fe) > 0 {
+		writeFieldErrors(w, fe)
+		return "", false
+	}
+
+	return name, true
+}
+
+func handleGetTaskGroups(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		groups, err := getTaskGroups(r.Context(), conn, user.ID)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get groups")
+			return
+		}
+
+		responses := make([]TaskGroupResponse, len(groups))
+		for i, g := range groups {
+			responses[i] = newTaskGroupResponse(g)
+		}
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+func handleCreateTaskGroup(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		name, ok := decodeGroupRequest(w, r)
+		if !ok {
+			return
+		}
+
+		g := &TaskGroup{UserID: user.ID, Name: name}
+		if err := insertTaskGroup(r.Context(), conn, g); err != nil {
+			writeStoreError(w, r, err, "Unable to insert group")
+			return
+		}
+
+		w.Header().Set("Location", fmt.Sprintf("/api/groups/%d", g.ID))
+		writeJSON(w, http.StatusCreated, newTaskGroupResponse(g))
+	}
+}
+
+// handleUpdateTaskGroup renames a group.
+func handleUpdateTaskGroup(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g, ok := groupFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		name, ok := decodeGroupRequest(w, r)
+		if !ok {
+			return
+		}
+
+		g.Name = name
+		if err := updateTaskGroup(r.Context(), conn, g); err != nil {
+			writeStoreError(w, r, err, "Unable to update group")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newTaskGroupResponse(g))
+	}
+}
+
+func handleDeleteTaskGroup(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		g, ok := groupFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		if err := deleteTaskGroup(r.Context(), conn, g.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete group")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -5,11 +5,14 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"mime"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync/atomic"
 	"time"
 
-	"github.com/jackc/pgx"
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
@@ -19,90 +22,235 @@ const (
 	previewLimit = 30
 )
 
-func startHTTP(port int, conn *pgxpool.Pool) error {
-	mux := http.NewServeMux()
+// startHTTP serves the API until ctx is cancelled, then drains in-flight
+// requests before returning.
+func startHTTP(ctx context.Context, cfg *Config, conn *pgxpool.Pool) error {
+	var ready atomic.Bool
+	ready.Store(true)
 
-	// unauthorized
-	mux.HandleFunc("GET /api/health", func(w http.ResponseWriter, r *http.Request) {
-		if err := conn.Ping(r.Context()); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to ping database", "error", err.Error())
-			return
+	mux := routes(cfg, conn, &ready)
+
+	if err := checkOpenAPI(openAPISpec, mux.patterns); err != nil {
+		return err
+	}
+
+	servers := []*http.Server{newServer(cfg, cfg.Port, withRequestLogging(withMetrics(withSecurityHeaders(cfg, withCORS(cfg, withCSRF(cfg, mux))))))}
+
+	if cfg.MetricsPort != 0 {
+		metricsMux := http.NewServeMux()
+		metricsMux.HandleFunc("GET /metrics", withMetricsToken(cfg, handleMetrics(conn)))
+		servers = append(servers, newServer(cfg, cfg.MetricsPort, metricsMux))
+	}
+
+	errCh := make(chan error, len(servers))
+	for _, srv := range servers {
+		go func() {
+			errCh <- srv.ListenAndServe()
+		}()
+	}
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+	}
+
+	logger.Info("Shutting down, draining requests")
+	ready.Store(false)
+	time.Sleep(cfg.ShutdownDelay)
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	for _, srv := range servers {
+		if err := srv.Shutdown(shutdownCtx); err != nil {
+			return err
 		}
-		w.WriteHeader(http.StatusOK)
-	})
+	}
 
-	mux.HandleFunc("POST /api/auth/login", handleAuth(conn))
-	mux.HandleFunc("GET /api/auth/logout", handleLogout())
-	mux.HandleFunc("GET /api/auth/magic/{magicToken}", handleMagic(conn))
+	for range servers {
+		if err := <-errCh; !errors.Is(err, http.ErrServerClosed) {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func newServer(cfg *Config, port int, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              fmt.Sprintf(":%d", port),
+		Handler:           h,
+		ReadTimeout:       cfg.ReadTimeout,
+		ReadHeaderTimeout: cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+	}
+}
+
+func routes(cfg *Config, conn *pgxpool.Pool, ready *atomic.Bool) *router {
+	mux := newRouter()
+
+	// unauthorized
+	mux.HandleFunc("GET /api/health", handleHealth(conn, ready))
+	mux.HandleFunc("GET /api/health/live", handleLive())
+	mux.HandleFunc("GET /api/health/ready", handleReady(cfg, conn, ready))
+
+	mux.HandleFunc("GET /api/openapi.json", handleOpenAPI())
+
+	// Metrics are only served alongside the API when they are protected by
+	// a token; otherwise they need their own port.
+	if cfg.MetricsPort == 0 && cfg.MetricsToken != "" {
+		mux.HandleFunc("GET /metrics", withMetricsToken(cfg, handleMetrics(conn)))
+	}
+
+	mux.HandleFunc("POST /api/auth/login", handleAuth(cfg, conn))
+	mux.HandleFunc("POST /api/auth/logout", handleLogout(cfg, conn))
+	mux.HandleFunc("POST /api/auth/token", handleCreateToken(conn))
+	mux.HandleFunc("GET /api/auth/magic/{magicToken}", handleMagic(cfg, conn))
 
 	// authorized
+	ttl := cfg.IdempotencyTTL
 	mux.HandleFunc("GET /api/tasks", withUser(conn, handleGetTasks(conn, previewLimit)))
-	mux.HandleFunc("POST /api/tasks", withUser(conn, handleCreateTask(conn)))
-	mux.HandleFunc("POST /api/tasks/{taskId}/complete", handleCompleteTask(conn))
+	mux.HandleFunc("POST /api/tasks", withUser(conn, withIdempotency(conn, ttl, handleCreateTask(conn, previewLimit))))
+	mux.HandleFunc("GET /api/tasks/{taskId}", withUser(conn, handleGetTask(conn, previewLimit)))
+	mux.HandleFunc("PATCH /api/tasks/{taskId}", withUser(conn, withIdempotency(conn, ttl, handleUpdateTask(conn, previewLimit))))
+	mux.HandleFunc("DELETE /api/tasks/{taskId}", withUser(conn, withIdempotency(conn, ttl, handleDeleteTask(conn))))
+	mux.HandleFunc("PUT /api/tasks/order", withUser(conn, withIdempotency(conn, ttl, handleReorderTasks(conn))))
+	mux.HandleFunc("POST /api/tasks/{taskId}/complete", withUser(conn, withIdempotency(conn, ttl, handleCompleteTask(conn))))
+	mux.HandleFunc("GET /api/tasks/{taskId}/reminders", withUser(conn, handleGetReminderSettings(conn)))
+	mux.HandleFunc("PUT /api/tasks/{taskId}/reminders", withUser(conn, withIdempotency(conn, ttl, handlePutReminderSettings(conn))))
+	mux.HandleFunc("GET /api/tasks/{taskId}/pauses", withUser(conn, handleGetTaskPauses(conn)))
+	mux.HandleFunc("POST /api/tasks/{taskId}/pauses", withUser(conn, withIdempotency(conn, ttl, handleCreateTaskPause(conn))))
+	mux.HandleFunc("DELETE /api/tasks/{taskId}/pauses/{pauseId}", withUser(conn, withIdempotency(conn, ttl, handleDeleteTaskPause(conn))))
+	mux.HandleFunc("GET /api/groups", withUser(conn, handleGetTaskGroups(conn)))
+	mux.HandleFunc("POST /api/groups", withUser(conn, withIdempotency(conn, ttl, handleCreateTaskGroup(conn))))
+	mux.HandleFunc("PATCH /api/groups/{groupId}", withUser(conn, withIdempotency(conn, ttl, handleUpdateTaskGroup(conn))))
+	mux.HandleFunc("DELETE /api/groups/{groupId}", withUser(conn, withIdempotency(conn, ttl, handleDeleteTaskGroup(conn))))
+	mux.HandleFunc("GET /api/webhooks", withUser(conn, handleGetWebhooks(conn)))
+	mux.HandleFunc("POST /api/webhooks", withUser(conn, withIdempotency(conn, ttl, handleCreateWebhook(conn))))
+	mux.HandleFunc("DELETE /api/webhooks/{webhookId}", withUser(conn, withIdempotency(conn, ttl, handleDeleteWebhook(conn))))
+	mux.HandleFunc("GET /api/webhooks/{webhookId}/deliveries", withUser(conn, handleGetWebhookDeliveries(conn)))
+	mux.HandleFunc("POST /api/webhooks/{webhookId}/ping", withUser(conn, withIdempotency(conn, ttl, handlePingWebhook(cfg, conn))))
+	mux.HandleFunc("GET /api/push/key", handleGetPushKey(cfg.vapidKey()))
+	mux.HandleFunc("POST /api/push/subscriptions", withUser(conn, withIdempotency(conn, ttl, handleCreatePushSubscription(cfg.vapidKey(), conn))))
+	mux.HandleFunc("DELETE /api/push/subscriptions", withUser(conn, withIdempotency(conn, ttl, handleDeletePushSubscription(conn))))
+	mux.HandleFunc("GET /api/export", withUser(conn, handleExport(cfg, conn)))
+	mux.HandleFunc("POST /api/import", withUser(conn, withIdempotency(conn, ttl, handleImport(conn))))
+	mux.HandleFunc("GET /api/calendar/feeds", withUser(conn, handleGetCalendarFeeds(conn)))
+	mux.HandleFunc("POST /api/calendar/feeds", withUser(conn, withIdempotency(conn, ttl, handleCreateCalendarFeed(cfg, conn))))
+	mux.HandleFunc("DELETE /api/calendar/feeds/{feedId}", withUser(conn, withIdempotency(conn, ttl, handleDeleteCalendarFeed(conn))))
+	mux.HandleFunc("GET /api/calendar/{token}/tasks.ics", handleCalendar(conn))
+	mux.HandleFunc("PUT /api/account/email", withUser(conn, withIdempotency(conn, ttl, handleSetEmail(cfg, conn, newMailer(cfg)))))
+	mux.HandleFunc("DELETE /api/account/email", withUser(conn, withIdempotency(conn, ttl, handleDeleteEmail(conn))))
+	mux.HandleFunc("GET /api/account/email/verify/{token}", handleVerifyEmail(conn))
+	mux.HandleFunc("PATCH /api/account", withUser(conn, withIdempotency(conn, ttl, handleUpdateAccount(conn))))
+	mux.HandleFunc("DELETE /api/account", withUser(conn, withIdempotency(conn, ttl, handleDeleteAccount(cfg, conn))))
 	mux.HandleFunc("GET /api/auth/session", withUser(conn, handleSession()))
+	mux.HandleFunc("DELETE /api/auth/token", withUser(conn, withIdempotency(conn, ttl, handleRevokeToken(conn))))
 	mux.HandleFunc("GET /api/auth/qr", withUser(conn, handleQR(conn)))
 
-	fs := http.FileServer(http.Dir("/dist"))
-	mux.Handle("/", fs)
+	// admin
+	mux.HandleFunc("GET /api/admin/users", withAdmin(conn, handleAdminGetUsers(conn)))
+	mux.HandleFunc("PATCH /api/admin/users/{userId}", withAdmin(conn, withIdempotency(conn, ttl, handleAdminUpdateUser(conn))))
+	mux.HandleFunc("DELETE /api/admin/users/{userId}", withAdmin(conn, withIdempotency(conn, ttl, handleAdminDeleteUser(conn))))
+	mux.HandleFunc("DELETE /api/admin/users/{userId}/sessions", withAdmin(conn, withIdempotency(conn, ttl, handleAdminLogoutUser(conn))))
+	mux.HandleFunc("GET /api/admin/stats", withAdmin(conn, handleAdminStats(conn)))
 
-	return http.ListenAndServe(fmt.Sprintf(":%d", port), mux)
+	mux.HandleFunc("/", handleStatic(staticFS(cfg)))
+
+	return mux
 }
 
 func hello(w http.ResponseWriter, _ *http.Request) {
 	w.Write([]byte("Hello, World!"))
 }
 
+// sessionToken returns the bearer token of r, falling back to its session
+// cookie.
+func sessionToken(r *http.Request) (string, bool) {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		return token, true
+	}
+
+	cookie, err := r.Cookie("session_token")
+	if err != nil || cookie.Value == "" {
+		return "", false
+	}
+
+	return cookie.Value, true
+}
+
 func withUser(conn *pgxpool.Pool, h http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		cookie, err := r.Cookie("session_token")
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusUnauthorized)
-			logger.Error("Unable to get cookie", "error", err.Error())
+		token, ok := sessionToken(r)
+		if !ok {
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "session cookie or bearer token is required")
+			loggerFrom(r.Context()).Error("Unable to get session token", "error", "no session cookie or bearer token")
 			return
 		}
 
-		session, err := getSession(r.Context(), conn, cookie.Value)
+		session, err := getSession(r.Context(), conn, token)
 		if err != nil {
-			logger.Error("Unable to get session", "error", err.Error())
-			http.Error(w, "Unable to get session", http.StatusInternalServerError)
-			return
-		}
-		if session.ID == 0 {
-			http.Error(w, "session not found", http.StatusUnauthorized)
-			logger.Error("Session not found", "error", "session not found")
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "session not found")
+				loggerFrom(r.Context()).Error("Session not found", "error", "session not found")
+				return
+			}
+			writeStoreError(w, r, err, "Unable to get session")
 			return
 		}
 
 		user, err := getUserByID(r.Context(), conn, session.UserID)
 		if err != nil {
-			if !errors.Is(err, pgx.ErrNoRows) && err.Error() != "no rows in result set" {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
+			if errors.Is(err, pgx.ErrNoRows) {
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "user not found")
+				loggerFrom(r.Context()).Error("User not found", "error", "user not found")
 				return
 			}
+			writeStoreError(w, r, err, "Unable to get user")
+			return
 		}
-		if user.ID == 0 {
-			http.Error(w, "user not found", http.StatusUnauthorized)
-			logger.Error("User not found", "error", "user not found")
+		if refuseDisabled(w, r, user) {
 			return
 		}
 
+		setRequestUser(r.Context(), user.ID)
 		ctx := context.WithValue(r.Context(), UserKey("user"), user)
 
 		h(w, r.WithContext(ctx))
 	}
 }
 
-func handleLogout() http.HandlerFunc {
+// refuseDisabled writes an error response and returns true if an admin has
+// disabled the user's account.
+func refuseDisabled(w http.ResponseWriter, r *http.Request, user *User) bool {
+	if user.DisabledAt == nil {
+		return false
+	}
+
+	writeError(w, http.StatusForbidden, CodeForbidden, "account is disabled")
+	loggerFrom(r.Context()).Error("Account is disabled", "error", "account is disabled")
+	return true
+}
+
+func handleLogout(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
+		if token, ok := sessionToken(r); ok {
+			if err := deleteSession(r.Context(), conn, token); err != nil {
+				writeStoreError(w, r, err, "Unable to delete session")
+				return
+			}
+		}
+
 		http.SetCookie(w, &http.Cookie{
 			Name:     "session_token",
 			Value:    "",
 			Path:     "/",
 			HttpOnly: true,
-			Secure:   isProduction(),
+			Secure:   cfg.IsProduction(),
 			SameSite: http.SameSiteStrictMode,
-			MaxAge:   60 * 60,
+			MaxAge:   -1,
 		})
 	}
 }
@@ -110,52 +258,139 @@ func handleLogout() http.HandlerFunc {
 func handleSession() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(UserKey("user")).(*User)
-		if user.ID == 0 {
-			http.Error(w, "user not found", http.StatusUnauthorized)
-			logger.Error("User not found", "error", "user not found")
-			return
-		}
 
 		userResp := struct {
-			Username string `json:"username"`
+			Username     string  `json:"username"`
+			Timezone     string  `json:"timezone"`
+			Email        *string `json:"email"`
+			WeeklyDigest bool    `json:"weekly_digest"`
+			IsAdmin      bool    `json:"is_admin"`
 		}{
-			Username: user.Username,
+			Username:     user.Username,
+			Timezone:     user.Timezone,
+			WeeklyDigest: user.WeeklyDigest,
+			IsAdmin:      user.IsAdmin,
+		}
+		if user.Email != "" {
+			userResp.Email = &user.Email
+		}
+
+		writeJSON(w, http.StatusOK, userResp)
+	}
+}
+
+func handleUpdateAccount(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body struct {
+			Timezone     *string `json:"timezone"`
+			WeeklyDigest *bool   `json:"weekly_digest"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if body.Timezone != nil {
+			if fe := validateTimezone(*body.Timezone); len(fe) > 0 {
+				writeFieldErrors(w, fe)
+				return
+			}
+
+			if err := updateUserTimezone(r.Context(), conn, user.ID, *body.Timezone); err != nil {
+				writeStoreError(w, r, err, "Unable to update timezone")
+				return
+			}
 		}
 
-		if err := json.NewEncoder(w).Encode(userResp); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if body.WeeklyDigest != nil {
+			if err := updateUserWeeklyDigest(r.Context(), conn, user.ID, *body.WeeklyDigest); err != nil {
+				writeStoreError(w, r, err, "Unable to update weekly digest")
+				return
+			}
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleDeleteAccount deletes the user and everything they own once they
+// confirm with their password. Clients should offer the bundle export first,
+// since nothing can be recovered afterwards.
+func handleDeleteAccount(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body struct {
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
 		}
+
+		if body.Password == "" {
+			writeFieldErrors(w, FieldErrors{"password": "password is required"})
+			return
+		}
+
+		valid, err := comparePassword(r.Context(), conn, user.Username, body.Password)
+		if err != nil || !valid {
+			writeError(w, http.StatusForbidden, CodeForbidden, "password is incorrect")
+			loggerFrom(r.Context()).Error("Incorrect password", "error", "password is incorrect")
+			return
+		}
+
+		if err := deleteUser(r.Context(), conn, user.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete user")
+			return
+		}
+
+		http.SetCookie(w, &http.Cookie{
+			Name:     "session_token",
+			Value:    "",
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   cfg.IsProduction(),
+			SameSite: http.SameSiteStrictMode,
+			MaxAge:   -1,
+		})
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
 
-func handleMagic(conn *pgxpool.Pool) http.HandlerFunc {
+func handleMagic(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		magicToken := r.PathValue("magicToken")
 		if magicToken == "" {
-			http.Error(w, "magic_token is required", http.StatusBadRequest)
-			logger.Error("Magic token is required", "error", "magic_token is required")
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "magic_token is required")
+			loggerFrom(r.Context()).Error("Magic token is required", "error", "magic_token is required")
 			return
 		}
 
 		magicLink, err := getMagicLinkByToken(r.Context(), conn, magicToken)
 		if err != nil {
-			logger.Error("Unable to get magic link by token", "error", err.Error())
-			http.Error(w, "Cannot verify magic link", http.StatusNotFound)
+			metrics.logins.Inc("magic_link", "failure")
+			writeStoreError(w, r, err, "Unable to get magic link by token")
 			return
 		}
 
 		user, err := getUserByID(r.Context(), conn, magicLink.UserID)
 		if err != nil {
-			logger.Error("Unable to get user by id", "error", err.Error())
-			http.Error(w, "Cannot find user", http.StatusNotFound)
+			writeStoreError(w, r, err, "Unable to get user by id")
+			return
+		}
+		if refuseDisabled(w, r, user) {
 			return
 		}
 
 		token := newToken()
 
 		if err := insertSession(r.Context(), conn, user.ID, token); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to insert session", "error", err.Error())
+			writeStoreError(w, r, err, "Unable to insert session")
 			return
 		}
 
@@ -164,11 +399,12 @@ func handleMagic(conn *pgxpool.Pool) http.HandlerFunc {
 			Value:    token,
 			Path:     "/",
 			HttpOnly: true,
-			Secure:   isProduction(),
+			Secure:   cfg.IsProduction(),
 			SameSite: http.SameSiteStrictMode,
 			MaxAge:   60 * 60,
 		})
 
+		metrics.logins.Inc("magic_link", "success")
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
 }
@@ -176,44 +412,33 @@ func handleMagic(conn *pgxpool.Pool) http.HandlerFunc {
 func handleQR(conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(UserKey("user")).(*User)
-		if user.ID == 0 {
-			http.Error(w, "user not found", http.StatusUnauthorized)
-			logger.Error("User not found", "error", "user not found")
-			return
-		}
 
 		magicLink, err := getMagicLink(r.Context(), conn, user.ID)
-		if err != nil {
-			logger.Error("Unable to get magic link", "error", err.Error())
-			if !errors.Is(err, pgx.ErrNoRows) && err.Error() != "no rows in result set" {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			writeStoreError(w, r, err, "Unable to get magic link")
+			return
 		}
 		if magicLink == nil || magicLink.ID == 0 {
 			if _, err := w.Write([]byte(magicLink.Token)); err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				logger.Error("Unable to write magic link token", "error", err.Error())
+				loggerFrom(r.Context()).Error("Unable to write magic link token", "error", err.Error())
 			}
 			return
 		}
 
 		token := newToken()
 		if err := insertMagicLink(r.Context(), conn, token, user.ID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to insert magic link", "error", err.Error())
+			writeStoreError(w, r, err, "Unable to insert magic link")
 			return
 		}
 
 		if _, err := w.Write([]byte(token)); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to write magic link token", "error", err.Error())
+			loggerFrom(r.Context()).Error("Unable to write magic link token", "error", err.Error())
 			return
 		}
 	}
 }
 
-func handleAuth(conn *pgxpool.Pool) http.HandlerFunc {
+func handleAuth(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		decoder := json.NewDecoder(r.Body)
 		var body struct {
@@ -221,41 +446,40 @@ func handleAuth(conn *pgxpool.Pool) http.HandlerFunc {
 			Password string `json:"password"`
 		}
 		if err := decoder.Decode(&body); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Unable to decode request body", "error", err.Error())
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
 			return
 		}
 
 		username := body.Username
 		password := body.Password
 
-		if username == "" || password == "" {
-			http.Error(w, "username and password are required", http.StatusBadRequest)
-			logger.Error("Username and password are required", "error", "username and password are required")
+		if fe := validateCredentials(username, password); len(fe) > 0 {
+			writeFieldErrors(w, fe)
 			return
 		}
 
 		user, err := getUser(r.Context(), conn, username)
-		if err != nil {
-			logger.Error("Unable to get user", "error", err.Error())
-			if !errors.Is(err, pgx.ErrNoRows) && err.Error() != "no rows in result set" {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+		if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+			writeStoreError(w, r, err, "Unable to get user")
+			return
 		}
 		if user == nil || user.ID == 0 {
 			var err error
 			user, err = insertUser(r.Context(), conn, username, password)
 			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				logger.Error("Unable to insert user", "error", err.Error())
+				writeStoreError(w, r, err, "Unable to insert user")
 				return
 			}
 		} else {
 			valid, err := comparePassword(r.Context(), conn, username, password)
 			if err != nil || !valid {
-				http.Error(w, "invalid username or password", http.StatusUnauthorized)
-				logger.Error("Invalid username or password", "error", "invalid username or password")
+				metrics.logins.Inc("password", "failure")
+				writeError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid username or password")
+				loggerFrom(r.Context()).Error("Invalid username or password", "error", "invalid username or password")
+				return
+			}
+			if refuseDisabled(w, r, user) {
 				return
 			}
 		}
@@ -263,8 +487,7 @@ func handleAuth(conn *pgxpool.Pool) http.HandlerFunc {
 		token := newToken()
 
 		if err := insertSession(r.Context(), conn, user.ID, token); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to insert session", "error", err.Error())
+			writeStoreError(w, r, err, "Unable to insert session")
 			return
 		}
 
@@ -273,137 +496,416 @@ func handleAuth(conn *pgxpool.Pool) http.HandlerFunc {
 			Value:    token,
 			Path:     "/",
 			HttpOnly: true,
-			Secure:   isProduction(),
+			Secure:   cfg.IsProduction(),
 			SameSite: http.SameSiteStrictMode,
 			MaxAge:   60 * 60,
 		})
 
+		metrics.logins.Inc("password", "success")
 		http.Redirect(w, r, "/", http.StatusFound)
 	}
 }
 
-func handleCompleteTask(conn *pgxpool.Pool) http.HandlerFunc {
+// handleCreateToken issues a bearer token for clients that cannot use the
+// session cookie. Unlike handleAuth it never creates the user.
+func handleCreateToken(conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		taskIDStr := r.PathValue("taskId")
-		if taskIDStr == "" {
-			http.Error(w, "task_id is required", http.StatusBadRequest)
-			logger.Error("Task ID is required", "error", "task_id is required")
+		var body struct {
+			Username string `json:"username"`
+			Password string `json:"password"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if fe := validateCredentials(body.Username, body.Password); len(fe) > 0 {
+			writeFieldErrors(w, fe)
 			return
 		}
 
-		taskID, err := strconv.Atoi(taskIDStr)
+		valid, err := comparePassword(r.Context(), conn, body.Username, body.Password)
+		if err != nil || !valid {
+			metrics.logins.Inc("token", "failure")
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "invalid username or password")
+			loggerFrom(r.Context()).Error("Invalid username or password", "error", "invalid username or password")
+			return
+		}
+
+		user, err := getUser(r.Context(), conn, body.Username)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Unable to convert task ID to int", "error", err.Error())
+			writeStoreError(w, r, err, "Unable to get user")
 			return
 		}
+		if refuseDisabled(w, r, user) {
+			return
+		}
+
+		token := newToken()
 
-		if err := completeTask(r.Context(), conn, taskID); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to complete task", "error", err.Error())
+		if err := insertSession(r.Context(), conn, user.ID, token); err != nil {
+			writeStoreError(w, r, err, "Unable to insert session")
 			return
 		}
+
+		metrics.logins.Inc("token", "success")
+		writeJSON(w, http.StatusCreated, TokenResponse{
+			Token:     token,
+			TokenType: "bearer",
+		})
 	}
 }
 
-func handleGetTasks(conn *pgxpool.Pool, limit int) http.HandlerFunc {
+// handleRevokeToken ends the session the request was authenticated with.
+func handleRevokeToken(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, _ := sessionToken(r)
+
+		if err := deleteSession(r.Context(), conn, token); err != nil {
+			writeStoreError(w, r, err, "Unable to delete session")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// taskFromPath loads the task named by the taskId path value, writing an
+// error and reporting false if it does not belong to the user.
+func taskFromPath(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool) (*Task, bool) {
+	user := r.Context().Value(UserKey("user")).(*User)
+
+	taskID, err := strconv.Atoi(r.PathValue("taskId"))
+	if err != nil {
+		writeFieldErrors(w, FieldErrors{"task_id": "task_id must be an integer"})
+		return nil, false
+	}
+
+	task, err := getTask(r.Context(), conn, taskID)
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get task")
+		return nil, false
+	}
+	if task.UserID != user.ID {
+		writeError(w, http.StatusNotFound, CodeNotFound, "resource not found")
+		return nil, false
+	}
+
+	return task, true
+}
+
+func handleCompleteTask(conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		user := r.Context().Value(UserKey("user")).(*User)
-		if user.ID == 0 {
-			http.Error(w, "user not found", http.StatusUnauthorized)
-			logger.Error("User not found", "error", "user not found")
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
 			return
 		}
-		tasks, err := getTasks(r.Context(), conn, user.ID)
+
+		completion, err := completeTask(r.Context(), conn, task, user.location())
 		if err != nil {
-			logger.Error("Unable to get tasks", "error", err.Error())
-			if !errors.Is(err, pgx.ErrNoRows) && err.Error() != "no rows in result set" {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				return
-			}
+			writeStoreError(w, r, err, "Unable to complete task")
+			return
+		}
+		if completion != nil {
+			metrics.completions.Inc(task.Interval.String())
+			emitEvent(r.Context(), conn, task.UserID, EventCompletionCreated, newCompletionEventData(task, completion))
 		}
+	}
+}
+
+func handleGetTasks(conn *pgxpool.Pool, limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
 
-		responses := make([]TaskResponse, len(tasks))
-		for i := range tasks {
-			layout := Layout
-			if tasks[i].Interval == Hourly {
-				layout = LayoutHourly
+		query := r.URL.Query()
+		fe := FieldErrors{}
+		var filter TaskFilter
+
+		switch query.Get("include") {
+		case "":
+		case "archived":
+			filter.Archived = true
+		default:
+			fe.add("include", "include must be archived")
+		}
+
+		switch group := query.Get("group"); group {
+		case "":
+		case "none":
+			filter.Ungrouped = true
+		default:
+			id, err := strconv.Atoi(group)
+			if err != nil || id <= 0 {
+				fe.add("group", "group must be a group ID or none")
 			}
-			unit := tasks[i].Interval.toTime()
+			filter.GroupID = id
+		}
 
-			date := time.Now().Add(-unit * time.Duration(limit-1))
+		sort := query.Get("sort")
+		if sort == "" {
+			sort = "position"
+		}
+		if name := strings.TrimPrefix(sort, "-"); taskOrders[name] != "" {
+			filter.Sort = sort
+		} else if _, ok := taskSorts[name]; !ok {
+			fe.add("sort", "sort must be one of position, name, created_at, interval, next_due or streak, with a leading - to reverse it")
+		}
 
-			completions, err := getCompletions(r.Context(), conn, tasks[i].ID, date)
-			if err != nil {
-				http.Error(w, err.Error(), http.StatusInternalServerError)
-				if !errors.Is(err, pgx.ErrNoRows) && err.Error() != "no rows in result set" {
-					logger.Error("Unable to get completions", "error", err.Error())
+		if len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+		if filter.GroupID != 0 && !checkGroup(w, r, conn, "group", filter.GroupID) {
+			return
+		}
+
+		tasks, err := getTasks(r.Context(), conn, user.ID, filter)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get tasks")
+			return
+		}
+
+		responses, err := newTaskResponses(r.Context(), conn, tasks, limit, user.location())
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get completions")
+			return
+		}
+		sortTasks(responses, sort)
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+func handleGetTask(conn *pgxpool.Pool, limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		resp, err := newTaskResponse(r.Context(), conn, task, limit, user.location())
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get completions")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, resp)
+	}
+}
+
+func handleCreateTask(conn *pgxpool.Pool, limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body struct {
+			Name        string `json:"name"`
+			Description string `json:"description"`
+			Interval    string `json:"interval"`
+			GroupID     *int   `json:"group_id"`
+		}
+
+		mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+		switch mediaType {
+		case "application/json":
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+				loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+				return
+			}
+		case "application/x-www-form-urlencoded", "multipart/form-data", "":
+			// Older clients send the task as query parameters without a
+			// Content-Type, so r.Form is used rather than r.PostForm.
+			if err := r.ParseMultipartForm(32 << 10); err != nil && !errors.Is(err, http.ErrNotMultipart) {
+				writeError(w, http.StatusBadRequest, CodeBadRequest, "unable to parse form")
+				loggerFrom(r.Context()).Error("Unable to parse form", "error", err.Error())
+				return
+			}
+			body.Name = r.Form.Get("name")
+			body.Description = r.Form.Get("description")
+			body.Interval = r.Form.Get("interval")
+			if groupID := r.Form.Get("group_id"); groupID != "" {
+				id, err := strconv.Atoi(groupID)
+				if err != nil {
+					writeFieldErrors(w, FieldErrors{"group_id": "group_id must be an integer"})
 					return
 				}
+				body.GroupID = &id
 			}
-			if completions == nil {
-				completions = make([]*Completion, 0)
-			}
+		default:
+			writeError(w, http.StatusUnsupportedMediaType, CodeUnsupportedMedia, "content type must be application/json or form encoded")
+			return
+		}
 
-			intervalsMap := make(map[string]bool)
-			for j := 0; j < limit; j++ {
-				timestamp := date.Add(time.Duration(j) * unit).Format(layout)
-				intervalsMap[timestamp] = false
-			}
+		t := Task{
+			Name:        body.Name,
+			Description: body.Description,
+			Interval:    fromString(body.Interval),
+			UserID:      user.ID,
+			GroupID:     body.GroupID,
+		}
+
+		if fe := validateTask(t); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+		if t.GroupID != nil && !checkGroup(w, r, conn, "group_id", *t.GroupID) {
+			return
+		}
 
-			for _, c := range completions {
-				timestamp := c.CompletedAt.Format(layout)
-				intervalsMap[timestamp] = true
+		task, err := insertTask(r.Context(), conn, t)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to insert task")
+			return
+		}
+
+		resp, err := newTaskResponse(r.Context(), conn, task, limit, user.location())
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get completions")
+			return
+		}
+
+		emitEvent(r.Context(), conn, user.ID, EventTaskCreated, newTaskEventData(task))
+
+		w.Header().Set("Location", fmt.Sprintf("/api/tasks/%d", task.ID))
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+// handleUpdateTask changes the fields present in the JSON body and leaves the
+// rest of the task as it was. Pausing starts an open ended pause today and
+// resuming ends the pause covering today. A null group_id takes the task out
+// of its group.
+func handleUpdateTask(conn *pgxpool.Pool, limit int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		var body struct {
+			Name        *string         `json:"name"`
+			Description *string         `json:"description"`
+			Interval    *string         `json:"interval"`
+			Archived    *bool           `json:"archived"`
+			Paused      *bool           `json:"paused"`
+			GroupID     json.RawMessage `json:"group_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if body.Name != nil {
+			task.Name = *body.Name
+		}
+		if body.Description != nil {
+			task.Description = *body.Description
+		}
+		if body.Interval != nil {
+			task.Interval = fromString(*body.Interval)
+		}
+		if body.Archived != nil {
+			switch {
+			case *body.Archived && task.ArchivedAt == nil:
+				now := time.Now()
+				task.ArchivedAt = &now
+			case !*body.Archived:
+				task.ArchivedAt = nil
 			}
+		}
 
-			resp := TaskResponse{
-				ID:           tasks[i].ID,
-				Name:         tasks[i].Name,
-				Description:  tasks[i].Description,
-				CreatedAt:    tasks[i].CreatedAt,
-				Interval:     tasks[i].Interval.String(),
-				IntervalsMap: intervalsMap,
+		if body.GroupID != nil {
+			task.GroupID = nil
+			if string(body.GroupID) != "null" {
+				var id int
+				if err := json.Unmarshal(body.GroupID, &id); err != nil {
+					writeFieldErrors(w, FieldErrors{"group_id": "group_id must be an integer or null"})
+					return
+				}
+				task.GroupID = &id
 			}
+		}
 
-			responses[i] = resp
+		if fe := validateTask(*task); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+		if body.GroupID != nil && task.GroupID != nil && !checkGroup(w, r, conn, "group_id", *task.GroupID) {
+			return
 		}
 
-		if err := json.NewEncoder(w).Encode(responses); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
+		if err := updateTask(r.Context(), conn, task, body.Paused, today(time.Now(), user.location())); err != nil {
+			writeStoreError(w, r, err, "Unable to update task")
+			return
 		}
+
+		resp, err := newTaskResponse(r.Context(), conn, task, limit, user.location())
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get completions")
+			return
+		}
+
+		emitEvent(r.Context(), conn, task.UserID, EventTaskUpdated, newTaskEventData(task))
+
+		writeJSON(w, http.StatusOK, resp)
 	}
 }
 
-func handleCreateTask(conn *pgxpool.Pool) http.HandlerFunc {
+func handleDeleteTask(conn *pgxpool.Pool) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user := r.Context().Value(UserKey("user")).(*User)
-		if user.ID == 0 {
-			http.Error(w, "user not found", http.StatusUnauthorized)
-			logger.Error("User not found", "error", "user not found")
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
 			return
 		}
 
-		if err := r.ParseForm(); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			logger.Error("Unable to parse form", "error", err.Error())
+		if err := deleteTask(r.Context(), conn, task.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete task")
 			return
 		}
 
-		name := r.Form.Get("name")
-		description := r.Form.Get("description")
-		interval := fromString(r.Form.Get("interval"))
+		emitEvent(r.Context(), conn, task.UserID, EventTaskDeleted, newTaskEventData(task))
 
-		t := Task{
-			Name:        name,
-			Description: description,
-			Interval:    interval,
-			UserID:      user.ID,
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleReorderTasks moves the listed tasks to the top of the user's list in
+// the order given, such as after a task is dragged to a new place.
+func handleReorderTasks(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body struct {
+			TaskIDs []int `json:"task_ids"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if fe := validateTaskOrder(body.TaskIDs); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
 		}
 
-		if err := insertTask(r.Context(), conn, t); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			logger.Error("Unable to insert task", "error", err.Error())
+		err := reorderTasks(r.Context(), conn, user.ID, body.TaskIDs)
+		if errors.Is(err, errUnknownTasks) {
+			writeFieldErrors(w, FieldErrors{"task_ids": "task_ids must all be your tasks"})
 			return
 		}
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to reorder tasks")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
 	}
 }
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	checkOK   = "ok"
+	checkFail = "fail"
+)
+
+type CheckResult struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type HealthResponse struct {
+	Status string                 `json:"status"`
+	Checks map[string]CheckResult `json:"checks,omitempty"`
+}
+
+func handleHealth(conn *pgxpool.Pool, ready *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !ready.Load() {
+			writeError(w, http.StatusServiceUnavailable, CodeUnavailable, "server is shutting down")
+			return
+		}
+
+		if err := conn.Ping(r.Context()); err != nil {
+			writeError(w, http.StatusServiceUnavailable, CodeUnavailable, "database unavailable")
+			loggerFrom(r.Context()).Error("Unable to ping database", "error", err.Error())
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}
+}
+
+// handleLive reports whether the process is able to serve requests at all.
+// It deliberately does not depend on the database.
+func handleLive() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		writeJSON(w, http.StatusOK, HealthResponse{Status: checkOK})
+	}
+}
+
+// handleReady reports whether the server should be sent traffic, with the
+// result of each check.
+func handleReady(cfg *Config, conn *pgxpool.Pool, ready *atomic.Bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		checks := map[string]func(context.Context) error{
+			"draining": func(context.Context) error {
+				if !ready.Load() {
+					return fmt.Errorf("server is shutting down")
+				}
+				return nil
+			},
+			"database": func(ctx context.Context) error {
+				return conn.Ping(ctx)
+			},
+			"migrations": func(ctx context.Context) error {
+				return checkSchemaVersion(ctx, conn)
+			},
+			"static": func(context.Context) error {
+				_, err := fs.Stat(staticFS(cfg), "index.html")
+				return err
+			},
+			"pool_acquire": func(ctx context.Context) error {
+				start := time.Now()
+				c, err := conn.Acquire(ctx)
+				if err != nil {
+					return err
+				}
+				c.Release()
+
+				if elapsed := time.Since(start); elapsed > cfg.ReadyAcquireThreshold {
+					return fmt.Errorf("acquiring a connection took %s, over the %s threshold", elapsed, cfg.ReadyAcquireThreshold)
+				}
+				return nil
+			},
+		}
+
+		resp := HealthResponse{
+			Status: checkOK,
+			Checks: make(map[string]CheckResult, len(checks)),
+		}
+		for name, check := range checks {
+			start := time.Now()
+			err := check(r.Context())
+
+			result := CheckResult{
+				Status:    checkOK,
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = checkFail
+				result.Error = err.Error()
+				resp.Status = checkFail
+			}
+			resp.Checks[name] = result
+		}
+
+		status := http.StatusOK
+		if resp.Status != checkOK {
+			status = http.StatusServiceUnavailable
+			loggerFrom(r.Context()).Warn("Server is not ready", "checks", resp.Checks)
+		}
+
+		writeJSON(w, status, resp)
+	}
+}
+
+// runHealthcheck asks the server on cfg.Port whether it is ready, for use as
+// a container healthcheck where no HTTP client is available.
+func runHealthcheck(cfg *Config) error {
+	client := &http.Client{Timeout: 5 * time.Second}
+
+	res, err := client.Get(fmt.Sprintf("http://localhost:%d/api/health/ready", cfg.Port))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	var health HealthResponse
+	if err := json.NewDecoder(res.Body).Decode(&health); err != nil {
+		return fmt.Errorf("unable to decode readiness response: %w", err)
+	}
+
+	if err := json.NewEncoder(os.Stdout).Encode(health); err != nil {
+		return err
+	}
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("readiness check returned %d", res.StatusCode)
+	}
+
+	return nil
+}
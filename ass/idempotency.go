@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	idempotencyHeader = "Idempotency-Key"
+	// maxIdempotentBody bounds the request bodies buffered to fingerprint
+	// them, which is the largest body any route accepts: an import.
+	maxIdempotentBody = maxImportSize + (1 << 20)
+)
+
+// replayedHeaders are the response headers stored alongside an idempotent
+// response and sent again when it is replayed.
+var replayedHeaders = []string{"Content-Type", "Location"}
+
+type IdempotencyKey struct {
+	UserID int
+	Key    string
+	Method string
+	Path   string
+	// RequestHash fingerprints the query and body of the request, so that
+	// a key reused for a different request is refused rather than replayed.
+	RequestHash string
+	Status      int
+	Headers     map[string]string
+	Body        []byte
+	CreatedAt   time.Time
+}
+
+// idempotencyStore keeps the keys of idempotent requests and their
+// responses. The database is the only implementation outside tests.
+type idempotencyStore interface {
+	// claim records ik as in progress, returning false if the user already
+	// has the key. Keys older than ttl are forgotten first.
+	claim(ctx context.Context, ik *IdempotencyKey, ttl time.Duration) (bool, error)
+	// get returns the key, or nil if the user does not have it.
+	get(ctx context.Context, userID int, key string) (*IdempotencyKey, error)
+	// complete stores the response of the request that claimed the key.
+	complete(ctx context.Context, ik *IdempotencyKey) error
+	// release forgets the key so that the request can be retried.
+	release(ctx context.Context, userID int, key string) error
+}
+
+type dbIdempotencyStore struct {
+	conn *pgxpool.Pool
+}
+
+func (s dbIdempotencyStore) claim(ctx context.Context, ik *IdempotencyKey, ttl time.Duration) (bool, error) {
+	return claimIdempotencyKey(ctx, s.conn, ik, ttl)
+}
+
+func (s dbIdempotencyStore) get(ctx context.Context, userID int, key string) (*IdempotencyKey, error) {
+	return getIdempotencyKey(ctx, s.conn, userID, key)
+}
+
+func (s dbIdempotencyStore) complete(ctx context.Context, ik *IdempotencyKey) error {
+	return completeIdempotencyKey(ctx, s.conn, ik)
+}
+
+func (s dbIdempotencyStore) release(ctx context.Context, userID int, key string) error {
+	return releaseIdempotencyKey(ctx, s.conn, userID, key)
+}
+
+type responseRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rr *responseRecorder) WriteHeader(status int) {
+	if rr.status == 0 {
+		rr.status = status
+	}
+	rr.ResponseWriter.WriteHeader(status)
+}
+
+func (rr *responseRecorder) Write(b []byte) (int, error) {
+	if rr.status == 0 {
+		rr.status = http.StatusOK
+	}
+	rr.body.Write(b)
+	return rr.ResponseWriter.Write(b)
+}
+
+// withIdempotency replays the stored response when a request is retried with
+// the same Idempotency-Key header. It must be wrapped by withUser, since keys
+// are scoped per user.
+func withIdempotency(conn *pgxpool.Pool, ttl time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return idempotent(dbIdempotencyStore{conn: conn}, ttl, h)
+}
+
+// idempotent is withIdempotency with keys kept in store.
+func idempotent(store idempotencyStore, ttl time.Duration, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := r.Header.Get(idempotencyHeader)
+		if key == "" {
+			h(w, r)
+			return
+		}
+		if len(key) > 255 {
+			writeFieldErrors(w, FieldErrors{"idempotency_key": "idempotency key must be at most 255 characters"})
+			return
+		}
+
+		hash, ok := hashIdempotentRequest(w, r)
+		if !ok {
+			return
+		}
+
+		user := r.Context().Value(UserKey("user")).(*User)
+		ik := &IdempotencyKey{
+			UserID:      user.ID,
+			Key:         key,
+			Method:      r.Method,
+			Path:        r.URL.Path,
+			RequestHash: hash,
+			Headers:     make(map[string]string),
+		}
+
+		claimed, err := store.claim(r.Context(), ik, ttl)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to claim idempotency key")
+			return
+		}
+
+		if !claimed {
+			replayIdempotentResponse(w, r, store, ik)
+			return
+		}
+
+		// The request did not finish successfully so let the client retry
+		// it with the same key instead of replaying the failure.
+		release := func() {
+			if err := store.release(context.WithoutCancel(r.Context()), user.ID, key); err != nil {
+				loggerFrom(r.Context()).Error("Unable to release idempotency key", "error", err.Error())
+			}
+		}
+
+		rec := &responseRecorder{ResponseWriter: w}
+		func() {
+			defer func() {
+				if v := recover(); v != nil {
+					release()
+					panic(v)
+				}
+			}()
+			h(rec, r)
+		}()
+
+		// A handler that writes nothing responds 200 without a body.
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if rec.status >= http.StatusInternalServerError {
+			release()
+			return
+		}
+
+		ik.Status = rec.status
+		ik.Body = rec.body.Bytes()
+		for _, name := range replayedHeaders {
+			if v := w.Header().Get(name); v != "" {
+				ik.Headers[name] = v
+			}
+		}
+
+		if err := store.complete(context.WithoutCancel(r.Context()), ik); err != nil {
+			loggerFrom(r.Context()).Error("Unable to store idempotent response", "error", err.Error())
+		}
+	}
+}
+
+// hashIdempotentRequest returns the fingerprint of the query and body of r,
+// buffering the body so that the handler can still read it. It writes an
+// error response and returns false if the body cannot be read.
+func hashIdempotentRequest(w http.ResponseWriter, r *http.Request) (string, bool) {
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxIdempotentBody))
+	var maxBytesErr *http.MaxBytesError
+	if errors.As(err, &maxBytesErr) {
+		writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("request body must be at most %d MiB", maxIdempotentBody>>20))
+		return "", false
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, CodeBadRequest, "unable to read the request body")
+		loggerFrom(r.Context()).Error("Unable to read request body", "error", err.Error())
+		return "", false
+	}
+	r.Body = io.NopCloser(bytes.NewReader(body))
+
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n", r.URL.RawQuery)
+	h.Write(body)
+	return hex.EncodeToString(h.Sum(nil)), true
+}
+
+// replayIdempotentResponse answers a request whose key was already claimed,
+// described by ik, with the stored response.
+func replayIdempotentResponse(w http.ResponseWriter, r *http.Request, store idempotencyStore, ik *IdempotencyKey) {
+	stored, err := store.get(r.Context(), ik.UserID, ik.Key)
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get idempotency key")
+		return
+	}
+	if stored == nil {
+		// The original request failed and released the key between our
+		// claim and this lookup; it is safe for the client to retry.
+		writeError(w, http.StatusConflict, CodeConflict, "request with this idempotency key is in progress")
+		return
+	}
+
+	if stored.Method != ik.Method || stored.Path != ik.Path || stored.RequestHash != ik.RequestHash {
+		writeError(w, http.StatusUnprocessableEntity, CodeConflict, "idempotency key was used for a different request")
+		loggerFrom(r.Context()).Error("Idempotency key reused", "error", "idempotency key was used for a different request")
+		return
+	}
+
+	if stored.Status == 0 {
+		writeError(w, http.StatusConflict, CodeConflict, "request with this idempotency key is in progress")
+		return
+	}
+
+	for name, v := range stored.Headers {
+		w.Header().Set(name, v)
+	}
+	w.Header().Set("Idempotent-Replayed", "true")
+	w.WriteHeader(stored.Status)
+	if _, err := w.Write(stored.Body); err != nil {
+		loggerFrom(r.Context()).Error("Unable to write idempotent response", "error", err.Error())
+	}
+}
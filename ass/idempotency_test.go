@@ -0,0 +1,207 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memoryIdempotencyStore is an idempotencyStore kept in a map.
+type memoryIdempotencyStore struct {
+	mu   sync.Mutex
+	keys map[string]IdempotencyKey
+}
+
+func newMemoryIdempotencyStore() *memoryIdempotencyStore {
+	return &memoryIdempotencyStore{keys: make(map[string]IdempotencyKey)}
+}
+
+func memoryKey(userID int, key string) string {
+	return fmt.Sprintf("%d:%s", userID, key)
+}
+
+func (s *memoryIdempotencyStore) claim(_ context.Context, ik *IdempotencyKey, _ time.Duration) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.keys[memoryKey(ik.UserID, ik.Key)]; ok {
+		return false, nil
+	}
+	s.keys[memoryKey(ik.UserID, ik.Key)] = *ik
+	return true, nil
+}
+
+func (s *memoryIdempotencyStore) get(_ context.Context, userID int, key string) (*IdempotencyKey, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ik, ok := s.keys[memoryKey(userID, key)]
+	if !ok {
+		return nil, nil
+	}
+	return &ik, nil
+}
+
+func (s *memoryIdempotencyStore) complete(_ context.Context, ik *IdempotencyKey) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys[memoryKey(ik.UserID, ik.Key)] = *ik
+	return nil
+}
+
+func (s *memoryIdempotencyStore) release(_ context.Context, userID int, key string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.keys, memoryKey(userID, key))
+	return nil
+}
+
+// idempotentRequest serves a request for user 1 with the given key and body
+// through h.
+func idempotentRequest(h http.HandlerFunc, target, key, body string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+	r.Header.Set(idempotencyHeader, key)
+	r = r.WithContext(context.WithValue(r.Context(), UserKey("user"), &User{ID: 1}))
+
+	w := httptest.NewRecorder()
+	h(w, r)
+	return w
+}
+
+func TestIdempotentReplaysResponse(t *testing.T) {
+	calls := 0
+	h := idempotent(newMemoryIdempotencyStore(), time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Location", "/api/tasks/1")
+		writeJSON(w, http.StatusCreated, map[string]any{"call": calls, "body": string(body)})
+	})
+
+	first := idempotentRequest(h, "/api/tasks", "k1", `{"name":"Stretch"}`)
+	if first.Code != http.StatusCreated || calls != 1 {
+		t.Fatalf("got %d after %d calls", first.Code, calls)
+	}
+
+	retry := idempotentRequest(h, "/api/tasks", "k1", `{"name":"Stretch"}`)
+	if calls != 1 {
+		t.Fatalf("handler ran %d times", calls)
+	}
+	if retry.Code != first.Code || retry.Body.String() != first.Body.String() {
+		t.Fatalf("replayed %d %q, want %d %q", retry.Code, retry.Body, first.Code, first.Body)
+	}
+	if retry.Header().Get("Location") != "/api/tasks/1" || retry.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("replayed headers %v", retry.Header())
+	}
+
+	if other := idempotentRequest(h, "/api/tasks", "k2", `{"name":"Stretch"}`); other.Code != http.StatusCreated || calls != 2 {
+		t.Fatalf("a new key got %d after %d calls", other.Code, calls)
+	}
+}
+
+func TestIdempotentImplicitOK(t *testing.T) {
+	calls := 0
+	h := idempotent(newMemoryIdempotencyStore(), time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+	})
+
+	for i := 0; i < 2; i++ {
+		if w := idempotentRequest(h, "/api/tasks/1/complete", "k", ""); w.Code != http.StatusOK {
+			t.Fatalf("got %d", w.Code)
+		}
+	}
+	if calls != 1 {
+		t.Fatalf("handler without a response ran %d times", calls)
+	}
+}
+
+func TestIdempotentDifferentRequest(t *testing.T) {
+	h := idempotent(newMemoryIdempotencyStore(), time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	idempotentRequest(h, "/api/import", "k", `{"a":1}`)
+
+	for name, target := range map[string]string{
+		"body":  "/api/import",
+		"query": "/api/import?dry_run=true",
+		"path":  "/api/groups",
+	} {
+		body := `{"a":1}`
+		if name == "body" {
+			body = `{"a":2}`
+		}
+		if w := idempotentRequest(h, target, "k", body); w.Code != http.StatusUnprocessableEntity {
+			t.Errorf("different %s got %d, want 422", name, w.Code)
+		}
+	}
+}
+
+func TestIdempotentInProgress(t *testing.T) {
+	started, finish := make(chan struct{}), make(chan struct{})
+	h := idempotent(newMemoryIdempotencyStore(), time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-finish
+		w.WriteHeader(http.StatusCreated)
+	})
+
+	done := make(chan *httptest.ResponseRecorder)
+	go func() { done <- idempotentRequest(h, "/api/tasks", "k", "{}") }()
+	<-started
+
+	if w := idempotentRequest(h, "/api/tasks", "k", "{}"); w.Code != http.StatusConflict {
+		t.Fatalf("concurrent duplicate got %d, want 409", w.Code)
+	}
+
+	close(finish)
+	if w := <-done; w.Code != http.StatusCreated {
+		t.Fatalf("original request got %d", w.Code)
+	}
+}
+
+func TestIdempotentReleasesFailures(t *testing.T) {
+	store := newMemoryIdempotencyStore()
+	status := http.StatusInternalServerError
+	calls := 0
+	h := idempotent(store, time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if status == 0 {
+			panic("handler failed")
+		}
+		w.WriteHeader(status)
+	})
+
+	if w := idempotentRequest(h, "/api/tasks", "k", "{}"); w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d", w.Code)
+	}
+	if len(store.keys) != 0 {
+		t.Fatal("a 5xx response was stored")
+	}
+
+	status = 0
+	func() {
+		defer func() { _ = recover() }()
+		idempotentRequest(h, "/api/tasks", "k", "{}")
+	}()
+	if len(store.keys) != 0 {
+		t.Fatal("the key of a panicking handler was kept")
+	}
+
+	status = http.StatusCreated
+	if w := idempotentRequest(h, "/api/tasks", "k", "{}"); w.Code != http.StatusCreated || calls != 3 {
+		t.Fatalf("retry got %d after %d calls", w.Code, calls)
+	}
+}
+
+func TestIdempotentRejectsLongKeys(t *testing.T) {
+	h := idempotent(newMemoryIdempotencyStore(), time.Hour, func(w http.ResponseWriter, r *http.Request) {
+		t.Fatal("handler ran")
+	})
+
+	if w := idempotentRequest(h, "/api/tasks", strings.Repeat("k", 256), "{}"); w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d", w.Code)
+	}
+}
@@ -0,0 +1,1000 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"path"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	// maxImportSize bounds the uploaded file, which is held in memory while
+	// it is parsed.
+	maxImportSize = 32 << 20
+	// maxImportWarnings bounds how many warnings are returned; the rest are
+	// only counted.
+	maxImportWarnings = 100
+)
+
+const (
+	ImportOnConflictSkip  = "skip"
+	ImportOnConflictMerge = "merge"
+)
+
+// Actions taken for each imported task.
+const (
+	ImportCreated = "created"
+	ImportMerged  = "merged"
+	ImportSkipped = "skipped"
+)
+
+// importParsers reads each supported format into an importSource.
+var importParsers = map[string]func(*importSource, []byte) error{
+	"didt":        parseDIDTImport,
+	"csv":         parseCSVImport,
+	"loop":        parseLoopImport,
+	"loop-sqlite": parseLoopSQLiteImport,
+	"habitica":    parseHabiticaImport,
+}
+
+// ImportResult reports what an import created, or would create on a dry
+// run, and anything that could not be carried over exactly.
+type ImportResult struct {
+	DryRun             bool               `json:"dry_run"`
+	Format             string             `json:"format"`
+	TasksCreated       int                `json:"tasks_created"`
+	TasksMerged        int                `json:"tasks_merged"`
+	TasksSkipped       int                `json:"tasks_skipped"`
+	CompletionsCreated int                `json:"completions_created"`
+	CompletionsSkipped int                `json:"completions_skipped"`
+	Tasks              []ImportTaskResult `json:"tasks"`
+	Conflicts          []ImportConflict   `json:"conflicts"`
+	Warnings           []string           `json:"warnings"`
+}
+
+type ImportTaskResult struct {
+	// ID is the task that was created or merged into. It is nil for tasks
+	// that were skipped, or would be created on a dry run.
+	ID       *int   `json:"id"`
+	Name     string `json:"name"`
+	Interval string `json:"interval"`
+	Action   string `json:"action"`
+	// Completions is how many completions were added and
+	// DuplicateCompletions how many were left out because their interval
+	// already had one.
+	Completions          int `json:"completions"`
+	DuplicateCompletions int `json:"duplicate_completions"`
+}
+
+// ImportConflict is an imported task with the same name as an existing
+// task.
+type ImportConflict struct {
+	Name             string `json:"name"`
+	TaskID           int    `json:"task_id"`
+	Interval         string `json:"interval"`
+	ImportedInterval string `json:"imported_interval"`
+	Resolution       string `json:"resolution"`
+}
+
+// importTask is a task read from an import before it is checked against the
+// user's existing tasks.
+type importTask struct {
+	Name        string
+	Description string
+	Interval    Interval
+	CreatedAt   time.Time
+	ArchivedAt  *time.Time
+	// Group names the group the task is filed under, which is created if
+	// the user does not have one by that name.
+	Group       string
+	Completions []time.Time
+}
+
+// importSource collects the tasks and warnings read from an uploaded file.
+// Dates without a time are placed at noon in loc, the user's time zone, so
+// that they land on the same day whatever the offset.
+type importSource struct {
+	loc      *time.Location
+	tasks    []*importTask
+	byName   map[string]*importTask
+	warnings []string
+	dropped  int
+}
+
+func newImportSource(loc *time.Location) *importSource {
+	return &importSource{loc: loc, byName: map[string]*importTask{}}
+}
+
+func (s *importSource) warn(format string, args ...any) {
+	if len(s.warnings) >= maxImportWarnings {
+		s.dropped++
+		return
+	}
+	s.warnings = append(s.warnings, fmt.Sprintf(format, args...))
+}
+
+// task returns the imported task called name, adding it if it has not been
+// seen. Tasks sharing a name are merged since they would otherwise conflict
+// with each other.
+func (s *importSource) task(name, description string, interval Interval) *importTask {
+	name = strings.TrimSpace(name)
+	key := strings.ToLower(name)
+	if t, ok := s.byName[key]; ok {
+		if t.Interval != interval {
+			s.warn("%q appears more than once; its completions were merged into one %s task", name, t.Interval)
+		}
+		return t
+	}
+
+	t := &importTask{Name: name, Description: description, Interval: interval}
+	s.tasks = append(s.tasks, t)
+	s.byName[key] = t
+	return t
+}
+
+// day returns noon on the given date in the user's time zone.
+func (s *importSource) day(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 12, 0, 0, 0, s.loc)
+}
+
+// intervalFromFrequency maps a frequency of times every days onto the
+// closest Interval, reporting whether the mapping is exact. A habit done
+// several times a period becomes one completion per period.
+func intervalFromFrequency(times, days int) (Interval, bool) {
+	if times < 1 {
+		times = 1
+	}
+	switch {
+	case days <= 1 || days <= times:
+		return Daily, days <= 1 && times == 1
+	case days <= 7:
+		return Weekly, days == 7 && times == 1
+	default:
+		return Monthly, days >= 28 && days <= 31 && times == 1
+	}
+}
+
+// detectImportFormat guesses the format of an upload sent without one.
+func detectImportFormat(data []byte) string {
+	switch {
+	case bytes.HasPrefix(data, []byte(sqliteMagic)):
+		return "loop-sqlite"
+	case bytes.HasPrefix(data, []byte("PK\x03\x04")):
+		return "loop"
+	case bytes.HasPrefix(bytes.TrimSpace(data), []byte("{")):
+		var probe struct {
+			Format string `json:"format"`
+		}
+		if json.Unmarshal(data, &probe) == nil && probe.Format == exportFormat {
+			return "didt"
+		}
+		return "habitica"
+	default:
+		return "csv"
+	}
+}
+
+// parseDIDTImport reads our own JSON export.
+func parseDIDTImport(s *importSource, data []byte) error {
+	var export Export
+	if err := json.Unmarshal(data, &export); err != nil {
+		return fmt.Errorf("file is not valid JSON: %w", err)
+	}
+	if export.Format != exportFormat {
+		return errors.New("file is not a DidIDoThat export")
+	}
+	if export.Version < 1 || export.Version > exportVersion {
+		return fmt.Errorf("export version %d is not supported", export.Version)
+	}
+
+	for _, et := range export.Tasks {
+		interval := fromString(et.Interval)
+		if interval == 0 {
+			s.warn("%q has unknown interval %q and was imported as Daily", et.Name, et.Interval)
+			interval = Daily
+		}
+
+		t := s.task(et.Name, et.Description, interval)
+		t.CreatedAt = et.CreatedAt
+		t.ArchivedAt = et.ArchivedAt
+		if group := strings.TrimSpace(et.Group); len(validateTaskGroup(group)) == 0 {
+			t.Group = group
+		} else if group != "" {
+			s.warn("%q has a group name that is too long and was imported without a group", et.Name)
+		}
+		t.Completions = append(t.Completions, et.Completions...)
+	}
+
+	return nil
+}
+
+// csvColumns lists the accepted names of each column of a plain CSV import,
+// in order of preference. The first name of each is the one in our own CSV
+// export.
+var csvColumns = map[string][]string{
+	"name":         {"task_name", "name", "task", "habit"},
+	"description":  {"task_description", "description"},
+	"interval":     {"interval", "frequency"},
+	"created_at":   {"task_created_at", "created_at"},
+	"completed_at": {"completed_at", "date"},
+}
+
+// csvTimeLayouts are tried in order when reading a time from a CSV import.
+// Dates without a time are read as noon in the user's time zone.
+var csvTimeLayouts = []string{time.RFC3339Nano, "2006-01-02T15:04:05", time.DateTime, "2006-01-02 15:04", time.DateOnly}
+
+func (s *importSource) parseTime(value string) (time.Time, error) {
+	for _, layout := range csvTimeLayouts {
+		t, err := time.ParseInLocation(layout, value, s.loc)
+		if err != nil {
+			continue
+		}
+		if layout == time.DateOnly {
+			t = s.day(t)
+		}
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%q is not a date or time", value)
+}
+
+// readCSVHeader reads the header of r, returning the index of each column by
+// its lower case name.
+func readCSVHeader(r *csv.Reader) (map[string]int, error) {
+	header, err := r.Read()
+	if err != nil {
+		return nil, fmt.Errorf("file is not valid CSV: %w", err)
+	}
+
+	columns := make(map[string]int, len(header))
+	for i, name := range header {
+		name = strings.ToLower(strings.TrimSpace(strings.TrimPrefix(name, "\ufeff")))
+		columns[name] = i
+	}
+	return columns, nil
+}
+
+// parseCSVImport reads a CSV file with one row per completion. Only a name
+// column is required; rows with an empty completed_at add the task alone.
+func parseCSVImport(s *importSource, data []byte) error {
+	r := csv.NewReader(bytes.NewReader(data))
+	r.FieldsPerRecord = -1
+
+	header, err := readCSVHeader(r)
+	if err != nil {
+		return err
+	}
+	columns := map[string]int{}
+	for column, names := range csvColumns {
+		for _, name := range names {
+			if i, ok := header[name]; ok {
+				columns[column] = i
+				break
+			}
+		}
+	}
+	if _, ok := columns["name"]; !ok {
+		return errors.New("CSV file must have a task_name column")
+	}
+
+	field := func(record []string, column string) string {
+		i, ok := columns[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	for line := 2; ; line++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("file is not valid CSV: %w", err)
+		}
+
+		name := field(record, "name")
+		if name == "" {
+			s.warn("line %d has no task name and was skipped", line)
+			continue
+		}
+
+		interval := Daily
+		if value := field(record, "interval"); value != "" {
+			if interval = fromString(value); interval == 0 {
+				s.warn("line %d has unknown interval %q; Daily was used", line, value)
+				interval = Daily
+			}
+		}
+
+		t := s.task(name, field(record, "description"), interval)
+		if value := field(record, "created_at"); value != "" && t.CreatedAt.IsZero() {
+			if t.CreatedAt, err = s.parseTime(value); err != nil {
+				s.warn("line %d: task_created_at %v", line, err)
+			}
+		}
+		if value := field(record, "completed_at"); value != "" {
+			completedAt, err := s.parseTime(value)
+			if err != nil {
+				s.warn("line %d was skipped: %v", line, err)
+				continue
+			}
+			t.Completions = append(t.Completions, completedAt)
+		}
+	}
+
+	return nil
+}
+
+// parseLoopImport reads the zip file written by Loop Habit Tracker's "Export
+// as CSV". Habits.csv lists the habits and Checkmarks.csv has a row per day
+// with a column per habit, in the same order.
+func parseLoopImport(s *importSource, data []byte) error {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return errors.New("file is not a zip file")
+	}
+
+	// The summary files are at the top of the archive, above a folder for
+	// each habit that holds files of the same name.
+	open := func(name string) (*csv.Reader, error) {
+		var found *zip.File
+		for _, f := range zr.File {
+			if path.Base(f.Name) != name {
+				continue
+			}
+			if found == nil || strings.Count(f.Name, "/") < strings.Count(found.Name, "/") {
+				found = f
+			}
+		}
+		if found == nil {
+			return nil, fmt.Errorf("zip file has no %s; is it a Loop Habit Tracker export?", name)
+		}
+
+		rc, err := found.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+
+		b, err := io.ReadAll(io.LimitReader(rc, maxImportSize))
+		if err != nil {
+			return nil, err
+		}
+		r := csv.NewReader(bytes.NewReader(b))
+		r.FieldsPerRecord = -1
+		return r, nil
+	}
+
+	r, err := open("Habits.csv")
+	if err != nil {
+		return err
+	}
+	header, err := readCSVHeader(r)
+	if err != nil {
+		return err
+	}
+	field := func(record []string, column string) string {
+		i, ok := header[column]
+		if !ok || i >= len(record) {
+			return ""
+		}
+		return strings.TrimSpace(record[i])
+	}
+
+	var habits []*importTask
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Habits.csv is not valid CSV: %w", err)
+		}
+
+		name := field(record, "name")
+		times, _ := strconv.Atoi(field(record, "numrepetitions"))
+		days, _ := strconv.Atoi(field(record, "interval"))
+		interval, exact := intervalFromFrequency(times, days)
+		if !exact {
+			s.warn("%q is done %d times every %d days and was imported as %s", name, times, days, interval)
+		}
+
+		description := field(record, "description")
+		if description == "" {
+			description = field(record, "question")
+		}
+		habits = append(habits, s.task(name, description, interval))
+	}
+
+	r, err = open("Checkmarks.csv")
+	if err != nil {
+		return err
+	}
+	names, err := r.Read()
+	if err != nil {
+		return fmt.Errorf("Checkmarks.csv is not valid CSV: %w", err)
+	}
+	// Loop ends every line with a comma, leaving an empty last column.
+	for len(names) > 1 && strings.TrimSpace(names[len(names)-1]) == "" {
+		names = names[:len(names)-1]
+	}
+	columns := make([]*importTask, len(names))
+	for i, name := range names[1:] {
+		if len(names)-1 == len(habits) {
+			columns[i+1] = habits[i]
+		} else if t, ok := s.byName[strings.ToLower(strings.TrimSpace(name))]; ok {
+			columns[i+1] = t
+		} else {
+			s.warn("Checkmarks.csv has a column for unknown habit %q", name)
+		}
+	}
+
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("Checkmarks.csv is not valid CSV: %w", err)
+		}
+
+		date, err := time.Parse(time.DateOnly, strings.TrimSpace(record[0]))
+		if err != nil {
+			s.warn("Checkmarks.csv has a row for %q, which is not a date", record[0])
+			continue
+		}
+		for i, value := range record[1:] {
+			if i+1 < len(columns) && columns[i+1] != nil && loopChecked(value) {
+				columns[i+1].Completions = append(columns[i+1].Completions, s.day(date))
+			}
+		}
+	}
+
+	return nil
+}
+
+// loopChecked reports whether a Loop checkmark was ticked by hand. Loop also
+// fills in days implied by a habit's frequency, which are not completions.
+func loopChecked(value string) bool {
+	switch strings.TrimSpace(value) {
+	case "2", "YES_MANUAL":
+		return true
+	default:
+		return false
+	}
+}
+
+// parseLoopSQLiteImport reads the database file written by Loop Habit
+// Tracker's "Full backup".
+func parseLoopSQLiteImport(s *importSource, data []byte) error {
+	db, err := openSQLite(data)
+	if err != nil {
+		return err
+	}
+
+	habits, err := db.table("Habits")
+	if err != nil {
+		return err
+	}
+	repetitions, err := db.table("Repetitions")
+	if err != nil {
+		return err
+	}
+
+	integer := func(row sqliteRow, column string) int64 {
+		switch v := row[column].(type) {
+		case int64:
+			return v
+		case float64:
+			return int64(v)
+		default:
+			return 0
+		}
+	}
+	text := func(row sqliteRow, column string) string {
+		v, _ := row[column].(string)
+		return strings.TrimSpace(v)
+	}
+
+	type habit struct {
+		task      *importTask
+		numerical bool
+	}
+	byID := map[int64]habit{}
+	for _, row := range habits {
+		name := text(row, "name")
+		times, days := integer(row, "freq_num"), integer(row, "freq_den")
+		interval, exact := intervalFromFrequency(int(times), int(days))
+		if !exact {
+			s.warn("%q is done %d times every %d days and was imported as %s", name, times, days, interval)
+		}
+
+		description := text(row, "description")
+		if description == "" {
+			description = text(row, "question")
+		}
+		byID[integer(row, "id")] = habit{
+			task:      s.task(name, description, interval),
+			numerical: integer(row, "type") == 1,
+		}
+	}
+
+	for _, row := range repetitions {
+		h, ok := byID[integer(row, "habit")]
+		if !ok {
+			continue
+		}
+
+		// Older backups have no value column and only store ticked days.
+		// Otherwise a yes/no habit is done when ticked by hand and a
+		// numerical habit when any amount was recorded.
+		if value, ok := row["value"].(int64); ok {
+			if h.numerical && value <= 0 || !h.numerical && value != 2 {
+				continue
+			}
+		}
+
+		// Loop stores each day as midnight UTC.
+		date := time.UnixMilli(integer(row, "timestamp")).UTC()
+		h.task.Completions = append(h.task.Completions, s.day(date))
+	}
+
+	return nil
+}
+
+// habiticaTime reads a Habitica timestamp, which is either milliseconds since
+// the epoch or an ISO 8601 string depending on the age of the account.
+type habiticaTime struct{ time.Time }
+
+func (ht *habiticaTime) UnmarshalJSON(b []byte) error {
+	if len(b) > 0 && b[0] == '"' {
+		return json.Unmarshal(b, &ht.Time)
+	}
+	var ms float64
+	if err := json.Unmarshal(b, &ms); err != nil {
+		return err
+	}
+	ht.Time = time.UnixMilli(int64(ms))
+	return nil
+}
+
+type habiticaTask struct {
+	Type      string          `json:"type"`
+	Text      string          `json:"text"`
+	Notes     string          `json:"notes"`
+	Frequency string          `json:"frequency"`
+	EveryX    int             `json:"everyX"`
+	Repeat    map[string]bool `json:"repeat"`
+	CreatedAt *habiticaTime   `json:"createdAt"`
+	History   []struct {
+		Date      habiticaTime `json:"date"`
+		Completed *bool        `json:"completed"`
+		ScoredUp  int          `json:"scoredUp"`
+	} `json:"history"`
+}
+
+// interval maps a daily's schedule or a habit's counter reset onto an
+// Interval, reporting whether the mapping is exact.
+func (ht *habiticaTask) interval() (Interval, bool) {
+	every := max(ht.EveryX, 1)
+	switch ht.Frequency {
+	case "weekly":
+		days := 0
+		for _, on := range ht.Repeat {
+			if on {
+				days++
+			}
+		}
+		if ht.Type == "habit" {
+			return Weekly, true
+		}
+		return intervalFromFrequency(max(days, 1), 7*every)
+	case "monthly":
+		return Monthly, every == 1
+	case "yearly":
+		return Monthly, false
+	default:
+		return intervalFromFrequency(1, every)
+	}
+}
+
+// parseHabiticaImport reads the JSON user data export from Habitica, or the
+// response of its user API. Dailies are done on the days their history marks
+// completed and habits on the days they were scored up.
+func parseHabiticaImport(s *importSource, data []byte) error {
+	var export struct {
+		Tasks json.RawMessage `json:"tasks"`
+		Data  *struct {
+			Tasks json.RawMessage `json:"tasks"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(data, &export); err != nil {
+		return fmt.Errorf("file is not valid JSON: %w", err)
+	}
+	raw := export.Tasks
+	if raw == nil && export.Data != nil {
+		raw = export.Data.Tasks
+	}
+	if raw == nil {
+		return errors.New("file has no tasks; is it a Habitica data export?")
+	}
+
+	// Exports group tasks by type while the API returns a single list.
+	var tasks []habiticaTask
+	if err := json.Unmarshal(raw, &tasks); err != nil {
+		var grouped map[string][]habiticaTask
+		if err := json.Unmarshal(raw, &grouped); err != nil {
+			return fmt.Errorf("tasks are not in a known format: %w", err)
+		}
+		for group, kind := range map[string]string{"habits": "habit", "dailys": "daily", "todos": "todo", "rewards": "reward"} {
+			for _, ht := range grouped[group] {
+				if ht.Type == "" {
+					ht.Type = kind
+				}
+				tasks = append(tasks, ht)
+			}
+		}
+	}
+
+	skipped := 0
+	for _, ht := range tasks {
+		if ht.Type != "habit" && ht.Type != "daily" {
+			skipped++
+			continue
+		}
+
+		interval, exact := ht.interval()
+		if !exact {
+			s.warn("%q does not repeat once a day, week or month and was imported as %s", ht.Text, interval)
+		}
+
+		t := s.task(ht.Text, ht.Notes, interval)
+		if ht.CreatedAt != nil {
+			t.CreatedAt = ht.CreatedAt.Time
+		}
+		for _, entry := range ht.History {
+			switch {
+			case ht.Type == "habit" && entry.ScoredUp > 0:
+				t.Completions = append(t.Completions, entry.Date.Time)
+			case ht.Type == "daily" && entry.Completed != nil && *entry.Completed:
+				// A daily's history is written when the day rolls over, so
+				// each entry belongs to the day before it.
+				t.Completions = append(t.Completions, s.day(entry.Date.In(s.loc).AddDate(0, 0, -1)))
+			}
+		}
+	}
+	if skipped > 0 {
+		s.warn("%d to-dos and rewards were skipped because they do not repeat", skipped)
+	}
+
+	return nil
+}
+
+// plannedTask is an imported task once it has been checked against the
+// user's existing tasks. taskID is the task merged into, or the new task
+// once it is saved.
+type plannedTask struct {
+	task        *importTask
+	taskID      int
+	interval    Interval
+	createdAt   time.Time
+	completions []time.Time
+	result      int
+}
+
+type importPlan struct {
+	tasks  []*plannedTask
+	result *ImportResult
+}
+
+// importStore reads the user's tasks an import is checked against and saves
+// the import. The database is the only implementation outside tests.
+type importStore interface {
+	tasks(ctx context.Context, userID int) ([]*Task, error)
+	completionTimes(ctx context.Context, taskID int, start, end time.Time) ([]time.Time, error)
+	save(ctx context.Context, userID int, plan *importPlan, dryRun bool) error
+}
+
+type dbImportStore struct {
+	conn *pgxpool.Pool
+}
+
+func (s dbImportStore) tasks(ctx context.Context, userID int) ([]*Task, error) {
+	return getTasks(ctx, s.conn, userID, TaskFilter{Archived: true})
+}
+
+func (s dbImportStore) completionTimes(ctx context.Context, taskID int, start, end time.Time) ([]time.Time, error) {
+	return getCompletionTimes(ctx, s.conn, taskID, start, end)
+}
+
+func (s dbImportStore) save(ctx context.Context, userID int, plan *importPlan, dryRun bool) error {
+	return saveImport(ctx, s.conn, userID, plan, dryRun)
+}
+
+// dedupeCompletions returns times sorted with at most one per interval,
+// leaving out intervals that already have one of existing.
+func dedupeCompletions(interval Interval, loc *time.Location, existing, times []time.Time) ([]time.Time, int) {
+	seen := map[int64]bool{}
+	for _, t := range existing {
+		start, _ := interval.bounds(t.In(loc))
+		seen[start.Unix()] = true
+	}
+
+	slices.SortFunc(times, func(a, b time.Time) int { return a.Compare(b) })
+
+	kept := []time.Time{}
+	for _, t := range times {
+		start, _ := interval.bounds(t.In(loc))
+		if seen[start.Unix()] {
+			continue
+		}
+		seen[start.Unix()] = true
+		kept = append(kept, t)
+	}
+
+	return kept, len(times) - len(kept)
+}
+
+// planImport works out what importing the tasks in s would do. A task with
+// the same name as an existing one is a conflict, which is either skipped or
+// has its completions merged into the existing task depending on
+// onConflict.
+func planImport(ctx context.Context, store importStore, user *User, s *importSource, format, onConflict string) (*importPlan, error) {
+	existing, err := store.tasks(ctx, user.ID)
+	if err != nil {
+		return nil, err
+	}
+	byName := make(map[string]*Task, len(existing))
+	for _, t := range existing {
+		byName[strings.ToLower(strings.TrimSpace(t.Name))] = t
+	}
+
+	result := &ImportResult{
+		Format:    format,
+		Tasks:     []ImportTaskResult{},
+		Conflicts: []ImportConflict{},
+	}
+	plan := &importPlan{result: result}
+	now := time.Now()
+
+	for _, t := range s.tasks {
+		if utf8.RuneCountInString(t.Description) > maxDescriptionLength {
+			t.Description = string([]rune(t.Description)[:maxDescriptionLength])
+			s.warn("the description of %q was shortened to %d characters", t.Name, maxDescriptionLength)
+		}
+		if fe := validateTask(Task{Name: t.Name, Description: t.Description, Interval: t.Interval}); len(fe) > 0 {
+			s.warn("%q was skipped: %s", t.Name, fe["name"]+fe["interval"])
+			continue
+		}
+
+		future := 0
+		completions := t.Completions[:0]
+		for _, c := range t.Completions {
+			if c.After(now) {
+				future++
+				continue
+			}
+			completions = append(completions, c)
+		}
+		if future > 0 {
+			s.warn("%d completions of %q are in the future and were skipped", future, t.Name)
+		}
+
+		p := &plannedTask{task: t, interval: t.Interval, createdAt: t.CreatedAt}
+		taskResult := ImportTaskResult{Name: t.Name, Interval: t.Interval.String(), Action: ImportCreated}
+
+		var have []time.Time
+		if e, ok := byName[strings.ToLower(t.Name)]; ok {
+			conflict := ImportConflict{
+				Name:             t.Name,
+				TaskID:           e.ID,
+				Interval:         e.Interval.String(),
+				ImportedInterval: t.Interval.String(),
+				Resolution:       ImportSkipped,
+			}
+
+			if onConflict != ImportOnConflictMerge {
+				result.Conflicts = append(result.Conflicts, conflict)
+				result.TasksSkipped++
+				result.CompletionsSkipped += len(completions)
+				taskResult.Action = ImportSkipped
+				taskResult.DuplicateCompletions = len(completions)
+				result.Tasks = append(result.Tasks, taskResult)
+				continue
+			}
+
+			conflict.Resolution = ImportMerged
+			result.Conflicts = append(result.Conflicts, conflict)
+			if e.Interval != t.Interval {
+				s.warn("%q is %s here and %s in the import; completions were merged as %s", t.Name, e.Interval, t.Interval, e.Interval)
+			}
+
+			p.taskID, p.interval = e.ID, e.Interval
+			taskResult.ID = &e.ID
+			taskResult.Interval = e.Interval.String()
+			taskResult.Action = ImportMerged
+
+			if len(completions) > 0 {
+				first, last := slices.MinFunc(completions, time.Time.Compare), slices.MaxFunc(completions, time.Time.Compare)
+				start, _ := e.Interval.bounds(first.In(s.loc))
+				_, end := e.Interval.bounds(last.In(s.loc))
+				if have, err = store.completionTimes(ctx, e.ID, start, end); err != nil {
+					return nil, err
+				}
+			}
+		}
+
+		var duplicates int
+		p.completions, duplicates = dedupeCompletions(p.interval, s.loc, have, completions)
+		if p.taskID == 0 {
+			// A task cannot have been created after it was first done.
+			if len(p.completions) > 0 && (p.createdAt.IsZero() || p.completions[0].Before(p.createdAt)) {
+				p.createdAt = p.completions[0]
+			}
+			if p.createdAt.IsZero() {
+				p.createdAt = now
+			}
+			result.TasksCreated++
+		} else {
+			result.TasksMerged++
+		}
+
+		taskResult.Completions = len(p.completions)
+		taskResult.DuplicateCompletions = duplicates
+		result.CompletionsCreated += len(p.completions)
+		result.CompletionsSkipped += duplicates
+
+		p.result = len(result.Tasks)
+		result.Tasks = append(result.Tasks, taskResult)
+		plan.tasks = append(plan.tasks, p)
+	}
+
+	if s.dropped > 0 {
+		s.warn("%d more warnings were left out", s.dropped)
+	}
+	result.Warnings = s.warnings
+	if result.Warnings == nil {
+		result.Warnings = []string{}
+	}
+
+	return plan, nil
+}
+
+// readImport returns the uploaded file, which is either the whole request
+// body or the "file" part of a multipart form.
+func readImport(w http.ResponseWriter, r *http.Request) ([]byte, error) {
+	// Leave room for the multipart headers around the file.
+	body := http.MaxBytesReader(w, r.Body, maxImportSize+(1<<20))
+
+	mediaType, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if mediaType != "multipart/form-data" {
+		return io.ReadAll(body)
+	}
+
+	r.Body = body
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+	for {
+		part, err := mr.NextPart()
+		if err == io.EOF {
+			return nil, errors.New(`multipart form has no "file" part`)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if part.FormName() == "file" {
+			return io.ReadAll(io.LimitReader(part, maxImportSize+1))
+		}
+	}
+}
+
+// handleImport imports tasks and completions from our own export or another
+// habit tracker, all in one transaction. With dry_run nothing is saved and
+// the response describes what would have been.
+func handleImport(conn *pgxpool.Pool) http.HandlerFunc {
+	return importHandler(dbImportStore{conn: conn})
+}
+
+// importHandler is handleImport with tasks read from and saved to store.
+func importHandler(store importStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		query := r.URL.Query()
+		fe := FieldErrors{}
+
+		format := query.Get("format")
+		if _, ok := importParsers[format]; format != "" && !ok {
+			fe.add("format", "format must be one of didt, csv, loop, loop-sqlite or habitica")
+		}
+
+		onConflict := query.Get("on_conflict")
+		if onConflict == "" {
+			onConflict = ImportOnConflictSkip
+		}
+		if onConflict != ImportOnConflictSkip && onConflict != ImportOnConflictMerge {
+			fe.add("on_conflict", "on_conflict must be skip or merge")
+		}
+
+		dryRun := false
+		if value := query.Get("dry_run"); value != "" {
+			var err error
+			if dryRun, err = strconv.ParseBool(value); err != nil {
+				fe.add("dry_run", "dry_run must be true or false")
+			}
+		}
+
+		if len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		data, err := readImport(w, r)
+		var maxBytesErr *http.MaxBytesError
+		if errors.As(err, &maxBytesErr) || len(data) > maxImportSize {
+			writeError(w, http.StatusRequestEntityTooLarge, CodeTooLarge, fmt.Sprintf("file must be at most %d MiB", maxImportSize>>20))
+			return
+		}
+		if err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "unable to read the uploaded file")
+			loggerFrom(r.Context()).Error("Unable to read import", "error", err.Error())
+			return
+		}
+		if len(data) == 0 {
+			writeFieldErrors(w, FieldErrors{"file": "file is required"})
+			return
+		}
+
+		if format == "" {
+			format = detectImportFormat(data)
+		}
+		source := newImportSource(user.location())
+		if err := importParsers[format](source, data); err != nil {
+			writeFieldErrors(w, FieldErrors{"file": err.Error()})
+			return
+		}
+
+		plan, err := planImport(r.Context(), store, user, source, format, onConflict)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to plan import")
+			return
+		}
+
+		if err := store.save(r.Context(), user.ID, plan, dryRun); err != nil {
+			if errors.Is(err, errImportChanged) {
+				writeError(w, http.StatusConflict, CodeConflict, "tasks changed during the import; try again")
+				return
+			}
+			writeStoreError(w, r, err, "Unable to save import")
+			return
+		}
+
+		plan.result.DryRun = dryRun
+		if !dryRun {
+			for _, p := range plan.tasks {
+				id := p.taskID
+				plan.result.Tasks[p.result].ID = &id
+			}
+		}
+
+		writeJSON(w, http.StatusOK, plan.result)
+	}
+}
@@ -0,0 +1,538 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestIntervalFromFrequency(t *testing.T) {
+	tests := []struct {
+		times, days int
+		want        Interval
+		exact       bool
+	}{
+		{1, 1, Daily, true},
+		{0, 1, Daily, true},
+		{2, 1, Daily, false},
+		{3, 3, Daily, false},
+		{1, 2, Weekly, false},
+		{1, 7, Weekly, true},
+		{2, 7, Weekly, false},
+		{1, 14, Monthly, false},
+		{1, 28, Monthly, true},
+		{1, 31, Monthly, true},
+		{1, 90, Monthly, false},
+	}
+
+	for _, tt := range tests {
+		got, exact := intervalFromFrequency(tt.times, tt.days)
+		if got != tt.want || exact != tt.exact {
+			t.Errorf("%d times every %d days: got %s, %v, want %s, %v", tt.times, tt.days, got, exact, tt.want, tt.exact)
+		}
+	}
+}
+
+// testZip builds a zip file holding files, which alternate between names
+// and contents.
+func testZip(t *testing.T, files ...string) []byte {
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		f, err := zw.Create(files[i])
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write([]byte(files[i+1])); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// testDays returns noon on each date in loc.
+func testDays(loc *time.Location, dates ...string) []time.Time {
+	days := make([]time.Time, len(dates))
+	for i, date := range dates {
+		d, _ := time.ParseInLocation(time.DateOnly, date, loc)
+		days[i] = d.Add(12 * time.Hour)
+	}
+	return days
+}
+
+// checkCompletions fails unless the imported task called name was done at
+// exactly want.
+func checkCompletions(t *testing.T, s *importSource, name string, want []time.Time) {
+	t.Helper()
+	task, ok := s.byName[strings.ToLower(name)]
+	if !ok {
+		t.Errorf("%q was not imported", name)
+		return
+	}
+	if !slices.EqualFunc(task.Completions, want, time.Time.Equal) {
+		t.Errorf("%q was done at %v, want %v", name, task.Completions, want)
+	}
+}
+
+const loopHabits = `Position,Name,Question,Description,NumRepetitions,Interval,Color
+001,Stretch,Did you stretch?,,1,1,#FF8F00
+002,Read,,Twenty pages,3,7,#00897B
+`
+
+func TestParseLoopImport(t *testing.T) {
+	tests := []struct {
+		name       string
+		checkmarks string
+		warnings   int
+	}{
+		{
+			// Columns are matched by position when there is one per habit,
+			// since a habit may have been renamed.
+			name: "by position",
+			checkmarks: `Date,Morning stretch,Reading,
+2024-03-03,2,0,
+2024-03-02,YES_MANUAL,YES_AUTO,
+2024-03-01,1,-1,
+2024-02-29,0,2,
+`,
+		},
+		{
+			name: "by name",
+			checkmarks: `Date,Read,Archived,Stretch,
+2024-03-03,0,2,2,
+2024-03-02,YES_AUTO,2,YES_MANUAL,
+2024-03-01,-1,2,1,
+2024-02-29,2,2,0,
+`,
+			warnings: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// Each habit has a folder of its own files, which must not be
+			// read in place of the summary at the top.
+			data := testZip(t,
+				"001 Stretch/Checkmarks.csv", "Date,Stretch\n2024-01-01,2\n",
+				"Habits.csv", loopHabits,
+				"Checkmarks.csv", tt.checkmarks,
+			)
+
+			s := newImportSource(time.UTC)
+			if err := parseLoopImport(s, data); err != nil {
+				t.Fatal(err)
+			}
+
+			if len(s.tasks) != 2 {
+				t.Fatalf("got %d tasks, want 2", len(s.tasks))
+			}
+			stretch, read := s.tasks[0], s.tasks[1]
+			if stretch.Name != "Stretch" || stretch.Interval != Daily || stretch.Description != "Did you stretch?" {
+				t.Errorf("got Stretch %+v", stretch)
+			}
+			if read.Name != "Read" || read.Interval != Weekly || read.Description != "Twenty pages" {
+				t.Errorf("got Read %+v", read)
+			}
+			checkCompletions(t, s, "Stretch", testDays(time.UTC, "2024-03-03", "2024-03-02"))
+			checkCompletions(t, s, "Read", testDays(time.UTC, "2024-02-29"))
+
+			// Read is done three times a week.
+			if len(s.warnings) != 1+tt.warnings {
+				t.Errorf("got warnings %q", s.warnings)
+			}
+		})
+	}
+}
+
+func TestParseLoopImportNotLoop(t *testing.T) {
+	for name, data := range map[string][]byte{
+		"not a zip":     []byte("Date,Stretch\n"),
+		"no Habits.csv": testZip(t, "Checkmarks.csv", "Date\n"),
+	} {
+		if err := parseLoopImport(newImportSource(time.UTC), data); err == nil {
+			t.Errorf("%s: got no error", name)
+		}
+	}
+}
+
+func TestParseLoopSQLiteImport(t *testing.T) {
+	habits := testPage(0x0D, 0, 0,
+		testLeafCell(1, testRecord(nil, "Stretch", "", "Did you stretch?", int64(1), int64(1), int64(0))),
+		testLeafCell(2, testRecord(nil, "Pages", "Pages read", "", int64(3), int64(7), int64(1))),
+	)
+	day := func(date string) int64 {
+		d, _ := time.Parse(time.DateOnly, date)
+		return d.UnixMilli()
+	}
+	repetitions := testPage(0x0D, 0, 0,
+		testLeafCell(1, testRecord(nil, int64(1), day("2024-03-01"), int64(2))),
+		testLeafCell(2, testRecord(nil, int64(1), day("2024-03-02"), int64(1))),
+		testLeafCell(3, testRecord(nil, int64(2), day("2024-03-01"), int64(5000))),
+		testLeafCell(4, testRecord(nil, int64(2), day("2024-03-02"), int64(0))),
+		testLeafCell(5, testRecord(nil, int64(9), day("2024-03-03"), int64(2))),
+	)
+	data := testSchemaDatabase([][]byte{
+		testRecord("table", "Habits", "Habits", int64(2), "CREATE TABLE Habits (id INTEGER PRIMARY KEY AUTOINCREMENT, name TEXT, description TEXT, question TEXT, freq_num INTEGER, freq_den INTEGER, type INTEGER)"),
+		testRecord("table", "Repetitions", "Repetitions", int64(3), "CREATE TABLE Repetitions (id INTEGER PRIMARY KEY AUTOINCREMENT, habit INTEGER NOT NULL REFERENCES Habits(id), timestamp INTEGER NOT NULL, value INTEGER NOT NULL)"),
+	}, habits, repetitions)
+
+	// Loop's midnight UTC must stay on the same day west of Greenwich.
+	loc, err := time.LoadLocation("America/Los_Angeles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := newImportSource(loc)
+	if err := parseLoopSQLiteImport(s, data); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(s.tasks) != 2 {
+		t.Fatalf("got %d tasks, want 2", len(s.tasks))
+	}
+	if s.tasks[0].Description != "Did you stretch?" || s.tasks[0].Interval != Daily {
+		t.Errorf("got Stretch %+v", s.tasks[0])
+	}
+	if s.tasks[1].Description != "Pages read" || s.tasks[1].Interval != Weekly {
+		t.Errorf("got Pages %+v", s.tasks[1])
+	}
+	checkCompletions(t, s, "Stretch", testDays(loc, "2024-03-01"))
+	checkCompletions(t, s, "Pages", testDays(loc, "2024-03-01"))
+	if len(s.warnings) != 1 {
+		t.Errorf("got warnings %q", s.warnings)
+	}
+}
+
+func TestParseHabiticaImport(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Run("export", func(t *testing.T) {
+		data := `{"tasks": {
+	"habits": [{"text": "Floss", "frequency": "daily", "history": [
+		{"date": 1709647200000, "scoredUp": 1, "scoredDown": 0},
+		{"date": 1709733600000, "scoredUp": 0, "scoredDown": 1}
+	]}],
+	"dailys": [
+		{"text": "Stretch", "notes": "Ten minutes", "frequency": "daily", "everyX": 1, "createdAt": "2024-03-01T15:00:00.000Z", "history": [
+			{"date": "2024-03-05T05:30:00.000Z", "completed": true},
+			{"date": "2024-03-06T05:30:00.000Z", "completed": false},
+			{"date": "2024-03-07T05:30:00.000Z"}
+		]},
+		{"text": "Gym", "frequency": "weekly", "repeat": {"m": true, "t": false, "w": true, "f": true}}
+	],
+	"todos": [{"text": "Taxes"}],
+	"rewards": []
+}}`
+
+		s := newImportSource(loc)
+		if err := parseHabiticaImport(s, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.tasks) != 3 {
+			t.Fatalf("got %d tasks, want 3", len(s.tasks))
+		}
+		// Habits keep the time they were scored.
+		checkCompletions(t, s, "Floss", []time.Time{time.Date(2024, 3, 5, 14, 0, 0, 0, time.UTC)})
+		// Shortly after midnight on the 5th closes the 4th.
+		checkCompletions(t, s, "Stretch", testDays(loc, "2024-03-04"))
+		checkCompletions(t, s, "Gym", nil)
+
+		stretch := s.byName["stretch"]
+		if stretch.Description != "Ten minutes" || !stretch.CreatedAt.Equal(time.Date(2024, 3, 1, 15, 0, 0, 0, time.UTC)) {
+			t.Errorf("got Stretch %+v", stretch)
+		}
+		if gym := s.byName["gym"]; gym.Interval != Weekly {
+			t.Errorf("Gym is %s, want Weekly", gym.Interval)
+		}
+		// Gym is done three times a week and the to-do is skipped.
+		if len(s.warnings) != 2 {
+			t.Errorf("got warnings %q", s.warnings)
+		}
+	})
+
+	t.Run("api", func(t *testing.T) {
+		data := `{"success": true, "data": {"tasks": [
+	{"type": "daily", "text": "Stretch", "frequency": "daily", "everyX": 2, "history": [{"date": "2024-03-05T05:30:00.000Z", "completed": true}]},
+	{"type": "todo", "text": "Taxes"}
+]}}`
+
+		s := newImportSource(loc)
+		if err := parseHabiticaImport(s, []byte(data)); err != nil {
+			t.Fatal(err)
+		}
+
+		if len(s.tasks) != 1 || s.tasks[0].Interval != Weekly {
+			t.Fatalf("got tasks %+v", s.tasks)
+		}
+		checkCompletions(t, s, "Stretch", testDays(loc, "2024-03-04"))
+	})
+
+	if err := parseHabiticaImport(newImportSource(loc), []byte(`{"user": {}}`)); err == nil {
+		t.Error("a file without tasks was accepted")
+	}
+}
+
+func TestDedupeCompletions(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Fatal(err)
+	}
+	at := func(value string) time.Time {
+		t, _ := time.Parse(time.RFC3339, value)
+		return t
+	}
+
+	tests := []struct {
+		name       string
+		interval   Interval
+		existing   []time.Time
+		times      []time.Time
+		want       []time.Time
+		duplicates int
+	}{
+		{
+			name:       "daily",
+			interval:   Daily,
+			existing:   []time.Time{at("2024-03-01T14:00:00Z")},
+			times:      []time.Time{at("2024-03-02T01:00:00Z"), at("2024-03-02T15:00:00Z"), at("2024-03-02T23:00:00Z"), at("2024-02-28T12:00:00Z")},
+			want:       []time.Time{at("2024-02-28T12:00:00Z"), at("2024-03-02T15:00:00Z")},
+			duplicates: 2,
+		},
+		{
+			name:       "weekly from Monday",
+			interval:   Weekly,
+			times:      []time.Time{at("2024-03-10T15:00:00Z"), at("2024-03-04T15:00:00Z"), at("2024-03-03T15:00:00Z")},
+			want:       []time.Time{at("2024-03-03T15:00:00Z"), at("2024-03-04T15:00:00Z")},
+			duplicates: 1,
+		},
+		{
+			name:       "monthly in the user's time zone",
+			interval:   Monthly,
+			existing:   []time.Time{at("2024-04-15T12:00:00Z")},
+			times:      []time.Time{at("2024-03-01T03:00:00Z"), at("2024-02-10T12:00:00Z"), at("2024-04-30T12:00:00Z")},
+			want:       []time.Time{at("2024-02-10T12:00:00Z")},
+			duplicates: 2,
+		},
+		{
+			name:     "nothing to import",
+			interval: Daily,
+			existing: []time.Time{at("2024-03-01T14:00:00Z")},
+			want:     []time.Time{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, duplicates := dedupeCompletions(tt.interval, loc, tt.existing, tt.times)
+			if !slices.EqualFunc(got, tt.want, time.Time.Equal) || duplicates != tt.duplicates {
+				t.Fatalf("got %v and %d duplicates, want %v and %d", got, duplicates, tt.want, tt.duplicates)
+			}
+		})
+	}
+}
+
+// memoryImportStore is an importStore kept in memory. Like the database it
+// gives new tasks an ID on a dry run but keeps nothing.
+type memoryImportStore struct {
+	existing    []*Task
+	completions map[int][]time.Time
+	nextID      int
+	dryRuns     int
+}
+
+func newMemoryImportStore() *memoryImportStore {
+	return &memoryImportStore{
+		existing:    []*Task{{ID: 7, UserID: 1, Name: "Stretch", Interval: Daily}},
+		completions: map[int][]time.Time{7: {time.Date(2024, 3, 2, 8, 0, 0, 0, time.UTC)}},
+		nextID:      8,
+	}
+}
+
+func (s *memoryImportStore) tasks(_ context.Context, userID int) ([]*Task, error) {
+	var tasks []*Task
+	for _, t := range s.existing {
+		if t.UserID == userID {
+			tasks = append(tasks, t)
+		}
+	}
+	return tasks, nil
+}
+
+func (s *memoryImportStore) completionTimes(_ context.Context, taskID int, start, end time.Time) ([]time.Time, error) {
+	var times []time.Time
+	for _, c := range s.completions[taskID] {
+		if !c.Before(start) && c.Before(end) {
+			times = append(times, c)
+		}
+	}
+	return times, nil
+}
+
+func (s *memoryImportStore) save(_ context.Context, userID int, plan *importPlan, dryRun bool) error {
+	var created []*Task
+	for _, p := range plan.tasks {
+		if p.taskID == 0 {
+			p.taskID = s.nextID
+			s.nextID++
+			created = append(created, &Task{ID: p.taskID, UserID: userID, Name: p.task.Name, Interval: p.interval})
+		}
+	}
+	if dryRun {
+		s.dryRuns++
+		return nil
+	}
+
+	s.existing = append(s.existing, created...)
+	for _, p := range plan.tasks {
+		s.completions[p.taskID] = append(s.completions[p.taskID], p.completions...)
+	}
+	return nil
+}
+
+func TestPlanImport(t *testing.T) {
+	// newSource is read afresh for each plan, which filters completions in
+	// place.
+	newSource := func() *importSource {
+		s := newImportSource(time.UTC)
+		stretch := s.task(" stretch ", "", Daily)
+		stretch.Completions = []time.Time{
+			time.Date(2024, 3, 2, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 3, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 3, 18, 0, 0, 0, time.UTC),
+			time.Now().Add(48 * time.Hour),
+		}
+		read := s.task("Read", "", Weekly)
+		read.Completions = []time.Time{
+			time.Date(2024, 3, 6, 12, 0, 0, 0, time.UTC),
+			time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC),
+		}
+		return s
+	}
+
+	tests := []struct {
+		onConflict string
+		want       ImportResult
+		conflict   ImportConflict
+		stretch    ImportTaskResult
+	}{
+		{
+			onConflict: ImportOnConflictSkip,
+			want:       ImportResult{TasksCreated: 1, TasksSkipped: 1, CompletionsCreated: 1, CompletionsSkipped: 4},
+			conflict:   ImportConflict{Name: "stretch", TaskID: 7, Interval: "Daily", ImportedInterval: "Daily", Resolution: ImportSkipped},
+			stretch:    ImportTaskResult{Name: "stretch", Interval: "Daily", Action: ImportSkipped, DuplicateCompletions: 3},
+		},
+		{
+			onConflict: ImportOnConflictMerge,
+			want:       ImportResult{TasksCreated: 1, TasksMerged: 1, CompletionsCreated: 2, CompletionsSkipped: 3},
+			conflict:   ImportConflict{Name: "stretch", TaskID: 7, Interval: "Daily", ImportedInterval: "Daily", Resolution: ImportMerged},
+			stretch:    ImportTaskResult{Name: "stretch", Interval: "Daily", Action: ImportMerged, Completions: 1, DuplicateCompletions: 2},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.onConflict, func(t *testing.T) {
+			s := newSource()
+			plan, err := planImport(context.Background(), newMemoryImportStore(), &User{ID: 1}, s, "csv", tt.onConflict)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got := plan.result
+
+			if got.TasksCreated != tt.want.TasksCreated || got.TasksMerged != tt.want.TasksMerged || got.TasksSkipped != tt.want.TasksSkipped ||
+				got.CompletionsCreated != tt.want.CompletionsCreated || got.CompletionsSkipped != tt.want.CompletionsSkipped {
+				t.Errorf("got counts %+v, want %+v", got, tt.want)
+			}
+			if len(got.Conflicts) != 1 || got.Conflicts[0] != tt.conflict {
+				t.Errorf("got conflicts %+v", got.Conflicts)
+			}
+			if len(got.Tasks) != 2 {
+				t.Fatalf("got task results %+v", got.Tasks)
+			}
+
+			stretch := got.Tasks[0]
+			stretch.ID = nil
+			if stretch != tt.stretch {
+				t.Errorf("got %+v, want %+v", stretch, tt.stretch)
+			}
+			read := got.Tasks[1]
+			if read.ID != nil || read.Action != ImportCreated || read.Completions != 1 || read.DuplicateCompletions != 1 {
+				t.Errorf("got Read %+v", read)
+			}
+
+			// Read is new and is created when it was first done.
+			last := plan.tasks[len(plan.tasks)-1]
+			if last.task.Name != "Read" || !last.createdAt.Equal(time.Date(2024, 3, 4, 12, 0, 0, 0, time.UTC)) {
+				t.Errorf("Read is planned as %+v", last)
+			}
+
+			if len(got.Warnings) != 1 || !strings.Contains(got.Warnings[0], "future") {
+				t.Errorf("got warnings %q", got.Warnings)
+			}
+		})
+	}
+}
+
+func TestImportDryRun(t *testing.T) {
+	const data = `task_name,interval,completed_at
+Stretch,Daily,2024-03-03
+Read,Weekly,2024-03-04
+`
+	store := newMemoryImportStore()
+	h := importHandler(store)
+
+	send := func(target string) ImportResult {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, target, strings.NewReader(data))
+		r.Header.Set("Content-Type", "text/csv")
+		r = r.WithContext(context.WithValue(r.Context(), UserKey("user"), &User{ID: 1, Timezone: "UTC"}))
+
+		w := httptest.NewRecorder()
+		h(w, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("got %d: %s", w.Code, w.Body)
+		}
+
+		var result ImportResult
+		if err := json.Unmarshal(w.Body.Bytes(), &result); err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+
+	result := send("/api/import?format=csv&dry_run=true")
+	if !result.DryRun || result.TasksCreated != 1 || result.TasksSkipped != 1 {
+		t.Errorf("got %+v", result)
+	}
+	if len(result.Conflicts) != 1 || result.Conflicts[0].TaskID != 7 || result.Conflicts[0].Resolution != ImportSkipped {
+		t.Errorf("got conflicts %+v", result.Conflicts)
+	}
+	for _, task := range result.Tasks {
+		if task.ID != nil {
+			t.Errorf("%q has ID %d on a dry run", task.Name, *task.ID)
+		}
+	}
+	if store.dryRuns != 1 || len(store.existing) != 1 || len(store.completions[7]) != 1 {
+		t.Fatalf("a dry run saved %d tasks and %d completions", len(store.existing), len(store.completions[7]))
+	}
+
+	result = send("/api/import?format=csv")
+	if result.DryRun || len(store.existing) != 2 {
+		t.Fatalf("got %+v with %d tasks saved", result, len(store.existing))
+	}
+	if read := result.Tasks[1]; read.ID == nil || *read.ID != store.existing[1].ID {
+		t.Errorf("got Read %+v", read)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"time"
+)
+
+const requestIDHeader = "X-Request-ID"
+
+// validRequestID limits which client supplied request IDs are honored so
+// they are safe to put in logs and response headers.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._:-]{1,128}$`)
+
+type requestLogKey struct{}
+
+// requestLog is shared by every handler serving a request, so that details
+// learned deep in the chain, such as the user, end up in the access log.
+type requestLog struct {
+	logger *slog.Logger
+}
+
+// loggerFrom returns the request scoped logger, or the global logger when
+// ctx does not belong to a request.
+func loggerFrom(ctx context.Context) *slog.Logger {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		return rl.logger
+	}
+	return logger
+}
+
+// setRequestUser attaches the user to the request scoped logger.
+func setRequestUser(ctx context.Context, userID int) {
+	if rl, ok := ctx.Value(requestLogKey{}).(*requestLog); ok {
+		rl.logger = rl.logger.With("user_id", userID)
+	}
+}
+
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(status int) {
+	if sw.status == 0 {
+		sw.status = status
+	}
+	sw.ResponseWriter.WriteHeader(status)
+}
+
+func (sw *statusWriter) Write(b []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(b)
+}
+
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
+
+// withRequestLogging assigns every request an ID, honoring X-Request-ID, puts
+// a logger carrying it in the context and writes an access log line once the
+// request is served.
+func withRequestLogging(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+
+		requestID := r.Header.Get(requestIDHeader)
+		if !validRequestID.MatchString(requestID) {
+			requestID = newToken()
+		}
+		w.Header().Set(requestIDHeader, requestID)
+
+		rl := &requestLog{logger: logger.With("request_id", requestID)}
+		sw := &statusWriter{ResponseWriter: w}
+
+		// The mux records the matched pattern on the request it is given.
+		req := r.WithContext(context.WithValue(r.Context(), requestLogKey{}, rl))
+		h.ServeHTTP(sw, req)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		level := slog.LevelInfo
+		if status >= http.StatusInternalServerError {
+			level = slog.LevelError
+		}
+
+		rl.logger.Log(r.Context(), level, "Request",
+			"method", r.Method,
+			"pattern", req.Pattern,
+			"path", r.URL.Path,
+			"status", status,
+			"latency_ms", float64(time.Since(start).Microseconds())/1000,
+		)
+	})
+}
@@ -2,38 +2,132 @@ package main
 
 import (
 	"context"
+	"errors"
+	"flag"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	_ "time/tzdata"
 
 	"github.com/jackc/pgx/v5/pgxpool"
 )
 
-var logger *slog.Logger
+var (
+	logger   *slog.Logger
+	logLevel = new(slog.LevelVar)
+)
 
 func init() {
 	slogOpts := &slog.HandlerOptions{
-		Level: slog.LevelInfo,
+		Level: logLevel,
 	}
 	logger = slog.New(slog.NewJSONHandler(os.Stdout, slogOpts))
 }
 
 func main() {
-	conn, err := pgxpool.New(context.Background(), databaseURL())
+	configPath := flag.String("config", "", "path to a YAML config file, overridden by the environment")
+	printOnly := flag.Bool("print-config", false, "print the loaded config with secrets redacted and exit")
+	generateVAPID := flag.Bool("generate-vapid-key", false, "print a new private key for vapid_private_key and exit")
+	healthcheck := flag.Bool("healthcheck", false, "check that the running server is ready and exit non-zero if it is not")
+	flag.Usage = usage
+	flag.Parse()
+
+	if *generateVAPID {
+		key, err := generateVAPIDKey()
+		if err != nil {
+			logger.Error("Unable to generate VAPID key", "error", err.Error())
+			os.Exit(1)
+		}
+		fmt.Println(key)
+		return
+	}
+
+	cfg, err := loadConfig(*configPath)
+	if err != nil {
+		logger.Error("Invalid configuration", "error", err.Error())
+		os.Exit(1)
+	}
+	logLevel.Set(cfg.LogLevel)
+
+	if *printOnly {
+		if err := printConfig(os.Stdout, cfg); err != nil {
+			logger.Error("Unable to print configuration", "error", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	if *healthcheck {
+		if err := runHealthcheck(cfg); err != nil {
+			logger.Error("Server is not ready", "error", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGINT, syscall.SIGTERM)
+	defer stop()
+
+	if flag.NArg() > 0 && flag.Arg(0) != "serve" {
+		err := runCommand(ctx, cfg, flag.Args())
+		if errors.Is(err, flag.ErrHelp) {
+			return
+		}
+		if err != nil {
+			logger.Error("Command failed", "command", flag.Arg(0), "error", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+
+	conn, err := pgxpool.New(ctx, cfg.DatabaseURL)
 	if err != nil {
 		logger.Error("Unable to connect to database", "error", err.Error())
 		os.Exit(1)
 	}
 	defer conn.Close()
 
-	if isFirstRun() {
-		if err := createTables(context.Background(), conn); err != nil {
-			logger.Error("Unable to create tables", "error", err.Error())
+	// Every release expects the schema its migrations build, so the server
+	// never runs against an older one.
+	if cfg.AutoMigrate || cfg.FirstRun {
+		if err := migrate(ctx, conn); err != nil {
+			logger.Error("Unable to migrate database", "error", err.Error())
+			os.Exit(1)
+		}
+	} else if err := checkSchemaVersion(ctx, conn); err != nil {
+		logger.Error("Database schema is out of date; run the migrate command or set DIDT_AUTO_MIGRATE", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if len(cfg.Admins) > 0 {
+		granted, err := grantAdmins(ctx, conn, cfg.Admins)
+		if err != nil {
+			logger.Error("Unable to grant admin access", "error", err.Error())
 			os.Exit(1)
 		}
+		if granted > 0 {
+			logger.Info("Granted admin access", "users", granted)
+		}
 	}
 
-	if err := startHTTP(port(), conn); err != nil {
+	if cfg.RemindersEnabled {
+		go runReminders(ctx, cfg, conn, newNotifiers(cfg, conn))
+	}
+
+	if m := newMailer(cfg); m != nil {
+		go runDigests(ctx, cfg, conn, m)
+	}
+
+	if cfg.WebhooksEnabled {
+		go runWebhooks(ctx, cfg, conn)
+	}
+
+	if err := startHTTP(ctx, cfg, conn); err != nil {
 		logger.Error("Unable to start HTTP server", "error", err.Error())
 		os.Exit(1)
 	}
+
+	logger.Info("Server stopped")
 }
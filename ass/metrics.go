@@ -0,0 +1,260 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// activeSessionWindow matches the MaxAge of the session cookie.
+const activeSessionWindow = time.Hour
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// metrics holds the process wide metrics, written in the Prometheus text
+// exposition format by handleMetrics.
+var metrics = struct {
+	httpRequests *counterVec
+	httpDuration *histogramVec
+	logins       *counterVec
+	completions  *counterVec
+
+	webhookDeliveries *counterVec
+}{
+	httpRequests: newCounterVec("didt_http_requests_total", "HTTP requests served.", "pattern", "method", "status"),
+	httpDuration: newHistogramVec("didt_http_request_duration_seconds", "Latency of HTTP requests.", durationBuckets, "pattern"),
+	logins:       newCounterVec("didt_logins_total", "Login attempts by method and result.", "method", "result"),
+	completions:  newCounterVec("didt_completions_created_total", "Completions created by task interval.", "interval"),
+
+	webhookDeliveries: newCounterVec("didt_webhook_delivery_attempts_total", "Webhook delivery attempts by the resulting delivery status.", "status"),
+}
+
+type counterVec struct {
+	name   string
+	help   string
+	labels []string
+
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func newCounterVec(name, help string, labels ...string) *counterVec {
+	return &counterVec{name: name, help: help, labels: labels, values: make(map[string]float64)}
+}
+
+func (c *counterVec) Inc(labelValues ...string) {
+	key := formatLabels(c.labels, labelValues)
+
+	c.mu.Lock()
+	c.values[key]++
+	c.mu.Unlock()
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	for _, key := range sortedKeys(c.values) {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, key, formatFloat(c.values[key]))
+	}
+}
+
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+type histogramVec struct {
+	name    string
+	help    string
+	buckets []float64
+	labels  []string
+
+	mu     sync.Mutex
+	values map[string]*histogram
+	// labelValues keeps the raw label values for each key so the le label
+	// can be added when writing buckets.
+	labelValues map[string][]string
+}
+
+func newHistogramVec(name, help string, buckets []float64, labels ...string) *histogramVec {
+	return &histogramVec{
+		name:        name,
+		help:        help,
+		buckets:     buckets,
+		labels:      labels,
+		values:      make(map[string]*histogram),
+		labelValues: make(map[string][]string),
+	}
+}
+
+func (h *histogramVec) Observe(v float64, labelValues ...string) {
+	key := formatLabels(h.labels, labelValues)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	hist, ok := h.values[key]
+	if !ok {
+		hist = &histogram{counts: make([]uint64, len(h.buckets))}
+		h.values[key] = hist
+		h.labelValues[key] = labelValues
+	}
+
+	for i, upper := range h.buckets {
+		if v <= upper {
+			hist.counts[i]++
+		}
+	}
+	hist.sum += v
+	hist.count++
+}
+
+func (h *histogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+
+	bucketLabels := append(append([]string{}, h.labels...), "le")
+	for _, key := range sortedKeys(h.values) {
+		hist := h.values[key]
+		values := h.labelValues[key]
+
+		for i, upper := range h.buckets {
+			le := formatLabels(bucketLabels, append(append([]string{}, values...), formatFloat(upper)))
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, hist.counts[i])
+		}
+		le := formatLabels(bucketLabels, append(append([]string{}, values...), "+Inf"))
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, le, hist.count)
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, key, formatFloat(hist.sum))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, key, hist.count)
+	}
+}
+
+func writeGauge(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+func writeCounter(w io.Writer, name, help string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s %s\n", name, help, name, name, formatFloat(v))
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func formatLabels(names, values []string) string {
+	if len(names) == 0 {
+		return ""
+	}
+
+	var b strings.Builder
+	b.WriteByte('{')
+	for i, name := range names {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		value := ""
+		if i < len(values) {
+			value = values[i]
+		}
+		fmt.Fprintf(&b, `%s="%s"`, name, labelEscaper.Replace(value))
+	}
+	b.WriteByte('}')
+
+	return b.String()
+}
+
+func formatFloat(v float64) string {
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// withMetrics records the count and latency of requests by the pattern the
+// mux matched them to.
+func withMetrics(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		sw := &statusWriter{ResponseWriter: w}
+
+		h.ServeHTTP(sw, r)
+
+		status := sw.status
+		if status == 0 {
+			status = http.StatusOK
+		}
+
+		pattern := r.Pattern
+		if pattern == "" {
+			pattern = "unmatched"
+		}
+
+		metrics.httpRequests.Inc(pattern, r.Method, strconv.Itoa(status))
+		metrics.httpDuration.Observe(time.Since(start).Seconds(), pattern)
+	})
+}
+
+// withMetricsToken requires the configured bearer token, if any.
+func withMetricsToken(cfg *Config, h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if cfg.MetricsToken == "" {
+			h(w, r)
+			return
+		}
+
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.MetricsToken)) != 1 {
+			writeError(w, http.StatusUnauthorized, CodeUnauthorized, "metrics token is required")
+			return
+		}
+
+		h(w, r)
+	}
+}
+
+func handleMetrics(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		activeSessions, err := countSessionsSince(r.Context(), conn, time.Now().Add(-activeSessionWindow))
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to count sessions")
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+
+		metrics.httpRequests.write(w)
+		metrics.httpDuration.write(w)
+		metrics.logins.write(w)
+		metrics.completions.write(w)
+		metrics.webhookDeliveries.write(w)
+
+		writeGauge(w, "didt_active_sessions", "Sessions created within the session cookie lifetime.", float64(activeSessions))
+
+		stat := conn.Stat()
+		writeGauge(w, "didt_pgxpool_acquired_conns", "Connections currently acquired from the pool.", float64(stat.AcquiredConns()))
+		writeGauge(w, "didt_pgxpool_idle_conns", "Idle connections in the pool.", float64(stat.IdleConns()))
+		writeGauge(w, "didt_pgxpool_total_conns", "Connections in the pool.", float64(stat.TotalConns()))
+		writeGauge(w, "didt_pgxpool_max_conns", "Maximum size of the pool.", float64(stat.MaxConns()))
+		writeCounter(w, "didt_pgxpool_acquire_total", "Connections acquired from the pool.", float64(stat.AcquireCount()))
+		writeCounter(w, "didt_pgxpool_acquire_duration_seconds_total", "Time spent acquiring connections from the pool.", stat.AcquireDuration().Seconds())
+		writeCounter(w, "didt_pgxpool_empty_acquire_total", "Acquires that waited for a connection because the pool was empty.", float64(stat.EmptyAcquireCount()))
+		writeCounter(w, "didt_pgxpool_canceled_acquire_total", "Acquires cancelled by their context.", float64(stat.CanceledAcquireCount()))
+	}
+}
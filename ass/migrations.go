@@ -0,0 +1,421 @@
+package main
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// migrationLockID is the advisory lock held while migrating, so that two
+// instances starting together do not both apply the same migration.
+const migrationLockID = 4419
+
+type migration struct {
+	version int
+	name    string
+	sql     string
+}
+
+// migrations are applied in order and must never be edited once released;
+// change the schema by appending a new one. Every statement in the initial
+// schema is idempotent so it is safe to apply to databases created before
+// migrations were tracked.
+var migrations = []migration{
+	{
+		version: 1,
+		name:    "initial schema",
+		sql: `
+DO $$ BEGIN
+	CREATE TYPE interval_enum AS ENUM ('Hourly', 'Daily', 'Weekly', 'Monthly');
+EXCEPTION
+    WHEN duplicate_object THEN null;
+END $$;
+
+CREATE TABLE if not exists tasks (
+    id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+    name VARCHAR(255) NOT NULL,
+    description TEXT,
+    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+    interval interval_enum NOT NULL
+);
+
+CREATE TABLE if not exists completions (
+	task_id INT NOT NULL,
+	completed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE if not exists users (
+	id SERIAL PRIMARY KEY,
+	username VARCHAR(255) NOT NULL UNIQUE,
+	password VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE if not exists magic_links (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	token VARCHAR(255) NOT NULL,
+	valid BOOLEAN DEFAULT FALSE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE if not exists sessions (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	token VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE if not exists idempotency_keys (
+	user_id INT NOT NULL,
+	key VARCHAR(255) NOT NULL,
+	method VARCHAR(16) NOT NULL,
+	path TEXT NOT NULL,
+	status INT NOT NULL DEFAULT 0,
+	headers JSONB NOT NULL DEFAULT '{}',
+	body BYTEA,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, key)
+);
+
+CREATE INDEX IF NOT EXISTS completions_task_id_completed_at_idx ON completions (task_id, completed_at);
+CREATE INDEX IF NOT EXISTS magic_links_token_idx ON magic_links (token);
+CREATE INDEX IF NOT EXISTS sessions_token_idx ON sessions (token);
+CREATE INDEX IF NOT EXISTS sessions_created_at_idx ON sessions (created_at);
+CREATE INDEX IF NOT EXISTS users_username_idx ON users (username);
+CREATE INDEX IF NOT EXISTS idempotency_keys_created_at_idx ON idempotency_keys (created_at);
+`,
+	},
+	{
+		version: 2,
+		name:    "reminders",
+		sql: `
+ALTER TABLE users ADD COLUMN timezone VARCHAR(64) NOT NULL DEFAULT 'UTC';
+
+CREATE TABLE task_reminders (
+	task_id INT PRIMARY KEY,
+	enabled BOOLEAN NOT NULL DEFAULT TRUE,
+	lead_minutes INT NOT NULL,
+	quiet_hours_start INT,
+	quiet_hours_end INT
+);
+
+CREATE TABLE reminders (
+	id SERIAL PRIMARY KEY,
+	task_id INT NOT NULL,
+	user_id INT NOT NULL,
+	interval_start TIMESTAMP WITH TIME ZONE NOT NULL,
+	channel VARCHAR(64) NOT NULL,
+	sent_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (task_id, interval_start, channel)
+);
+`,
+	},
+	{
+		version: 3,
+		name:    "webhooks",
+		sql: `
+CREATE TABLE webhooks (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	url TEXT NOT NULL,
+	secret VARCHAR(64) NOT NULL,
+	events TEXT[] NOT NULL,
+	active BOOLEAN NOT NULL DEFAULT TRUE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX webhooks_user_id_idx ON webhooks (user_id);
+
+CREATE TABLE webhook_deliveries (
+	id SERIAL PRIMARY KEY,
+	webhook_id INT NOT NULL,
+	event VARCHAR(64) NOT NULL,
+	event_key VARCHAR(255) NOT NULL,
+	payload JSONB NOT NULL,
+	status VARCHAR(16) NOT NULL DEFAULT 'pending',
+	attempts INT NOT NULL DEFAULT 0,
+	next_attempt_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT CURRENT_TIMESTAMP,
+	last_status_code INT,
+	last_error TEXT,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	delivered_at TIMESTAMP WITH TIME ZONE,
+	UNIQUE (webhook_id, event_key)
+);
+
+CREATE INDEX webhook_deliveries_due_idx ON webhook_deliveries (next_attempt_at) WHERE status = 'pending';
+`,
+	},
+	{
+		version: 4,
+		name:    "push subscriptions",
+		sql: `
+CREATE TABLE push_subscriptions (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	endpoint TEXT NOT NULL UNIQUE,
+	p256dh VARCHAR(255) NOT NULL,
+	auth VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX push_subscriptions_user_id_idx ON push_subscriptions (user_id);
+`,
+	},
+	{
+		version: 5,
+		name:    "email",
+		sql: `
+ALTER TABLE users
+	ADD COLUMN email VARCHAR(255),
+	ADD COLUMN email_verified_at TIMESTAMP WITH TIME ZONE,
+	ADD COLUMN weekly_digest BOOLEAN NOT NULL DEFAULT TRUE;
+
+CREATE TABLE email_verifications (
+	token VARCHAR(64) PRIMARY KEY,
+	user_id INT NOT NULL,
+	email VARCHAR(255) NOT NULL,
+	expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE digests (
+	user_id INT NOT NULL,
+	week_start TIMESTAMP WITH TIME ZONE NOT NULL,
+	sent_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	PRIMARY KEY (user_id, week_start)
+);
+`,
+	},
+	{
+		version: 6,
+		name:    "calendar feeds",
+		sql: `
+CREATE TABLE calendar_feeds (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL,
+	token VARCHAR(64) NOT NULL UNIQUE,
+	last_used_at TIMESTAMP WITH TIME ZONE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX calendar_feeds_user_id_idx ON calendar_feeds (user_id);
+`,
+	},
+	{
+		version: 7,
+		name:    "admin",
+		sql: `
+ALTER TABLE users
+	ADD COLUMN is_admin BOOLEAN NOT NULL DEFAULT FALSE,
+	ADD COLUMN disabled_at TIMESTAMP WITH TIME ZONE;
+`,
+	},
+	{
+		version: 8,
+		name:    "foreign keys",
+		sql: `
+-- Rows orphaned before the keys existed would fail them, so they go first,
+-- parents before children so that the children of orphans go too.
+DELETE FROM tasks WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM completions WHERE task_id NOT IN (SELECT id FROM tasks);
+DELETE FROM task_reminders WHERE task_id NOT IN (SELECT id FROM tasks);
+DELETE FROM reminders WHERE task_id NOT IN (SELECT id FROM tasks) OR user_id NOT IN (SELECT id FROM users);
+DELETE FROM magic_links WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM sessions WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM idempotency_keys WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM webhooks WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM webhook_deliveries WHERE webhook_id NOT IN (SELECT id FROM webhooks);
+DELETE FROM push_subscriptions WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM email_verifications WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM digests WHERE user_id NOT IN (SELECT id FROM users);
+DELETE FROM calendar_feeds WHERE user_id NOT IN (SELECT id FROM users);
+
+ALTER TABLE tasks ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE completions ADD FOREIGN KEY (task_id) REFERENCES tasks (id) ON DELETE CASCADE;
+ALTER TABLE task_reminders ADD FOREIGN KEY (task_id) REFERENCES tasks (id) ON DELETE CASCADE;
+ALTER TABLE reminders
+	ADD FOREIGN KEY (task_id) REFERENCES tasks (id) ON DELETE CASCADE,
+	ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE magic_links ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE sessions ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE idempotency_keys ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE webhooks ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE webhook_deliveries ADD FOREIGN KEY (webhook_id) REFERENCES webhooks (id) ON DELETE CASCADE;
+ALTER TABLE push_subscriptions ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE email_verifications ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE digests ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+ALTER TABLE calendar_feeds ADD FOREIGN KEY (user_id) REFERENCES users (id) ON DELETE CASCADE;
+
+-- Cascading deletes look rows up by these columns.
+CREATE INDEX tasks_user_id_idx ON tasks (user_id);
+CREATE INDEX reminders_user_id_idx ON reminders (user_id);
+CREATE INDEX magic_links_user_id_idx ON magic_links (user_id);
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+CREATE INDEX email_verifications_user_id_idx ON email_verifications (user_id);
+`,
+	},
+	{
+		version: 9,
+		name:    "archiving and pausing",
+		sql: `
+ALTER TABLE tasks ADD COLUMN archived_at TIMESTAMP WITH TIME ZONE;
+
+CREATE TABLE task_pauses (
+	id SERIAL PRIMARY KEY,
+	task_id INT NOT NULL REFERENCES tasks (id) ON DELETE CASCADE,
+	starts_on DATE NOT NULL,
+	ends_on DATE,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	CHECK (ends_on >= starts_on)
+);
+
+CREATE INDEX task_pauses_task_id_idx ON task_pauses (task_id);
+`,
+	},
+	{
+		version: 10,
+		name:    "ordering and groups",
+		sql: `
+CREATE TABLE task_groups (
+	id SERIAL PRIMARY KEY,
+	user_id INT NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	name VARCHAR(255) NOT NULL,
+	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
+	UNIQUE (user_id, name)
+);
+
+ALTER TABLE tasks ADD COLUMN position INT NOT NULL DEFAULT 0;
+ALTER TABLE tasks ADD COLUMN group_id INT REFERENCES task_groups (id) ON DELETE SET NULL;
+
+-- Existing tasks keep the order they were created in.
+UPDATE tasks t
+SET position = o.position
+FROM (
+	SELECT id, row_number() OVER (PARTITION BY user_id ORDER BY id) AS position
+	FROM tasks
+) o
+WHERE o.id = t.id;
+
+CREATE INDEX tasks_group_id_idx ON tasks (group_id);
+`,
+	},
+	{
+		version: 11,
+		name:    "webhook response bodies",
+		sql: `
+-- Failed deliveries used to keep the start of the response body, which
+-- users could read back from the delivery log.
+UPDATE webhook_deliveries
+SET last_error = NULL
+WHERE last_status_code IS NOT NULL;
+`,
+	},
+	{
+		version: 12,
+		name:    "idempotency request hashes",
+		sql: `
+-- Keys claimed before this are forgotten rather than compared against a
+-- hash they never had.
+DELETE FROM idempotency_keys;
+
+ALTER TABLE idempotency_keys ADD COLUMN request_hash CHAR(64) NOT NULL;
+`,
+	},
+}
+
+// schemaVersion is the version the database is at once every migration has
+// been applied.
+func schemaVersion() int {
+	return migrations[len(migrations)-1].version
+}
+
+// migrate applies every migration newer than the database's current version,
+// each in its own transaction.
+func migrate(ctx context.Context, conn *pgxpool.Pool) error {
+	_, err := conn.Exec(ctx, `
+CREATE TABLE if not exists schema_migrations (
+	version INT PRIMARY KEY,
+	name VARCHAR(255) NOT NULL,
+	applied_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
+);`)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range migrations {
+		if err := applyMigration(ctx, conn, m); err != nil {
+			return fmt.Errorf("migration %d (%s): %w", m.version, m.name, err)
+		}
+	}
+
+	return nil
+}
+
+func applyMigration(ctx context.Context, conn *pgxpool.Pool, m migration) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock($1)`, migrationLockID); err != nil {
+			return err
+		}
+
+		var applied bool
+		err := tx.QueryRow(ctx, `
+SELECT EXISTS (
+	SELECT 1
+	FROM schema_migrations
+	WHERE version = $1
+)`, m.version).Scan(&applied)
+		if err != nil {
+			return err
+		}
+		if applied {
+			return nil
+		}
+
+		if _, err := tx.Exec(ctx, m.sql); err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+INSERT INTO schema_migrations (version, name)
+VALUES ($1, $2)`, m.version, m.name)
+		if err != nil {
+			return err
+		}
+
+		logger.Info("Applied migration", "version", m.version, "name", m.name)
+		return nil
+	})
+}
+
+// currentSchemaVersion returns the newest migration applied to the database,
+// or 0 if none have been.
+func currentSchemaVersion(ctx context.Context, conn *pgxpool.Pool) (int, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, err
+	}
+
+	var version int
+	err = conn.QueryRow(ctx, `
+SELECT COALESCE(MAX(version), 0)
+FROM schema_migrations`).Scan(&version)
+	return version, err
+}
+
+// checkSchemaVersion returns an error unless every migration has been
+// applied to the database.
+func checkSchemaVersion(ctx context.Context, conn *pgxpool.Pool) error {
+	version, err := currentSchemaVersion(ctx, conn)
+	if err != nil {
+		return err
+	}
+	if version != schemaVersion() {
+		return fmt.Errorf("schema is at version %d, expected %d", version, schemaVersion())
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	_ "embed"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+//go:embed openapi.json
+var openAPISpec []byte
+
+type openAPIDocument struct {
+	Paths map[string]map[string]json.RawMessage `json:"paths"`
+}
+
+func handleOpenAPI() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		if _, err := w.Write(openAPISpec); err != nil {
+			loggerFrom(r.Context()).Error("Unable to write OpenAPI document", "error", err.Error())
+		}
+	}
+}
+
+// checkOpenAPI returns an error naming every route in patterns that is not
+// documented in spec. Patterns without a method, such as the static file
+// server, are not part of the API and are skipped.
+func checkOpenAPI(spec []byte, patterns []string) error {
+	var doc openAPIDocument
+	if err := json.Unmarshal(spec, &doc); err != nil {
+		return fmt.Errorf("unable to parse OpenAPI document: %w", err)
+	}
+
+	var missing []string
+	for _, pattern := range patterns {
+		method, path, ok := strings.Cut(pattern, " ")
+		if !ok {
+			continue
+		}
+
+		if _, ok := doc.Paths[path][strings.ToLower(method)]; !ok {
+			missing = append(missing, pattern)
+		}
+	}
+
+	if len(missing) > 0 {
+		return fmt.Errorf("routes missing from OpenAPI document: %s", strings.Join(missing, ", "))
+	}
+
+	return nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestOpenAPIDocumentsEveryRoute(t *testing.T) {
+	var ready atomic.Bool
+	mux := routes(defaultConfig(), nil, &ready)
+
+	if err := checkOpenAPI(openAPISpec, mux.patterns); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestCheckOpenAPIReportsMissingRoutes(t *testing.T) {
+	spec := []byte(`{"paths": {"/api/tasks": {"get": {}}}}`)
+
+	if err := checkOpenAPI(spec, []string{"GET /api/tasks", "/"}); err != nil {
+		t.Fatalf("documented routes reported as missing: %v", err)
+	}
+	if err := checkOpenAPI(spec, []string{"POST /api/tasks"}); err == nil {
+		t.Fatal("an undocumented route was not reported")
+	}
+}
+
+// TestOpenAPIIdempotencyKeys checks that every authenticated route that
+// changes something documents the Idempotency-Key header, which routes wraps
+// them all with.
+func TestOpenAPIIdempotencyKeys(t *testing.T) {
+	type parameter struct {
+		Ref string `json:"$ref"`
+	}
+	var doc struct {
+		Paths map[string]map[string]struct {
+			Security   []map[string]any `json:"security"`
+			Parameters []parameter      `json:"parameters"`
+		} `json:"paths"`
+	}
+	if err := json.Unmarshal(openAPISpec, &doc); err != nil {
+		t.Fatal(err)
+	}
+
+	key := parameter{Ref: "#/components/parameters/IdempotencyKey"}
+	for path, ops := range doc.Paths {
+		for method, op := range ops {
+			if method != "get" && len(op.Security) > 0 && !slices.Contains(op.Parameters, key) {
+				t.Errorf("%s %s does not document the Idempotency-Key header", strings.ToUpper(method), path)
+			}
+		}
+	}
+}
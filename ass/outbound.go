@@ -0,0 +1,77 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errPrivateAddress is returned when a request to a user supplied URL would
+// connect to an address that is not public.
+var errPrivateAddress = errors.New("connections to loopback, private, link-local and unspecified addresses are not allowed")
+
+// publicAddr reports whether ip may be reached by requests to user supplied
+// URLs. Anything that could reach the server itself or its network is
+// refused.
+func publicAddr(ip netip.Addr) bool {
+	ip = ip.Unmap()
+	return ip.IsValid() &&
+		!ip.IsLoopback() &&
+		!ip.IsPrivate() &&
+		!ip.IsLinkLocalUnicast() &&
+		!ip.IsLinkLocalMulticast() &&
+		!ip.IsInterfaceLocalMulticast() &&
+		!ip.IsUnspecified()
+}
+
+// dialPublic is a net.Dialer Control hook that refuses connections to
+// addresses publicAddr rejects. It runs on the resolved address of every
+// connection, redirects included, so a public name that resolves to a
+// private address is caught as well.
+func dialPublic(_, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+	ip, err := netip.ParseAddr(host)
+	if err != nil {
+		return err
+	}
+	if !publicAddr(ip) {
+		return errPrivateAddress
+	}
+	return nil
+}
+
+// newOutboundClient returns a client for requests to URLs users give us,
+// such as webhooks and push endpoints, which may only reach public
+// addresses. Proxies are not used, as the check would apply to the proxy
+// rather than to the URL.
+func newOutboundClient(timeout time.Duration) *http.Client {
+	dialer := &net.Dialer{Timeout: timeout, Control: dialPublic}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+
+	return &http.Client{Timeout: timeout, Transport: transport}
+}
+
+// privateHost reports whether the host of u is obviously not public: an IP
+// literal publicAddr rejects or localhost. Names are only checked when they
+// are dialed, but this lets validation reject the obvious cases up front.
+func privateHost(u *url.URL) bool {
+	host := strings.TrimSuffix(strings.ToLower(u.Hostname()), ".")
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return true
+	}
+	if ip, err := netip.ParseAddr(host); err == nil {
+		return !publicAddr(ip)
+	}
+	return false
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"testing"
+	"time"
+)
+
+func TestPublicAddr(t *testing.T) {
+	for addr, want := range map[string]bool{
+		"93.184.216.34":      true,
+		"2606:4700::1111":    true,
+		"127.0.0.1":          false,
+		"::1":                false,
+		"10.1.2.3":           false,
+		"172.16.0.1":         false,
+		"192.168.1.1":        false,
+		"169.254.169.254":    false,
+		"fe80::1":            false,
+		"fd00::1":            false,
+		"0.0.0.0":            false,
+		"::":                 false,
+		"::ffff:127.0.0.1":   false,
+		"::ffff:10.0.0.1":    false,
+		"::ffff:93.184.2.34": true,
+	} {
+		if got := publicAddr(netip.MustParseAddr(addr)); got != want {
+			t.Errorf("publicAddr(%s) = %t, want %t", addr, got, want)
+		}
+	}
+}
+
+func TestPrivateHost(t *testing.T) {
+	for raw, want := range map[string]bool{
+		"https://example.com/hook":           false,
+		"http://localhost:8080/":             true,
+		"http://LOCALHOST./":                 true,
+		"http://api.localhost/":              true,
+		"http://127.0.0.1/":                  true,
+		"http://[::1]:9000/":                 true,
+		"http://169.254.169.254/latest/meta": true,
+		"http://10.0.0.5/":                   true,
+		"https://93.184.216.34/":             false,
+	} {
+		u, err := url.Parse(raw)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := privateHost(u); got != want {
+			t.Errorf("privateHost(%s) = %t, want %t", raw, got, want)
+		}
+	}
+}
+
+func TestOutboundClientRefusesLoopback(t *testing.T) {
+	called := false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		called = true
+	}))
+	defer srv.Close()
+
+	_, err := newOutboundClient(time.Second).Get(srv.URL)
+	if !errors.Is(err, errPrivateAddress) {
+		t.Fatalf("err = %v, want %v", err, errPrivateAddress)
+	}
+	if called {
+		t.Fatal("the loopback server was reached")
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// TaskPause is a range of days, in the user's time zone, when a task is
+// paused. Intervals that overlap a pause are skipped: they neither break nor
+// extend a streak and are never reported as missed, though a completion in
+// one still counts.
+type TaskPause struct {
+	ID       int
+	TaskID   int
+	StartsOn time.Time
+	// EndsOn is the last paused day, or nil while the task is paused until
+	// it is resumed.
+	EndsOn    *time.Time
+	CreatedAt time.Time
+}
+
+type TaskPauseResponse struct {
+	ID        int       `json:"id"`
+	StartsOn  string    `json:"starts_on"`
+	EndsOn    *string   `json:"ends_on"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+func newTaskPauseResponse(p *TaskPause) TaskPauseResponse {
+	resp := TaskPauseResponse{
+		ID:        p.ID,
+		StartsOn:  p.StartsOn.Format(time.DateOnly),
+		CreatedAt: p.CreatedAt,
+	}
+	if p.EndsOn != nil {
+		endsOn := p.EndsOn.Format(time.DateOnly)
+		resp.EndsOn = &endsOn
+	}
+	return resp
+}
+
+// bounds returns when the pause starts and ends in loc. A pause without an
+// end ends at the zero time.
+func (p *TaskPause) bounds(loc *time.Location) (time.Time, time.Time) {
+	y, m, d := p.StartsOn.Date()
+	start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+	if p.EndsOn == nil {
+		return start, time.Time{}
+	}
+
+	y, m, d = p.EndsOn.Date()
+	return start, time.Date(y, m, d+1, 0, 0, 0, 0, loc)
+}
+
+// paused reports whether any of pauses overlaps [start, end) in loc.
+func paused(pauses []*TaskPause, loc *time.Location, start, end time.Time) bool {
+	for _, p := range pauses {
+		ps, pe := p.bounds(loc)
+		if ps.Before(end) && (pe.IsZero() || pe.After(start)) {
+			return true
+		}
+	}
+	return false
+}
+
+type TaskPauseRequest struct {
+	StartsOn string  `json:"starts_on"`
+	EndsOn   *string `json:"ends_on"`
+}
+
+// today returns the day of now in loc as midnight UTC, which is how dates
+// are read from and written to the database.
+func today(now time.Time, loc *time.Location) time.Time {
+	y, m, d := now.In(loc).Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func handleGetTaskPauses(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		pauses, err := getTaskPauses(r.Context(), conn, task.ID)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get pauses")
+			return
+		}
+
+		responses := make([]TaskPauseResponse, len(pauses))
+		for i, p := range pauses {
+			responses[i] = newTaskPauseResponse(p)
+		}
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+// handleCreateTaskPause pauses the task over a range of days, such as a
+// planned holiday.
+func handleCreateTaskPause(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		var body TaskPauseRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		p, fe := validateTaskPause(task, body)
+		if len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		if err := insertTaskPause(r.Context(), conn, p); err != nil {
+			writeStoreError(w, r, err, "Unable to insert pause")
+			return
+		}
+
+		writeJSON(w, http.StatusCreated, newTaskPauseResponse(p))
+	}
+}
+
+func handleDeleteTaskPause(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		pauseID, err := strconv.Atoi(r.PathValue("pauseId"))
+		if err != nil {
+			writeFieldErrors(w, FieldErrors{"pause_id": "pause_id must be an integer"})
+			return
+		}
+
+		if err := deleteTaskPause(r.Context(), conn, task.ID, pauseID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete pause")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
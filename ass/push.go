@@ -0,0 +1,428 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// pushRecordSize is the record size of the aes128gcm encoding. Payloads
+	// are sent as a single record, so it bounds the payload size.
+	pushRecordSize = 4096
+	// pushHeaderSize is the size of the aes128gcm header: a 16 byte salt,
+	// the 4 byte record size, the 1 byte key id length and the 65 byte key.
+	pushHeaderSize = 16 + 4 + 1 + 65
+	// maxPushPayload leaves room for the header, the GCM tag and the
+	// padding delimiter.
+	maxPushPayload = pushRecordSize - pushHeaderSize - 16 - 1
+	// vapidExpiry is how long a VAPID token is valid; push services reject
+	// tokens valid for more than 24 hours.
+	vapidExpiry = 12 * time.Hour
+	// pushTimeout bounds each request to a push service.
+	pushTimeout = 10 * time.Second
+	// maxResponseError is how much of a push service's error response is
+	// logged.
+	maxResponseError = 512
+)
+
+// errPushSubscriptionGone is returned when the push service reports that the
+// subscription has expired or was unsubscribed.
+var errPushSubscriptionGone = errors.New("push subscription is gone")
+
+// PushSubscription is where the push service of a browser accepts messages
+// for it, with the keys used to encrypt them.
+type PushSubscription struct {
+	ID        int
+	UserID    int
+	Endpoint  string
+	P256dh    string
+	Auth      string
+	CreatedAt time.Time
+}
+
+// PushSubscriptionRequest is the JSON form of a browser PushSubscription.
+type PushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+type DeletePushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+}
+
+type PushKeyResponse struct {
+	PublicKey string `json:"public_key"`
+}
+
+// PushMessage is the payload shown by the service worker.
+type PushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	Tag   string `json:"tag"`
+}
+
+// vapidKey is the application server key pair that identifies this server to
+// push services (RFC 8292).
+type vapidKey struct {
+	private *ecdsa.PrivateKey
+	// public is the uncompressed public key, base64url encoded without
+	// padding as browsers expect for applicationServerKey.
+	public  string
+	subject string
+}
+
+// parseVAPIDKey parses a base64url encoded P-256 private key as written by
+// -generate-vapid-key.
+func parseVAPIDKey(privateKey, subject string) (*vapidKey, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(privateKey, "="))
+	if err != nil {
+		return nil, fmt.Errorf("vapid_private_key must be base64url encoded: %w", err)
+	}
+
+	key, err := ecdh.P256().NewPrivateKey(raw)
+	if err != nil {
+		return nil, fmt.Errorf("vapid_private_key must be a P-256 private key: %w", err)
+	}
+	pub := key.PublicKey().Bytes()
+
+	return &vapidKey{
+		private: &ecdsa.PrivateKey{
+			PublicKey: ecdsa.PublicKey{
+				Curve: elliptic.P256(),
+				X:     new(big.Int).SetBytes(pub[1:33]),
+				Y:     new(big.Int).SetBytes(pub[33:]),
+			},
+			D: new(big.Int).SetBytes(raw),
+		},
+		public:  base64.RawURLEncoding.EncodeToString(pub),
+		subject: subject,
+	}, nil
+}
+
+// generateVAPIDKey returns a new base64url encoded private key for
+// vapid_private_key.
+func generateVAPIDKey() (string, error) {
+	key, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key.Bytes()), nil
+}
+
+// authorization returns the Authorization header for a request to endpoint,
+// signing a JWT for the endpoint's origin with ES256.
+func (k *vapidKey) authorization(endpoint string, now time.Time) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+
+	header, err := json.Marshal(map[string]string{"typ": "JWT", "alg": "ES256"})
+	if err != nil {
+		return "", err
+	}
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": now.Add(vapidExpiry).Unix(),
+		"sub": k.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	unsigned := base64.RawURLEncoding.EncodeToString(header) + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// JWS encodes the signature as the fixed size concatenation of r and s.
+	sig := make([]byte, 64)
+	r.FillBytes(sig[:32])
+	s.FillBytes(sig[32:])
+
+	token := unsigned + "." + base64.RawURLEncoding.EncodeToString(sig)
+	return fmt.Sprintf("vapid t=%s, k=%s", token, k.public), nil
+}
+
+// encryptPush encrypts payload for the subscription as described by RFC 8291,
+// returning the aes128gcm encoded body (RFC 8188).
+func encryptPush(sub *PushSubscription, payload []byte) ([]byte, error) {
+	asKey, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	return sealPush(sub, payload, asKey, salt)
+}
+
+// sealPush does the work of encryptPush with the given application server
+// key and salt, which must be new for every message.
+func sealPush(sub *PushSubscription, payload []byte, asKey *ecdh.PrivateKey, salt []byte) ([]byte, error) {
+	if len(payload) > maxPushPayload {
+		return nil, fmt.Errorf("push payload is %d bytes, over the %d byte limit", len(payload), maxPushPayload)
+	}
+
+	uaPublic, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.P256dh, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(sub.Auth, "="))
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth secret: %w", err)
+	}
+
+	uaKey, err := ecdh.P256().NewPublicKey(uaPublic)
+	if err != nil {
+		return nil, fmt.Errorf("invalid p256dh key: %w", err)
+	}
+
+	asPublic := asKey.PublicKey().Bytes()
+
+	ecdhSecret, err := asKey.ECDH(uaKey)
+	if err != nil {
+		return nil, err
+	}
+
+	// The input keying material combines the shared secret with the auth
+	// secret and both public keys.
+	keyInfo := append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ecdhSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+
+	prk := hkdf.Extract(sha256.New, ikm, salt)
+	cek := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: aes128gcm\x00")), cek); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.Expand(sha256.New, prk, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	body := make([]byte, pushHeaderSize, pushHeaderSize+len(payload)+1+gcm.Overhead())
+	copy(body, salt)
+	binary.BigEndian.PutUint32(body[16:], pushRecordSize)
+	body[20] = byte(len(asPublic))
+	copy(body[21:], asPublic)
+
+	// 0x02 marks the last (and only) record.
+	plaintext := append(append([]byte{}, payload...), 0x02)
+	return gcm.Seal(body, nonce, plaintext, nil), nil
+}
+
+// pushSender sends encrypted messages to push services.
+type pushSender struct {
+	key    *vapidKey
+	client *http.Client
+}
+
+// send delivers payload to the subscription. The push service drops the
+// message if it cannot be delivered within ttl.
+func (ps *pushSender) send(ctx context.Context, sub *PushSubscription, payload []byte, ttl time.Duration) error {
+	body, err := encryptPush(sub, payload)
+	if err != nil {
+		return err
+	}
+
+	auth, err := ps.key.authorization(sub.Endpoint, time.Now())
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, sub.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", auth)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("TTL", strconv.Itoa(max(int(ttl.Seconds()), 0)))
+	req.Header.Set("Urgency", "high")
+
+	res, err := ps.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusNotFound || res.StatusCode == http.StatusGone:
+		return errPushSubscriptionGone
+	case res.StatusCode < 200 || res.StatusCode > 299:
+		msg, _ := io.ReadAll(io.LimitReader(res.Body, maxResponseError))
+		return fmt.Errorf("push service responded %d: %s", res.StatusCode, bytes.TrimSpace(msg))
+	}
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	return nil
+}
+
+// pushNotifier sends reminders to every browser the user subscribed.
+type pushNotifier struct {
+	conn   *pgxpool.Pool
+	sender *pushSender
+}
+
+func (pushNotifier) Name() string {
+	return "push"
+}
+
+// Notify sends the reminder to each subscription, removing those the push
+// service no longer accepts. It only fails if no subscription received the
+// reminder, so that a retry does not notify the others twice.
+func (pn pushNotifier) Notify(ctx context.Context, r Reminder) error {
+	subs, err := getPushSubscriptions(ctx, pn.conn, r.User.ID)
+	if err != nil {
+		return err
+	}
+
+	payload, err := json.Marshal(PushMessage{
+		Title: r.Task.Name,
+		Body:  fmt.Sprintf("Due by %s", r.IntervalEnd.Format(time.Kitchen)),
+		URL:   "/",
+		Tag:   fmt.Sprintf("task-%d", r.Task.ID),
+	})
+	if err != nil {
+		return err
+	}
+
+	var errs []error
+	sent := false
+	for _, sub := range subs {
+		err := pn.sender.send(ctx, sub, payload, time.Until(r.IntervalEnd))
+		switch {
+		case err == nil:
+			sent = true
+		case errors.Is(err, errPushSubscriptionGone):
+			if err := deletePushSubscription(ctx, pn.conn, sub.UserID, sub.Endpoint); err != nil {
+				errs = append(errs, err)
+			}
+		default:
+			errs = append(errs, err)
+		}
+	}
+
+	if sent {
+		return nil
+	}
+	return errors.Join(errs...)
+}
+
+// handleGetPushKey returns the public key browsers need to subscribe.
+func handleGetPushKey(key *vapidKey) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if key == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, "push notifications are not configured")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, PushKeyResponse{PublicKey: key.public})
+	}
+}
+
+// handleCreatePushSubscription saves the subscription of a browser. Saving a
+// subscription again moves it to the current user.
+func handleCreatePushSubscription(key *vapidKey, conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		if key == nil {
+			writeError(w, http.StatusNotFound, CodeNotFound, "push notifications are not configured")
+			return
+		}
+
+		var body PushSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if fe := validatePushSubscription(body); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		sub := &PushSubscription{
+			UserID:   user.ID,
+			Endpoint: body.Endpoint,
+			P256dh:   body.Keys.P256dh,
+			Auth:     body.Keys.Auth,
+		}
+		if err := upsertPushSubscription(r.Context(), conn, sub); err != nil {
+			writeStoreError(w, r, err, "Unable to save push subscription")
+			return
+		}
+
+		w.WriteHeader(http.StatusCreated)
+	}
+}
+
+func handleDeletePushSubscription(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body DeletePushSubscriptionRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if body.Endpoint == "" {
+			writeFieldErrors(w, FieldErrors{"endpoint": "endpoint is required"})
+			return
+		}
+
+		if err := deletePushSubscription(r.Context(), conn, user.ID, body.Endpoint); err != nil {
+			writeStoreError(w, r, err, "Unable to delete push subscription")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/hkdf"
+)
+
+// The example from RFC 8291, Appendix A.
+const (
+	rfc8291Plaintext = "When I grow up, I want to be a watermelon"
+	rfc8291ASPrivate = "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"
+	rfc8291UAPrivate = "q1dXpw3UpT5VOmu_cf_v6ih07Aems3njxI-JWgLcM94"
+	rfc8291UAPublic  = "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"
+	rfc8291Salt      = "DGv6ra1nlYgDCS1FRnbzlw"
+	rfc8291Auth      = "BTBZMqHH6r4Tts7J_aSIgg"
+	rfc8291Body      = "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN"
+)
+
+func testBase64(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func testPushSubscription() *PushSubscription {
+	return &PushSubscription{P256dh: rfc8291UAPublic, Auth: rfc8291Auth}
+}
+
+// decryptPush decrypts an aes128gcm body the way the user agent holding
+// uaPrivate and auth does.
+func decryptPush(t *testing.T, body []byte, uaPrivate *ecdh.PrivateKey, auth []byte) []byte {
+	t.Helper()
+	if len(body) < pushHeaderSize {
+		t.Fatalf("body is %d bytes, shorter than the header", len(body))
+	}
+	salt, rs, idlen := body[:16], binary.BigEndian.Uint32(body[16:20]), int(body[20])
+	if rs != pushRecordSize || idlen != 65 {
+		t.Fatalf("got record size %d and key id length %d", rs, idlen)
+	}
+	asPublic, record := body[21:21+idlen], body[21+idlen:]
+
+	asKey, err := ecdh.P256().NewPublicKey(asPublic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ecdhSecret, err := uaPrivate.ECDH(asKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expand := func(secret, salt, info []byte, n int) []byte {
+		out := make([]byte, n)
+		if _, err := io.ReadFull(hkdf.New(sha256.New, secret, salt, info), out); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+	uaPublic := uaPrivate.PublicKey().Bytes()
+	ikm := expand(ecdhSecret, auth, append(append([]byte("WebPush: info\x00"), uaPublic...), asPublic...), 32)
+	cek := expand(ikm, salt, []byte("Content-Encoding: aes128gcm\x00"), 16)
+	nonce := expand(ikm, salt, []byte("Content-Encoding: nonce\x00"), 12)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plaintext, err := gcm.Open(nil, nonce, record, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The last record ends with a 0x02 delimiter followed by any padding.
+	plaintext = bytes.TrimRight(plaintext, "\x00")
+	if len(plaintext) == 0 || plaintext[len(plaintext)-1] != 0x02 {
+		t.Fatal("record does not end with the last record delimiter")
+	}
+	return plaintext[:len(plaintext)-1]
+}
+
+func testUAKey(t *testing.T) *ecdh.PrivateKey {
+	t.Helper()
+	key, err := ecdh.P256().NewPrivateKey(testBase64(t, rfc8291UAPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func TestSealPushRFC8291(t *testing.T) {
+	asKey, err := ecdh.P256().NewPrivateKey(testBase64(t, rfc8291ASPrivate))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	body, err := sealPush(testPushSubscription(), []byte(rfc8291Plaintext), asKey, testBase64(t, rfc8291Salt))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := base64.RawURLEncoding.EncodeToString(body); got != rfc8291Body {
+		t.Fatalf("got body\n%s\nwant\n%s", got, rfc8291Body)
+	}
+
+	if got := decryptPush(t, body, testUAKey(t), testBase64(t, rfc8291Auth)); string(got) != rfc8291Plaintext {
+		t.Fatalf("decrypted %q", got)
+	}
+}
+
+func TestEncryptPushRoundTrip(t *testing.T) {
+	payload := []byte(`{"title":"Stretch","body":"Due by 5:00PM"}`)
+
+	body, err := encryptPush(testPushSubscription(), payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptPush(t, body, testUAKey(t), testBase64(t, rfc8291Auth)); !bytes.Equal(got, payload) {
+		t.Fatalf("decrypted %q, want %q", got, payload)
+	}
+
+	if _, err := encryptPush(testPushSubscription(), make([]byte, maxPushPayload+1)); err == nil {
+		t.Fatal("a payload over the limit was encrypted")
+	}
+}
+
+func TestPushSenderSend(t *testing.T) {
+	key, err := generateVAPIDKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	vapid, err := parseVAPIDKey(key, "mailto:admin@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	status := http.StatusCreated
+	var received []byte
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Content-Encoding") != "aes128gcm" || r.Header.Get("TTL") != "60" {
+			t.Errorf("got headers %v", r.Header)
+		}
+		received, _ = io.ReadAll(r.Body)
+		w.WriteHeader(status)
+	}))
+	defer srv.Close()
+
+	// The test server is on loopback, which the outbound client refuses.
+	ps := &pushSender{key: vapid, client: srv.Client()}
+	sub := testPushSubscription()
+	sub.Endpoint = srv.URL
+
+	if err := ps.send(context.Background(), sub, []byte("hello"), time.Minute); err != nil {
+		t.Fatal(err)
+	}
+	if got := decryptPush(t, received, testUAKey(t), testBase64(t, rfc8291Auth)); string(got) != "hello" {
+		t.Fatalf("push service received %q", got)
+	}
+
+	status = http.StatusGone
+	if err := ps.send(context.Background(), sub, []byte("hello"), time.Minute); !errors.Is(err, errPushSubscriptionGone) {
+		t.Fatalf("got %v, want errPushSubscriptionGone", err)
+	}
+}
@@ -0,0 +1,280 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const defaultLeadMinutes = 60
+
+// ReminderSettings controls when reminders are sent for a task. Quiet hours
+// are minutes after midnight in the owner's time zone; reminders due while
+// they are in effect are held back until they end.
+type ReminderSettings struct {
+	TaskID          int
+	Enabled         bool
+	LeadMinutes     int
+	QuietHoursStart *int
+	QuietHoursEnd   *int
+}
+
+type ReminderSettingsRequest struct {
+	Enabled         bool    `json:"enabled"`
+	LeadMinutes     int     `json:"lead_minutes"`
+	QuietHoursStart *string `json:"quiet_hours_start"`
+	QuietHoursEnd   *string `json:"quiet_hours_end"`
+}
+
+type ReminderSettingsResponse struct {
+	Enabled         bool    `json:"enabled"`
+	LeadMinutes     int     `json:"lead_minutes"`
+	QuietHoursStart *string `json:"quiet_hours_start"`
+	QuietHoursEnd   *string `json:"quiet_hours_end"`
+}
+
+// ReminderCandidate is a task with reminders enabled, as loaded by the
+// scheduler.
+type ReminderCandidate struct {
+	Task     *Task
+	User     *User
+	Settings *ReminderSettings
+}
+
+// Reminder tells a user that the current interval of a task is about to close
+// without a completion.
+type Reminder struct {
+	User          *User
+	Task          *Task
+	IntervalStart time.Time
+	IntervalEnd   time.Time
+}
+
+// Notifier delivers reminders over one channel. Name identifies the channel
+// so each reminder is sent at most once per channel.
+type Notifier interface {
+	Name() string
+	Notify(ctx context.Context, r Reminder) error
+}
+
+// logNotifier writes reminders to the log. It is always enabled so reminders
+// are visible even when no other channel is configured.
+type logNotifier struct{}
+
+func (logNotifier) Name() string {
+	return "log"
+}
+
+func (logNotifier) Notify(_ context.Context, r Reminder) error {
+	logger.Info("Task is due",
+		"user_id", r.User.ID,
+		"task_id", r.Task.ID,
+		"task", r.Task.Name,
+		"interval_end", r.IntervalEnd,
+	)
+	return nil
+}
+
+// newNotifiers returns every notifier enabled by cfg.
+func newNotifiers(cfg *Config, conn *pgxpool.Pool) []Notifier {
+	notifiers := []Notifier{logNotifier{}}
+
+	if key := cfg.vapidKey(); key != nil {
+		notifiers = append(notifiers, pushNotifier{
+			conn:   conn,
+			sender: &pushSender{key: key, client: newOutboundClient(pushTimeout)},
+		})
+	}
+
+	if m := newMailer(cfg); m != nil {
+		notifiers = append(notifiers, emailNotifier{mailer: m, publicURL: cfg.PublicURL})
+	}
+
+	return notifiers
+}
+
+func (rs *ReminderSettings) lead() time.Duration {
+	return time.Duration(rs.LeadMinutes) * time.Minute
+}
+
+// inQuietHours reports whether t, in the owner's time zone, falls in the quiet
+// hours. Quiet hours may wrap past midnight.
+func (rs *ReminderSettings) inQuietHours(t time.Time) bool {
+	if rs.QuietHoursStart == nil || rs.QuietHoursEnd == nil {
+		return false
+	}
+
+	start, end := *rs.QuietHoursStart, *rs.QuietHoursEnd
+	minute := t.Hour()*60 + t.Minute()
+
+	if start <= end {
+		return minute >= start && minute < end
+	}
+	return minute >= start || minute < end
+}
+
+// due reports whether a reminder for an interval ending at end may be sent
+// at local: once the lead time before the end has begun and outside quiet
+// hours.
+func (rs *ReminderSettings) due(local, end time.Time) bool {
+	return !local.Before(end.Add(-rs.lead())) && !rs.inQuietHours(local)
+}
+
+func newReminderSettingsResponse(rs *ReminderSettings) ReminderSettingsResponse {
+	resp := ReminderSettingsResponse{
+		Enabled:     rs.Enabled,
+		LeadMinutes: rs.LeadMinutes,
+	}
+	if resp.LeadMinutes == 0 {
+		resp.LeadMinutes = defaultLeadMinutes
+	}
+	if rs.QuietHoursStart != nil && rs.QuietHoursEnd != nil {
+		start := formatMinuteOfDay(*rs.QuietHoursStart)
+		end := formatMinuteOfDay(*rs.QuietHoursEnd)
+		resp.QuietHoursStart = &start
+		resp.QuietHoursEnd = &end
+	}
+	return resp
+}
+
+func formatMinuteOfDay(m int) string {
+	return fmt.Sprintf("%02d:%02d", m/60, m%60)
+}
+
+func parseMinuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, err
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+// runReminders checks for due tasks every cfg.ReminderCheckInterval until ctx
+// is cancelled.
+func runReminders(ctx context.Context, cfg *Config, conn *pgxpool.Pool, notifiers []Notifier) {
+	ticker := time.NewTicker(cfg.ReminderCheckInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := checkReminders(ctx, conn, notifiers, time.Now()); err != nil {
+			logger.Error("Unable to check reminders", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// checkReminders sends a reminder through every notifier for each task whose
+// current interval closes within its lead time and has no completion yet,
+// unless the interval is paused.
+func checkReminders(ctx context.Context, conn *pgxpool.Pool, notifiers []Notifier, now time.Time) error {
+	candidates, err := getReminderCandidates(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		local := now.In(c.User.location())
+		start, end := c.Task.Interval.bounds(local)
+
+		if !c.Settings.due(local, end) {
+			continue
+		}
+
+		done, err := hasCompletionSince(ctx, conn, c.Task.ID, start)
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+
+		pauses, err := getTaskPauses(ctx, conn, c.Task.ID)
+		if err != nil {
+			return err
+		}
+		if paused(pauses, local.Location(), start, end) {
+			continue
+		}
+
+		reminder := Reminder{
+			User:          c.User,
+			Task:          c.Task,
+			IntervalStart: start,
+			IntervalEnd:   end,
+		}
+
+		for _, n := range notifiers {
+			claimed, err := claimReminder(ctx, conn, c.Task.ID, c.User.ID, start, n.Name())
+			if err != nil {
+				return err
+			}
+			if !claimed {
+				continue
+			}
+
+			if err := n.Notify(ctx, reminder); err != nil {
+				logger.Error("Unable to send reminder", "notifier", n.Name(), "task_id", c.Task.ID, "error", err.Error())
+				if err := releaseReminder(ctx, conn, c.Task.ID, start, n.Name()); err != nil {
+					logger.Error("Unable to release reminder", "notifier", n.Name(), "task_id", c.Task.ID, "error", err.Error())
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func handleGetReminderSettings(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		rs, err := getReminderSettings(r.Context(), conn, task.ID)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get reminder settings")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newReminderSettingsResponse(rs))
+	}
+}
+
+func handlePutReminderSettings(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		task, ok := taskFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		var body ReminderSettingsRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		rs, fe := validateReminderSettings(task, body)
+		if len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		if err := upsertReminderSettings(r.Context(), conn, rs); err != nil {
+			writeStoreError(w, r, err, "Unable to save reminder settings")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newReminderSettingsResponse(rs))
+	}
+}
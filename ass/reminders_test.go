@@ -0,0 +1,115 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestInQuietHours(t *testing.T) {
+	minutes := func(value string) *int {
+		m, err := parseMinuteOfDay(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return &m
+	}
+
+	tests := []struct {
+		name       string
+		start, end *int
+		at         string
+		want       bool
+	}{
+		{"no quiet hours", nil, nil, "03:00", false},
+		{"only a start", minutes("22:00"), nil, "23:00", false},
+
+		{"before daytime hours", minutes("09:00"), minutes("17:00"), "08:59", false},
+		{"at the start of daytime hours", minutes("09:00"), minutes("17:00"), "09:00", true},
+		{"during daytime hours", minutes("09:00"), minutes("17:00"), "12:30", true},
+		{"last minute of daytime hours", minutes("09:00"), minutes("17:00"), "16:59", true},
+		{"at the end of daytime hours", minutes("09:00"), minutes("17:00"), "17:00", false},
+
+		{"before overnight hours", minutes("22:00"), minutes("07:00"), "21:59", false},
+		{"at the start of overnight hours", minutes("22:00"), minutes("07:00"), "22:00", true},
+		{"before midnight", minutes("22:00"), minutes("07:00"), "23:59", true},
+		{"at midnight", minutes("22:00"), minutes("07:00"), "00:00", true},
+		{"last minute of overnight hours", minutes("22:00"), minutes("07:00"), "06:59", true},
+		{"at the end of overnight hours", minutes("22:00"), minutes("07:00"), "07:00", false},
+		{"midday with overnight hours", minutes("22:00"), minutes("07:00"), "12:00", false},
+
+		{"empty quiet hours", minutes("08:00"), minutes("08:00"), "08:00", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rs := &ReminderSettings{QuietHoursStart: tt.start, QuietHoursEnd: tt.end}
+			clock, err := time.Parse("15:04", tt.at)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Seconds within the minute do not matter.
+			at := time.Date(2024, 3, 1, clock.Hour(), clock.Minute(), 59, 0, time.UTC)
+
+			if got := rs.inQuietHours(at); got != tt.want {
+				t.Fatalf("inQuietHours(%s) = %v, want %v", tt.at, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMinuteOfDay(t *testing.T) {
+	for _, value := range []string{"00:00", "07:05", "23:59"} {
+		m, err := parseMinuteOfDay(value)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := formatMinuteOfDay(m); got != value {
+			t.Errorf("%s round-tripped to %s", value, got)
+		}
+	}
+
+	for _, value := range []string{"24:00", "7:5pm", ""} {
+		if _, err := parseMinuteOfDay(value); err == nil {
+			t.Errorf("%q was accepted", value)
+		}
+	}
+}
+
+func TestReminderDue(t *testing.T) {
+	berlin, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, end := Daily.bounds(time.Date(2024, 3, 1, 12, 0, 0, 0, berlin))
+	quietStart, quietEnd := 23*60, 7*60
+
+	tests := []struct {
+		at    string
+		quiet bool
+		want  bool
+	}{
+		{"21:00:00", false, false},
+		{"22:29:59", false, false},
+		{"22:30:00", false, true},
+		{"23:59:00", false, true},
+		// Quiet hours hold back a reminder within the lead time.
+		{"22:30:00", true, true},
+		{"23:00:00", true, false},
+	}
+
+	for _, tt := range tests {
+		rs := &ReminderSettings{LeadMinutes: 90}
+		if tt.quiet {
+			rs.QuietHoursStart, rs.QuietHoursEnd = &quietStart, &quietEnd
+		}
+		clock, err := time.Parse(time.TimeOnly, tt.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		at := time.Date(2024, 3, 1, clock.Hour(), clock.Minute(), clock.Second(), 0, berlin)
+
+		if got := rs.due(at, end); got != tt.want {
+			t.Errorf("due at %s with quiet hours %v = %v, want %v", tt.at, tt.quiet, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,23 @@
+package main
+
+import "net/http"
+
+// router is an http.ServeMux that remembers the patterns registered on it.
+type router struct {
+	*http.ServeMux
+	patterns []string
+}
+
+func newRouter() *router {
+	return &router{ServeMux: http.NewServeMux()}
+}
+
+func (rt *router) Handle(pattern string, h http.Handler) {
+	rt.patterns = append(rt.patterns, pattern)
+	rt.ServeMux.Handle(pattern, h)
+}
+
+func (rt *router) HandleFunc(pattern string, h http.HandlerFunc) {
+	rt.patterns = append(rt.patterns, pattern)
+	rt.ServeMux.HandleFunc(pattern, h)
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCSRF(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.TrustedOrigins = []string{"https://app.example.com"}
+	h := withCSRF(cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	}))
+
+	tests := []struct {
+		name          string
+		method        string
+		cookie        bool
+		authorization string
+		origin        string
+		fetchSite     string
+		want          int
+	}{
+		{"cross-site read", http.MethodGet, true, "", "https://evil.example", "cross-site", http.StatusNoContent},
+		{"cross-site cookie POST", http.MethodPost, true, "", "https://evil.example", "cross-site", http.StatusForbidden},
+		{"cross-site cookie DELETE", http.MethodDelete, true, "", "https://evil.example", "cross-site", http.StatusForbidden},
+		{"same-site cookie POST from another host", http.MethodPost, true, "", "https://other.didt.example.com", "same-site", http.StatusForbidden},
+		{"cookie POST without an origin", http.MethodPost, true, "", "", "", http.StatusForbidden},
+		{"same-origin cookie POST", http.MethodPost, true, "", "", "same-origin", http.StatusNoContent},
+		{"cookie POST typed by the user", http.MethodPost, true, "", "", "none", http.StatusNoContent},
+		{"cookie POST from our own origin", http.MethodPost, true, "", "https://didt.example.com", "", http.StatusNoContent},
+		{"cookie POST from a trusted origin", http.MethodPost, true, "", "https://app.example.com", "cross-site", http.StatusNoContent},
+		{"bearer POST from another origin", http.MethodPost, false, "Bearer didt_token", "https://evil.example", "cross-site", http.StatusNoContent},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, "https://didt.example.com/api/tasks", nil)
+			if tt.cookie {
+				r.AddCookie(&http.Cookie{Name: "session_token", Value: "session"})
+			}
+			if tt.authorization != "" {
+				r.Header.Set("Authorization", tt.authorization)
+			}
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			if tt.fetchSite != "" {
+				r.Header.Set("Sec-Fetch-Site", tt.fetchSite)
+			}
+
+			w := httptest.NewRecorder()
+			h.ServeHTTP(w, r)
+			if w.Code != tt.want {
+				t.Fatalf("got %d, want %d", w.Code, tt.want)
+			}
+
+			if tt.want == http.StatusForbidden {
+				var resp ErrorResponse
+				if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Code != CodeForbidden {
+					t.Errorf("got body %s", w.Body)
+				}
+			}
+		})
+	}
+}
+
+func TestSecurityHeaders(t *testing.T) {
+	for _, env := range []string{"development", "production"} {
+		cfg := defaultConfig()
+		cfg.Env = env
+		h := withSecurityHeaders(cfg, http.NotFoundHandler())
+
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/", nil))
+
+		header := w.Header()
+		if header.Get("Content-Security-Policy") != contentSecurityPolicy || header.Get("X-Frame-Options") != "DENY" || header.Get("X-Content-Type-Options") != "nosniff" {
+			t.Errorf("%s: got headers %v", env, header)
+		}
+		if hsts := header.Get("Strict-Transport-Security") != ""; hsts != cfg.IsProduction() {
+			t.Errorf("%s: Strict-Transport-Security set is %v", env, hsts)
+		}
+	}
+}
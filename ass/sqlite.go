@@ -0,0 +1,358 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// sqliteFile reads tables from an SQLite database file held in memory. It
+// only supports what importing a Loop Habit Tracker backup needs: walking
+// table b-trees and decoding records in a UTF-8 database. Indexes, WAL files
+// and writing are not supported.
+//
+// The file is an upload, so every size and offset read from it is checked
+// against the data before it is used: a corrupt file must fail with an
+// error rather than panic or allocate more than the file holds.
+type sqliteFile struct {
+	data     []byte
+	pageSize int
+	usable   int
+}
+
+const sqliteMagic = "SQLite format 3\x00"
+
+var errNotSQLite = errors.New("file is not an SQLite database")
+
+func openSQLite(data []byte) (*sqliteFile, error) {
+	if len(data) < 100 || string(data[:16]) != sqliteMagic {
+		return nil, errNotSQLite
+	}
+
+	pageSize := int(binary.BigEndian.Uint16(data[16:18]))
+	if pageSize == 1 {
+		pageSize = 65536
+	}
+	if pageSize < 512 || pageSize&(pageSize-1) != 0 {
+		return nil, fmt.Errorf("invalid SQLite page size %d", pageSize)
+	}
+	if encoding := binary.BigEndian.Uint32(data[56:60]); encoding > 1 {
+		return nil, errors.New("only UTF-8 SQLite databases are supported")
+	}
+
+	return &sqliteFile{
+		data:     data,
+		pageSize: pageSize,
+		usable:   pageSize - int(data[20]),
+	}, nil
+}
+
+func (db *sqliteFile) page(n int) ([]byte, error) {
+	start := (n - 1) * db.pageSize
+	if n < 1 || start+db.pageSize > len(db.data) {
+		return nil, fmt.Errorf("SQLite page %d is out of range", n)
+	}
+	return db.data[start : start+db.pageSize], nil
+}
+
+// sqliteRow is one row of a table, keyed by column name. An INTEGER PRIMARY
+// KEY column holds the rowid.
+type sqliteRow map[string]any
+
+// table returns every row of the named table, matched case insensitively.
+func (db *sqliteFile) table(name string) ([]sqliteRow, error) {
+	var root int
+	var columns []string
+	err := db.walk(1, func(rowid int64, values []any) error {
+		if len(values) < 5 {
+			return nil
+		}
+		kind, _ := values[0].(string)
+		tblName, _ := values[1].(string)
+		if kind != "table" || !strings.EqualFold(tblName, name) {
+			return nil
+		}
+		page, _ := values[3].(int64)
+		sql, _ := values[4].(string)
+		root = int(page)
+		columns = sqliteColumns(sql)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if root == 0 {
+		return nil, fmt.Errorf("SQLite database has no %s table", name)
+	}
+
+	rows := []sqliteRow{}
+	err = db.walk(root, func(rowid int64, values []any) error {
+		row := make(sqliteRow, len(columns))
+		for i, column := range columns {
+			var v any
+			if i < len(values) {
+				v = values[i]
+			}
+			// An INTEGER PRIMARY KEY is an alias for the rowid and is
+			// stored as NULL.
+			if v == nil && strings.EqualFold(column, "id") {
+				v = rowid
+			}
+			row[strings.ToLower(column)] = v
+		}
+		rows = append(rows, row)
+		return nil
+	})
+	return rows, err
+}
+
+// walk calls fn with the rowid and values of every record in the table
+// b-tree rooted at page n, in rowid order.
+func (db *sqliteFile) walk(n int, fn func(rowid int64, values []any) error) error {
+	return db.walkPage(n, 0, map[int]bool{}, fn)
+}
+
+// walkPage walks the b-tree below page n. Each page may only be reached
+// once, as a page linked from several places would otherwise be walked an
+// exponential number of times.
+func (db *sqliteFile) walkPage(n, depth int, seen map[int]bool, fn func(rowid int64, values []any) error) error {
+	// A b-tree deeper than this is either corrupt or has a cycle.
+	if depth > 32 {
+		return errors.New("SQLite b-tree is too deep")
+	}
+	if seen[n] {
+		return fmt.Errorf("SQLite page %d is linked more than once", n)
+	}
+	seen[n] = true
+
+	page, err := db.page(n)
+	if err != nil {
+		return err
+	}
+	header := page
+	if n == 1 {
+		header = page[100:]
+	}
+
+	kind := header[0]
+	if kind != 0x05 && kind != 0x0D {
+		return fmt.Errorf("SQLite page %d is not a table page", n)
+	}
+	cells := int(binary.BigEndian.Uint16(header[3:5]))
+	pointers := header[8:]
+	if kind == 0x05 {
+		pointers = header[12:]
+	}
+	if len(pointers) < 2*cells {
+		return fmt.Errorf("SQLite page %d is corrupt", n)
+	}
+
+	for i := 0; i < cells; i++ {
+		offset := int(binary.BigEndian.Uint16(pointers[2*i:]))
+		if offset >= len(page) {
+			return fmt.Errorf("SQLite page %d is corrupt", n)
+		}
+		cell := page[offset:]
+
+		switch kind {
+		case 0x05:
+			if len(cell) < 4 {
+				return fmt.Errorf("SQLite page %d is corrupt", n)
+			}
+			if err := db.walkPage(int(binary.BigEndian.Uint32(cell)), depth+1, seen, fn); err != nil {
+				return err
+			}
+		case 0x0D:
+			size, k := sqliteVarint(cell)
+			rowid, l := sqliteVarint(cell[k:])
+			// No payload can be larger than the file it is stored in.
+			if size < 0 || size > int64(len(db.data)) {
+				return fmt.Errorf("SQLite page %d is corrupt", n)
+			}
+			payload, err := db.payload(cell[k+l:], int(size))
+			if err != nil {
+				return err
+			}
+			values, err := sqliteRecord(payload)
+			if err != nil {
+				return err
+			}
+			if err := fn(rowid, values); err != nil {
+				return err
+			}
+		}
+	}
+
+	if kind == 0x05 {
+		return db.walkPage(int(binary.BigEndian.Uint32(header[8:12])), depth+1, seen, fn)
+	}
+	return nil
+}
+
+// payload returns the size bytes of a cell's payload, following overflow
+// pages when it does not fit on the page. The caller makes sure size is no
+// larger than the file.
+func (db *sqliteFile) payload(cell []byte, size int) ([]byte, error) {
+	if size < 0 || size > len(db.data) {
+		return nil, errors.New("SQLite cell is corrupt")
+	}
+
+	maxLocal := db.usable - 35
+	if size <= maxLocal {
+		if size > len(cell) {
+			return nil, errors.New("SQLite cell is corrupt")
+		}
+		return cell[:size], nil
+	}
+
+	minLocal := (db.usable-12)*32/255 - 23
+	local := minLocal + (size-minLocal)%(db.usable-4)
+	if local > maxLocal {
+		local = minLocal
+	}
+	if local+4 > len(cell) {
+		return nil, errors.New("SQLite cell is corrupt")
+	}
+
+	payload := make([]byte, 0, size)
+	payload = append(payload, cell[:local]...)
+	next := int(binary.BigEndian.Uint32(cell[local:]))
+	for len(payload) < size {
+		page, err := db.page(next)
+		if err != nil {
+			return nil, err
+		}
+		chunk := page[4:db.usable]
+		if remaining := size - len(payload); remaining < len(chunk) {
+			chunk = chunk[:remaining]
+		}
+		payload = append(payload, chunk...)
+		next = int(binary.BigEndian.Uint32(page))
+	}
+
+	return payload, nil
+}
+
+// sqliteRecord decodes a record into int64, float64, string, []byte or nil
+// values.
+func sqliteRecord(payload []byte) ([]any, error) {
+	headerSize, n := sqliteVarint(payload)
+	if headerSize < int64(n) || headerSize > int64(len(payload)) {
+		return nil, errors.New("SQLite record is corrupt")
+	}
+
+	var types []int64
+	for off := n; off < int(headerSize); {
+		t, k := sqliteVarint(payload[off:])
+		types = append(types, t)
+		off += k
+	}
+
+	body := payload[headerSize:]
+	values := make([]any, len(types))
+	for i, t := range types {
+		var size int
+		switch {
+		case t >= 12:
+			size = int(t-12) / 2
+		case t >= 1 && t <= 4:
+			size = int(t)
+		case t == 5:
+			size = 6
+		case t == 6 || t == 7:
+			size = 8
+		}
+		if size > len(body) {
+			return nil, errors.New("SQLite record is corrupt")
+		}
+		b := body[:size]
+		body = body[size:]
+
+		switch {
+		case t == 0:
+			values[i] = nil
+		case t >= 1 && t <= 6:
+			var v int64
+			for _, c := range b {
+				v = v<<8 | int64(c)
+			}
+			// Sign extend from the stored width.
+			shift := 64 - 8*uint(size)
+			values[i] = v << shift >> shift
+		case t == 7:
+			values[i] = math.Float64frombits(binary.BigEndian.Uint64(b))
+		case t == 8:
+			values[i] = int64(0)
+		case t == 9:
+			values[i] = int64(1)
+		case t >= 12 && t%2 == 0:
+			values[i] = bytes.Clone(b)
+		case t >= 13:
+			values[i] = string(b)
+		default:
+			return nil, fmt.Errorf("SQLite record has reserved serial type %d", t)
+		}
+	}
+
+	return values, nil
+}
+
+// sqliteVarint decodes a big-endian variable length integer of up to 9
+// bytes, returning it and the number of bytes read.
+func sqliteVarint(b []byte) (int64, int) {
+	var v uint64
+	for i := 0; i < 9 && i < len(b); i++ {
+		if i == 8 {
+			return int64(v<<8 | uint64(b[i])), 9
+		}
+		v = v<<7 | uint64(b[i]&0x7f)
+		if b[i]&0x80 == 0 {
+			return int64(v), i + 1
+		}
+	}
+	return int64(v), len(b)
+}
+
+// sqliteColumns returns the column names declared by a CREATE TABLE
+// statement, in order.
+func sqliteColumns(sql string) []string {
+	start, end := strings.Index(sql, "("), strings.LastIndex(sql, ")")
+	if start < 0 || end <= start {
+		return nil
+	}
+
+	var defs []string
+	depth, last := 0, start+1
+	for i := start + 1; i < end; i++ {
+		switch sql[i] {
+		case '(':
+			depth++
+		case ')':
+			depth--
+		case ',':
+			if depth == 0 {
+				defs = append(defs, sql[last:i])
+				last = i + 1
+			}
+		}
+	}
+	defs = append(defs, sql[last:end])
+
+	var columns []string
+	for _, def := range defs {
+		fields := strings.Fields(def)
+		if len(fields) == 0 {
+			continue
+		}
+		switch strings.ToUpper(fields[0]) {
+		case "PRIMARY", "UNIQUE", "CHECK", "FOREIGN", "CONSTRAINT":
+			continue
+		}
+		columns = append(columns, strings.Trim(fields[0], "\"`[]'"))
+	}
+
+	return columns
+}
@@ -0,0 +1,187 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+const testPageSize = 512
+
+// testVarint encodes v as an SQLite varint of up to 8 bytes.
+func testVarint(v uint64) []byte {
+	if v < 0x80 {
+		return []byte{byte(v)}
+	}
+	var groups []byte
+	for ; v > 0; v >>= 7 {
+		groups = append([]byte{byte(v & 0x7f)}, groups...)
+	}
+	for i := range groups[:len(groups)-1] {
+		groups[i] |= 0x80
+	}
+	return groups
+}
+
+// testRecord encodes values, which are nil, int64 or string, as a record.
+func testRecord(values ...any) []byte {
+	var types, body []byte
+	for _, v := range values {
+		switch v := v.(type) {
+		case nil:
+			types = append(types, 0)
+		case int64:
+			types = append(types, testVarint(6)...)
+			body = binary.BigEndian.AppendUint64(body, uint64(v))
+		case string:
+			types = append(types, testVarint(uint64(13+2*len(v)))...)
+			body = append(body, v...)
+		}
+	}
+	return append(append(testVarint(uint64(len(types)+1)), types...), body...)
+}
+
+// testLeafCell is a table leaf cell holding payload under rowid.
+func testLeafCell(rowid int64, payload []byte) []byte {
+	cell := append(testVarint(uint64(len(payload))), testVarint(uint64(rowid))...)
+	return append(cell, payload...)
+}
+
+// testPage lays out a b-tree page of the given kind with its cells packed
+// at the end. offset is where the page header starts, which is 100 on the
+// first page. rightmost is the right child of an interior page.
+func testPage(kind byte, offset int, rightmost uint32, cells ...[]byte) []byte {
+	page := make([]byte, testPageSize)
+	header := page[offset:]
+	header[0] = kind
+	binary.BigEndian.PutUint16(header[3:], uint16(len(cells)))
+
+	pointers := header[8:]
+	if kind == 0x05 {
+		binary.BigEndian.PutUint32(header[8:], rightmost)
+		pointers = header[12:]
+	}
+
+	end := testPageSize
+	for i, cell := range cells {
+		end -= len(cell)
+		copy(page[end:], cell)
+		binary.BigEndian.PutUint16(pointers[2*i:], uint16(end))
+	}
+	binary.BigEndian.PutUint16(header[5:], uint16(end))
+	return page
+}
+
+// testDatabase builds a database whose first page lists a Habits table
+// rooted at page 2, followed by pages.
+func testDatabase(pages ...[]byte) []byte {
+	schema := testRecord("table", "Habits", "Habits", int64(2), "CREATE TABLE Habits (id INTEGER PRIMARY KEY, name TEXT)")
+	return testSchemaDatabase([][]byte{schema}, pages...)
+}
+
+// testSchemaDatabase builds a database whose first page holds the schema
+// records, followed by pages.
+func testSchemaDatabase(schema [][]byte, pages ...[]byte) []byte {
+	cells := make([][]byte, len(schema))
+	for i, record := range schema {
+		cells[i] = testLeafCell(int64(i+1), record)
+	}
+	first := testPage(0x0D, 100, 0, cells...)
+
+	copy(first, sqliteMagic)
+	binary.BigEndian.PutUint16(first[16:], testPageSize)
+	first[18], first[19] = 1, 1
+	first[21], first[22], first[23] = 64, 32, 32
+	binary.BigEndian.PutUint32(first[28:], uint32(len(pages)+1))
+	binary.BigEndian.PutUint32(first[44:], 4)
+	binary.BigEndian.PutUint32(first[56:], 1)
+
+	return bytes.Join(append([][]byte{first}, pages...), nil)
+}
+
+func testHabitsPage() []byte {
+	return testPage(0x0D, 0, 0,
+		testLeafCell(1, testRecord(nil, "Stretch")),
+		testLeafCell(2, testRecord(nil, "Read")),
+	)
+}
+
+func TestSQLiteTable(t *testing.T) {
+	db, err := openSQLite(testDatabase(testHabitsPage()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rows, err := db.table("habits")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 {
+		t.Fatalf("got %d rows, want 2", len(rows))
+	}
+	if rows[0]["id"] != int64(1) || rows[0]["name"] != "Stretch" || rows[1]["id"] != int64(2) || rows[1]["name"] != "Read" {
+		t.Fatalf("got rows %v", rows)
+	}
+}
+
+// sqliteCorruptions are databases with a Habits table that is corrupt in
+// some way, each of which must fail with an error.
+func sqliteCorruptions() map[string][]byte {
+	negative := bytes.Repeat([]byte{0xff}, 9)
+	huge := testVarint(1 << 40)
+
+	return map[string][]byte{
+		"negative payload size": testDatabase(testPage(0x0D, 0, 0,
+			append(append(negative, 1), testRecord("x")...))),
+		"huge payload size": testDatabase(testPage(0x0D, 0, 0,
+			append(append(huge, 1), testRecord("x")...))),
+		"negative record header size": testDatabase(testPage(0x0D, 0, 0,
+			testLeafCell(1, append(negative, 0x01, 0x17, 'x')))),
+		"record header larger than record": testDatabase(testPage(0x0D, 0, 0,
+			testLeafCell(1, []byte{0x40, 0x01}))),
+		"record header size of zero": testDatabase(testPage(0x0D, 0, 0,
+			testLeafCell(1, []byte{0x00, 0x01}))),
+		"huge text value": testDatabase(testPage(0x0D, 0, 0,
+			testLeafCell(1, append(append([]byte{0x09}, testVarint(1<<50|1)...), 'x')))),
+		"interior page pointing at itself": testDatabase(testPage(0x05, 0, 2,
+			append(binary.BigEndian.AppendUint32(nil, 2), testVarint(1)...))),
+		"child page out of range": testDatabase(testPage(0x05, 0, 9)),
+		"not a table page":        testDatabase(testPage(0x0A, 0, 0)),
+		"missing root page":       testDatabase(),
+		"cell offset past page": func() []byte {
+			data := testDatabase(testHabitsPage())
+			binary.BigEndian.PutUint16(data[testPageSize+8:], 0xffff)
+			return data
+		}(),
+	}
+}
+
+func TestSQLiteCorrupt(t *testing.T) {
+	for name, data := range sqliteCorruptions() {
+		t.Run(name, func(t *testing.T) {
+			db, err := openSQLite(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.table("Habits"); err == nil {
+				t.Fatal("a corrupt table was read without an error")
+			}
+		})
+	}
+}
+
+func FuzzSQLite(f *testing.F) {
+	f.Add(testDatabase(testHabitsPage()))
+	for _, data := range sqliteCorruptions() {
+		f.Add(data)
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		db, err := openSQLite(data)
+		if err != nil {
+			return
+		}
+		_, _ = db.table("Habits")
+		_, _ = db.table("Repetitions")
+	})
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"io/fs"
+	"mime"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+)
+
+// immutableCacheControl is used for Vite's hashed build output, which never
+// changes under the same name.
+const immutableCacheControl = "public, max-age=31536000, immutable"
+
+// precompressed lists the encodings we look for alongside each static file,
+// in order of preference.
+var precompressed = []struct {
+	encoding  string
+	extension string
+}{
+	{"br", ".br"},
+	{"gzip", ".gz"},
+}
+
+// staticFS returns the built frontend, either embedded in the binary or read
+// from cfg.StaticDir.
+func staticFS(cfg *Config) fs.FS {
+	if cfg.EmbedStatic {
+		if fsys, ok := embeddedStatic(); ok {
+			return fsys
+		}
+	}
+	return os.DirFS(cfg.StaticDir)
+}
+
+// handleStatic serves the frontend. Paths that do not match a file and do
+// not look like one fall back to index.html so client side routes work on a
+// reload.
+func handleStatic(fsys fs.FS) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/")
+
+		if name == "api" || strings.HasPrefix(name, "api/") {
+			writeError(w, http.StatusNotFound, CodeNotFound, "resource not found")
+			return
+		}
+
+		if name == "" {
+			name = "index.html"
+		}
+		if info, err := fs.Stat(fsys, name); err == nil && info.IsDir() {
+			name = path.Join(name, "index.html")
+		}
+
+		if _, err := fs.Stat(fsys, name); err != nil {
+			if !errors.Is(err, fs.ErrNotExist) || path.Ext(name) != "" {
+				http.NotFound(w, r)
+				return
+			}
+			name = "index.html"
+		}
+
+		if strings.HasPrefix(name, "assets/") {
+			w.Header().Set("Cache-Control", immutableCacheControl)
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+
+		serveStaticFile(w, r, fsys, name)
+	}
+}
+
+func serveStaticFile(w http.ResponseWriter, r *http.Request, fsys fs.FS, name string) {
+	w.Header().Add("Vary", "Accept-Encoding")
+
+	file := name
+	for _, p := range precompressed {
+		if !acceptsEncoding(r, p.encoding) {
+			continue
+		}
+		if _, err := fs.Stat(fsys, name+p.extension); err == nil {
+			file = name + p.extension
+			w.Header().Set("Content-Encoding", p.encoding)
+			break
+		}
+	}
+
+	// Content-Type has to come from the original name since sniffing
+	// compressed content would be wrong.
+	contentType := mime.TypeByExtension(path.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+
+	f, err := fsys.Open(file)
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Unable to read static file")
+		loggerFrom(r.Context()).Error("Unable to stat static file", "error", err.Error())
+		return
+	}
+
+	content, ok := f.(io.ReadSeeker)
+	if !ok {
+		writeError(w, http.StatusInternalServerError, CodeInternal, "Unable to read static file")
+		loggerFrom(r.Context()).Error("Static file is not seekable", "file", file)
+		return
+	}
+
+	http.ServeContent(w, r, name, info.ModTime(), content)
+}
+
+// acceptsEncoding reports whether the Accept-Encoding header of r allows
+// encoding.
+func acceptsEncoding(r *http.Request, encoding string) bool {
+	for _, part := range strings.Split(r.Header.Get("Accept-Encoding"), ",") {
+		coding, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if !strings.EqualFold(strings.TrimSpace(coding), encoding) {
+			continue
+		}
+
+		q := strings.ReplaceAll(strings.TrimSpace(params), " ", "")
+		return q != "q=0" && q != "q=0.0" && q != "q=0.00" && q != "q=0.000"
+	}
+	return false
+}
@@ -0,0 +1,21 @@
+//go:build embed
+
+package main
+
+import (
+	"embed"
+	"io/fs"
+)
+
+// dist is a copy of face/dist made by `make build-embed`.
+//
+//go:embed all:dist
+var dist embed.FS
+
+func embeddedStatic() (fs.FS, bool) {
+	fsys, err := fs.Sub(dist, "dist")
+	if err != nil {
+		return nil, false
+	}
+	return fsys, true
+}
@@ -0,0 +1,11 @@
+//go:build !embed
+
+package main
+
+import "io/fs"
+
+// embeddedStatic reports false since the frontend is only embedded when
+// building with the embed tag.
+func embeddedStatic() (fs.FS, bool) {
+	return nil, false
+}
@@ -2,64 +2,16 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"errors"
+	"strings"
 	"time"
 
+	"github.com/jackc/pgx/v5"
 	"github.com/jackc/pgx/v5/pgxpool"
 	"golang.org/x/crypto/bcrypt"
 )
 
-func createTables(ctx context.Context, conn *pgxpool.Pool) error {
-	_, err := conn.Exec(ctx, `
-DO $$ BEGIN
-	CREATE TYPE interval_enum AS ENUM ('Hourly', 'Daily', 'Weekly', 'Monthly');
-EXCEPTION
-    WHEN duplicate_object THEN null;
-END $$;
-
-CREATE TABLE if not exists tasks (
-    id SERIAL PRIMARY KEY,
-	user_id INT NOT NULL,
-    name VARCHAR(255) NOT NULL,
-    description TEXT,
-    created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP,
-    interval interval_enum NOT NULL
-);
-
-CREATE TABLE if not exists completions (
-	task_id INT NOT NULL,
-	completed_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE if not exists users (
-	id SERIAL PRIMARY KEY,
-	username VARCHAR(255) NOT NULL UNIQUE,
-	password VARCHAR(255) NOT NULL,
-	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE if not exists magic_links (
-	id SERIAL PRIMARY KEY,
-	user_id INT NOT NULL,
-	token VARCHAR(255) NOT NULL,
-	valid BOOLEAN DEFAULT FALSE,
-	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE TABLE if not exists sessions (
-	id SERIAL PRIMARY KEY,
-	user_id INT NOT NULL,
-	token VARCHAR(255) NOT NULL,
-	created_at TIMESTAMP WITH TIME ZONE DEFAULT CURRENT_TIMESTAMP
-);
-
-CREATE INDEX IF NOT EXISTS completions_task_id_completed_at_idx ON completions (task_id, completed_at);
-CREATE INDEX IF NOT EXISTS magic_links_token_idx ON magic_links (token);
-CREATE INDEX IF NOT EXISTS sessions_token_idx ON sessions (token);
-CREATE INDEX IF NOT EXISTS users_username_idx ON users (username);
-`)
-	return err
-}
-
 func getMagicLinkByToken(ctx context.Context, conn *pgxpool.Pool, token string) (*MagicLink, error) {
 	magicLink := &MagicLink{}
 	err := conn.QueryRow(ctx, `
@@ -110,6 +62,13 @@ VALUES ($1, $2)`, userID, token)
 	return err
 }
 
+func deleteSession(ctx context.Context, conn *pgxpool.Pool, token string) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM sessions
+WHERE token = $1`, token)
+	return err
+}
+
 func getSession(ctx context.Context, conn *pgxpool.Pool, token string) (*Session, error) {
 	session := &Session{}
 	err := conn.QueryRow(ctx, `
@@ -126,9 +85,9 @@ WHERE token = $1`, token).Scan(&session.ID, &session.UserID, &session.Token, &se
 func getUser(ctx context.Context, conn *pgxpool.Pool, username string) (*User, error) {
 	user := &User{}
 	err := conn.QueryRow(ctx, `
-SELECT id, username, created_at
+SELECT id, username, timezone, COALESCE(email, ''), weekly_digest, is_admin, disabled_at, created_at
 FROM users
-WHERE username = $1`, username).Scan(&user.ID, &user.Username, &user.CreatedAt)
+WHERE username = $1`, username).Scan(&user.ID, &user.Username, &user.Timezone, &user.Email, &user.WeeklyDigest, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -139,9 +98,9 @@ WHERE username = $1`, username).Scan(&user.ID, &user.Username, &user.CreatedAt)
 func getUserByID(ctx context.Context, conn *pgxpool.Pool, id int) (*User, error) {
 	user := &User{}
 	err := conn.QueryRow(ctx, `
-SELECT id, username, created_at
+SELECT id, username, timezone, COALESCE(email, ''), weekly_digest, is_admin, disabled_at, created_at
 FROM users
-WHERE id = $1`, id).Scan(&user.ID, &user.Username, &user.CreatedAt)
+WHERE id = $1`, id).Scan(&user.ID, &user.Username, &user.Timezone, &user.Email, &user.WeeklyDigest, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt)
 	if err != nil {
 		return nil, err
 	}
@@ -183,151 +142,1349 @@ VALUES ($1, $2)`, username, passwordHash)
 	return getUser(ctx, conn, username)
 }
 
-func getCompletions(ctx context.Context, conn *pgxpool.Pool, taskID int, dateEnd time.Time) ([]*Completion, error) {
-	queryTime := dateEnd.Format(time.RFC3339)
-	query := `
-SELECT task_id, completed_at
-FROM completions
-WHERE task_id = $1
-AND completed_at > $2`
+// completeTask records a completion of task unless it has one in the
+// current interval, which runs on calendar bounds in loc like the ones
+// reminders and streaks use. It returns nil when nothing was recorded.
+func completeTask(ctx context.Context, conn *pgxpool.Pool, task *Task, loc *time.Location) (*Completion, error) {
+	start, end := task.Interval.bounds(time.Now().In(loc))
+
+	c := &Completion{TaskID: task.ID}
+	err := conn.QueryRow(ctx, `
+INSERT INTO completions (task_id)
+SELECT $1::integer
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM completions
+	WHERE task_id = $1
+	AND completed_at >= $2
+	AND completed_at < $3
+)
+RETURNING completed_at`, task.ID, start, end).Scan(&c.CompletedAt)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// TaskFilter picks which of a user's tasks getTasks returns. The zero value
+// returns every task that is not archived.
+type TaskFilter struct {
+	Archived bool
+	// GroupID limits the tasks to one group when it is set.
+	GroupID int
+	// Ungrouped limits the tasks to those without a group.
+	Ungrouped bool
+	// Sort is one of taskOrders, with a leading minus to reverse it. The
+	// user's order is used when it is empty.
+	Sort string
+}
+
+// taskOrders are the orders of the task list the database sorts in, as the
+// ORDER BY expression for each name. Ties keep the user's order.
+var taskOrders = map[string]string{
+	"position":   "position",
+	"name":       "lower(name)",
+	"created_at": "created_at",
+	"interval":   "interval",
+}
 
-	rows, err := conn.Query(ctx, query, taskID, queryTime)
+// getTasks returns the user's tasks that match filter, sorted by
+// filter.Sort.
+func getTasks(ctx context.Context, conn *pgxpool.Pool, userId int, filter TaskFilter) ([]*Task, error) {
+	order := "position"
+	if name, desc := strings.CutPrefix(filter.Sort, "-"); taskOrders[name] != "" {
+		order = taskOrders[name]
+		if desc {
+			order += " DESC"
+		}
+	}
+
+	rows, err := conn.Query(ctx, `
+SELECT id, name, description, created_at, interval, archived_at, position, group_id
+FROM tasks
+WHERE user_id = $1
+AND ($2 OR archived_at IS NULL)
+AND ($3 = 0 OR group_id = $3)
+AND (NOT $4 OR group_id IS NULL)
+ORDER BY `+order+`, position, id
+	`, userId, filter.Archived, filter.GroupID, filter.Ungrouped)
 	if err != nil {
 		return nil, err
 	}
 
-	completions := []*Completion{}
+	tasks := []*Task{}
 	for rows.Next() {
-		c := &Completion{}
-		err := rows.Scan(&c.TaskID, &c.CompletedAt)
+		task := &Task{}
+		var interval string
+		err := rows.Scan(&task.ID, &task.Name, &task.Description, &task.CreatedAt, &interval, &task.ArchivedAt, &task.Position, &task.GroupID)
 		if err != nil {
 			return nil, err
 		}
+		task.Interval = fromString(interval)
 
-		completions = append(completions, c)
+		tasks = append(tasks, task)
 	}
 
-	return completions, nil
+	return tasks, nil
 }
 
-func completeTask(ctx context.Context, conn *pgxpool.Pool, taskID int) error {
-	task, err := getTask(ctx, conn, taskID)
+// insertTask adds the task at the end of the user's list.
+func insertTask(ctx context.Context, conn *pgxpool.Pool, task Task) (*Task, error) {
+	err := conn.QueryRow(ctx, `
+		INSERT INTO tasks (name, user_id, description, interval, group_id, position)
+		VALUES ($1, $2, $3, $4, $5, (SELECT COALESCE(MAX(position), 0) + 1 FROM tasks WHERE user_id = $2))
+		RETURNING id, created_at, position
+		`, task.Name, task.UserID, task.Description, task.Interval.String(), task.GroupID).Scan(&task.ID, &task.CreatedAt, &task.Position)
 	if err != nil {
+		return nil, err
+	}
+
+	return &task, nil
+}
+
+// updateTask saves task and, when paused is set, pauses or resumes it as of
+// today, all in one transaction.
+func updateTask(ctx context.Context, conn *pgxpool.Pool, task *Task, paused *bool, today time.Time) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		_, err := tx.Exec(ctx, `
+		UPDATE tasks
+		SET name = $1, description = $2, interval = $3, archived_at = $4, group_id = $5
+		WHERE id = $6
+		`, task.Name, task.Description, task.Interval.String(), task.ArchivedAt, task.GroupID, task.ID)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case paused == nil:
+			return nil
+		case *paused:
+			return pauseTask(ctx, tx, task.ID, today)
+		default:
+			return resumeTask(ctx, tx, task.ID, today)
+		}
+	})
+}
+
+// errUnknownTasks is returned by reorderTasks when it is given a task the
+// user does not have.
+var errUnknownTasks = errors.New("unknown tasks")
+
+// reorderTasks moves the tasks in ids to the top of the user's list in that
+// order. The rest follow them in the order they were already in.
+func reorderTasks(ctx context.Context, conn *pgxpool.Pool, userID int, ids []int) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var found int
+		err := tx.QueryRow(ctx, `
+SELECT COUNT(*)
+FROM tasks
+WHERE user_id = $1
+AND id = ANY($2)`, userID, ids).Scan(&found)
+		if err != nil {
+			return err
+		}
+		if found != len(ids) {
+			return errUnknownTasks
+		}
+
+		_, err = tx.Exec(ctx, `
+UPDATE tasks t
+SET position = o.position
+FROM (
+	SELECT id, row_number() OVER (ORDER BY array_position($2::int[], id) NULLS LAST, position, id) AS position
+	FROM tasks
+	WHERE user_id = $1
+) o
+WHERE o.id = t.id`, userID, ids)
 		return err
+	})
+}
+
+// deleteTask deletes the task. Its history and settings go with it through
+// the foreign keys on the task.
+func deleteTask(ctx context.Context, conn *pgxpool.Pool, id int) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM tasks
+WHERE id = $1`, id)
+	return err
+}
+
+func getTask(ctx context.Context, conn *pgxpool.Pool, id int) (*Task, error) {
+	task := &Task{}
+	var interval string
+	err := conn.QueryRow(ctx, `
+		SELECT id, user_id, name, description, created_at, interval, archived_at, position, group_id
+		FROM tasks
+		WHERE id = $1
+		`, id).Scan(&task.ID, &task.UserID, &task.Name, &task.Description, &task.CreatedAt, &interval, &task.ArchivedAt, &task.Position, &task.GroupID)
+	if err != nil {
+		return nil, err
+	}
+
+	task.Interval = fromString(interval)
+
+	return task, nil
+}
+
+// claimIdempotencyKey reserves key for the user. It reports false when the key
+// is already taken by an unexpired request, in which case the caller should
+// look the stored request up instead.
+func claimIdempotencyKey(ctx context.Context, conn *pgxpool.Pool, ik *IdempotencyKey, ttl time.Duration) (bool, error) {
+	_, err := conn.Exec(ctx, `
+DELETE FROM idempotency_keys
+WHERE user_id = $1
+AND created_at < $2`, ik.UserID, time.Now().Add(-ttl))
+	if err != nil {
+		return false, err
 	}
 
-	interval := ""
-	switch task.Interval {
-	case Hourly:
-		interval = "NOW() - INTERVAL '1 hour'"
-	case Daily:
-		interval = "NOW() - INTERVAL '1 day'"
-	case Weekly:
-		interval = "NOW() - INTERVAL '1 week'"
-	case Monthly:
-		interval = "NOW() - INTERVAL '1 month'"
+	tag, err := conn.Exec(ctx, `
+INSERT INTO idempotency_keys (user_id, key, method, path, request_hash)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (user_id, key) DO NOTHING`, ik.UserID, ik.Key, ik.Method, ik.Path, ik.RequestHash)
+	if err != nil {
+		return false, err
 	}
 
-	query := `
-SELECT task_id, completed_at
-FROM completions
-WHERE task_id = $1
-AND completed_at > ` + interval
+	return tag.RowsAffected() == 1, nil
+}
+
+func getIdempotencyKey(ctx context.Context, conn *pgxpool.Pool, userID int, key string) (*IdempotencyKey, error) {
+	ik := &IdempotencyKey{}
+	var headers []byte
+	err := conn.QueryRow(ctx, `
+SELECT user_id, key, method, path, request_hash, status, headers, body, created_at
+FROM idempotency_keys
+WHERE user_id = $1
+AND key = $2`, userID, key).Scan(&ik.UserID, &ik.Key, &ik.Method, &ik.Path, &ik.RequestHash, &ik.Status, &headers, &ik.Body, &ik.CreatedAt)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if err := json.Unmarshal(headers, &ik.Headers); err != nil {
+		return nil, err
+	}
+
+	return ik, nil
+}
 
-	rows, err := conn.Query(ctx, query, taskID)
+func completeIdempotencyKey(ctx context.Context, conn *pgxpool.Pool, ik *IdempotencyKey) error {
+	headers, err := json.Marshal(ik.Headers)
 	if err != nil {
 		return err
 	}
 
-	completions := []Completion{}
+	_, err = conn.Exec(ctx, `
+UPDATE idempotency_keys
+SET status = $3, headers = $4, body = $5
+WHERE user_id = $1
+AND key = $2`, ik.UserID, ik.Key, ik.Status, headers, ik.Body)
+	return err
+}
+
+func releaseIdempotencyKey(ctx context.Context, conn *pgxpool.Pool, userID int, key string) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM idempotency_keys
+WHERE user_id = $1
+AND key = $2`, userID, key)
+	return err
+}
+
+func countSessionsSince(ctx context.Context, conn *pgxpool.Pool, since time.Time) (int, error) {
+	var count int
+	err := conn.QueryRow(ctx, `
+SELECT COUNT(*)
+FROM sessions
+WHERE created_at > $1`, since).Scan(&count)
+	return count, err
+}
+
+func updateUserWeeklyDigest(ctx context.Context, conn *pgxpool.Pool, userID int, weeklyDigest bool) error {
+	_, err := conn.Exec(ctx, `
+UPDATE users
+SET weekly_digest = $2
+WHERE id = $1`, userID, weeklyDigest)
+	return err
+}
+
+func updateUserTimezone(ctx context.Context, conn *pgxpool.Pool, userID int, timezone string) error {
+	_, err := conn.Exec(ctx, `
+UPDATE users
+SET timezone = $2
+WHERE id = $1`, userID, timezone)
+	return err
+}
+
+// getReminderSettings returns the reminder settings of the task, or disabled
+// settings if none were saved.
+func getReminderSettings(ctx context.Context, conn *pgxpool.Pool, taskID int) (*ReminderSettings, error) {
+	rs := &ReminderSettings{TaskID: taskID}
+	err := conn.QueryRow(ctx, `
+SELECT enabled, lead_minutes, quiet_hours_start, quiet_hours_end
+FROM task_reminders
+WHERE task_id = $1`, taskID).Scan(&rs.Enabled, &rs.LeadMinutes, &rs.QuietHoursStart, &rs.QuietHoursEnd)
+	if err != nil {
+		if errors.Is(err, pgx.ErrNoRows) {
+			return rs, nil
+		}
+		return nil, err
+	}
+
+	return rs, nil
+}
+
+// getUserReminderSettings returns the saved reminder settings of every task
+// of the user.
+func getUserReminderSettings(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*ReminderSettings, error) {
+	rows, err := conn.Query(ctx, `
+SELECT r.task_id, r.enabled, r.lead_minutes, r.quiet_hours_start, r.quiet_hours_end
+FROM task_reminders r
+JOIN tasks t ON t.id = r.task_id
+WHERE t.user_id = $1
+ORDER BY r.task_id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	settings := []*ReminderSettings{}
 	for rows.Next() {
-		var c Completion
-		err := rows.Scan(&c.TaskID, &c.CompletedAt)
+		rs := &ReminderSettings{}
+		err := rows.Scan(&rs.TaskID, &rs.Enabled, &rs.LeadMinutes, &rs.QuietHoursStart, &rs.QuietHoursEnd)
 		if err != nil {
-			return err
+			return nil, err
 		}
 
-		completions = append(completions, c)
+		settings = append(settings, rs)
 	}
 
-	if len(completions) > 0 {
-		return nil
+	return settings, rows.Err()
+}
+
+func upsertReminderSettings(ctx context.Context, conn *pgxpool.Pool, rs *ReminderSettings) error {
+	_, err := conn.Exec(ctx, `
+INSERT INTO task_reminders (task_id, enabled, lead_minutes, quiet_hours_start, quiet_hours_end)
+VALUES ($1, $2, $3, $4, $5)
+ON CONFLICT (task_id) DO UPDATE
+SET enabled = EXCLUDED.enabled,
+	lead_minutes = EXCLUDED.lead_minutes,
+	quiet_hours_start = EXCLUDED.quiet_hours_start,
+	quiet_hours_end = EXCLUDED.quiet_hours_end`,
+		rs.TaskID, rs.Enabled, rs.LeadMinutes, rs.QuietHoursStart, rs.QuietHoursEnd)
+	return err
+}
+
+// getReminderCandidates returns every task with reminders enabled, along with
+// its owner and settings.
+func getReminderCandidates(ctx context.Context, conn *pgxpool.Pool) ([]*ReminderCandidate, error) {
+	rows, err := conn.Query(ctx, `
+SELECT t.id, t.user_id, t.name, t.description, t.created_at, t.interval,
+	u.id, u.username, u.timezone, COALESCE(u.email, ''), u.weekly_digest, u.created_at,
+	r.enabled, r.lead_minutes, r.quiet_hours_start, r.quiet_hours_end
+FROM task_reminders r
+JOIN tasks t ON t.id = r.task_id
+JOIN users u ON u.id = t.user_id
+WHERE r.enabled = true
+AND t.archived_at IS NULL
+AND u.disabled_at IS NULL`)
+	if err != nil {
+		return nil, err
 	}
+	defer rows.Close()
 
-	_, err = conn.Exec(ctx, `
-INSERT INTO completions (task_id)
-VALUES ($1)`, taskID)
+	candidates := []*ReminderCandidate{}
+	for rows.Next() {
+		c := &ReminderCandidate{Task: &Task{}, User: &User{}, Settings: &ReminderSettings{}}
+		var interval string
+		err := rows.Scan(&c.Task.ID, &c.Task.UserID, &c.Task.Name, &c.Task.Description, &c.Task.CreatedAt, &interval,
+			&c.User.ID, &c.User.Username, &c.User.Timezone, &c.User.Email, &c.User.WeeklyDigest, &c.User.CreatedAt,
+			&c.Settings.Enabled, &c.Settings.LeadMinutes, &c.Settings.QuietHoursStart, &c.Settings.QuietHoursEnd)
+		if err != nil {
+			return nil, err
+		}
+		c.Task.Interval = fromString(interval)
+		c.Settings.TaskID = c.Task.ID
+
+		candidates = append(candidates, c)
+	}
+
+	return candidates, rows.Err()
+}
+
+func hasCompletionBetween(ctx context.Context, conn *pgxpool.Pool, taskID int, start, end time.Time) (bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, `
+SELECT EXISTS (
+	SELECT 1
+	FROM completions
+	WHERE task_id = $1
+	AND completed_at >= $2
+	AND completed_at < $3
+)`, taskID, start, end).Scan(&exists)
+	return exists, err
+}
+
+func hasCompletionSince(ctx context.Context, conn *pgxpool.Pool, taskID int, since time.Time) (bool, error) {
+	var exists bool
+	err := conn.QueryRow(ctx, `
+SELECT EXISTS (
+	SELECT 1
+	FROM completions
+	WHERE task_id = $1
+	AND completed_at >= $2
+)`, taskID, since).Scan(&exists)
+	return exists, err
+}
+
+// claimReminder records that a reminder for the interval of the task starting
+// at intervalStart is being sent on channel. It reports false if one already
+// was.
+func claimReminder(ctx context.Context, conn *pgxpool.Pool, taskID, userID int, intervalStart time.Time, channel string) (bool, error) {
+	tag, err := conn.Exec(ctx, `
+INSERT INTO reminders (task_id, user_id, interval_start, channel)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (task_id, interval_start, channel) DO NOTHING`, taskID, userID, intervalStart, channel)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func releaseReminder(ctx context.Context, conn *pgxpool.Pool, taskID int, intervalStart time.Time, channel string) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM reminders
+WHERE task_id = $1
+AND interval_start = $2
+AND channel = $3`, taskID, intervalStart, channel)
 	return err
 }
 
-func getTasks(ctx context.Context, conn *pgxpool.Pool, userId int) ([]*Task, error) {
+func insertWebhook(ctx context.Context, conn *pgxpool.Pool, hook *Webhook) error {
+	return conn.QueryRow(ctx, `
+INSERT INTO webhooks (user_id, url, secret, events, active)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, created_at`, hook.UserID, hook.URL, hook.Secret, hook.Events, hook.Active).Scan(&hook.ID, &hook.CreatedAt)
+}
+
+func getWebhook(ctx context.Context, conn *pgxpool.Pool, id int) (*Webhook, error) {
+	hook := &Webhook{}
+	err := conn.QueryRow(ctx, `
+SELECT id, user_id, url, secret, events, active, created_at
+FROM webhooks
+WHERE id = $1`, id).Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.Active, &hook.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+
+	return hook, nil
+}
+
+func getWebhooks(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*Webhook, error) {
 	rows, err := conn.Query(ctx, `
-SELECT id, name, description, created_at, interval
-FROM tasks
+SELECT id, user_id, url, secret, events, active, created_at
+FROM webhooks
 WHERE user_id = $1
-	`, userId)
+ORDER BY id`, userID)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	tasks := []*Task{}
+	hooks := []*Webhook{}
 	for rows.Next() {
-		task := &Task{}
-		var interval string
-		err := rows.Scan(&task.ID, &task.Name, &task.Description, &task.CreatedAt, &interval)
+		hook := &Webhook{}
+		err := rows.Scan(&hook.ID, &hook.UserID, &hook.URL, &hook.Secret, &hook.Events, &hook.Active, &hook.CreatedAt)
 		if err != nil {
 			return nil, err
 		}
-		task.Interval = fromString(interval)
 
-		tasks = append(tasks, task)
+		hooks = append(hooks, hook)
 	}
 
-	return tasks, nil
+	return hooks, rows.Err()
+}
+
+// deleteWebhook deletes the webhook along with its delivery log.
+func deleteWebhook(ctx context.Context, conn *pgxpool.Pool, id int) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `DELETE FROM webhook_deliveries WHERE webhook_id = $1`, id); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM webhooks WHERE id = $1`, id)
+		return err
+	})
 }
 
-func insertTask(ctx context.Context, conn *pgxpool.Pool, task Task) error {
+// enqueueWebhookDeliveries queues payload for every active webhook of the user
+// subscribed to event. Webhooks that already have a delivery for key are
+// skipped.
+func enqueueWebhookDeliveries(ctx context.Context, conn *pgxpool.Pool, userID int, event, key string, payload []byte) error {
 	_, err := conn.Exec(ctx, `
-		INSERT INTO tasks (name, user_id, description, interval)
-		VALUES ($1, $2, $3, $4)
-		`, task.Name, task.UserID, task.Description, task.Interval.String())
+INSERT INTO webhook_deliveries (webhook_id, event, event_key, payload)
+SELECT id, $2, $3, $4
+FROM webhooks
+WHERE user_id = $1
+AND active = true
+AND $2 = ANY(events)
+ON CONFLICT (webhook_id, event_key) DO NOTHING`, userID, event, key, payload)
+	return err
+}
+
+func insertWebhookDelivery(ctx context.Context, conn *pgxpool.Pool, d *WebhookDelivery) error {
+	return conn.QueryRow(ctx, `
+INSERT INTO webhook_deliveries (webhook_id, event, event_key, payload, next_attempt_at)
+VALUES ($1, $2, $3, $4, $5)
+RETURNING id, status, created_at`, d.WebhookID, d.Event, d.EventKey, d.Payload, d.NextAttemptAt).Scan(&d.ID, &d.Status, &d.CreatedAt)
+}
+
+// claimWebhookDeliveries returns up to limit pending deliveries that are due,
+// pushing their next attempt back by lease so they are not claimed again
+// while being sent.
+func claimWebhookDeliveries(ctx context.Context, conn *pgxpool.Pool, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	rows, err := conn.Query(ctx, `
+UPDATE webhook_deliveries
+SET next_attempt_at = CURRENT_TIMESTAMP + $2 * INTERVAL '1 millisecond'
+WHERE id IN (
+	SELECT id
+	FROM webhook_deliveries
+	WHERE status = 'pending'
+	AND next_attempt_at <= CURRENT_TIMESTAMP
+	ORDER BY next_attempt_at
+	LIMIT $1
+	FOR UPDATE SKIP LOCKED
+)
+RETURNING id, webhook_id, event, event_key, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, delivered_at`,
+		limit, lease.Milliseconds())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+func getWebhookDeliveries(ctx context.Context, conn *pgxpool.Pool, webhookID, limit int) ([]*WebhookDelivery, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, webhook_id, event, event_key, payload, status, attempts, next_attempt_at, last_status_code, last_error, created_at, delivered_at
+FROM webhook_deliveries
+WHERE webhook_id = $1
+ORDER BY id DESC
+LIMIT $2`, webhookID, limit)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanWebhookDeliveries(rows)
+}
+
+func scanWebhookDeliveries(rows pgx.Rows) ([]*WebhookDelivery, error) {
+	deliveries := []*WebhookDelivery{}
+	for rows.Next() {
+		d := &WebhookDelivery{}
+		err := rows.Scan(&d.ID, &d.WebhookID, &d.Event, &d.EventKey, &d.Payload, &d.Status, &d.Attempts, &d.NextAttemptAt,
+			&d.LastStatusCode, &d.LastError, &d.CreatedAt, &d.DeliveredAt)
+		if err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, d)
+	}
 
+	return deliveries, rows.Err()
+}
+
+func updateWebhookDelivery(ctx context.Context, conn *pgxpool.Pool, d *WebhookDelivery) error {
+	_, err := conn.Exec(ctx, `
+UPDATE webhook_deliveries
+SET status = $2, attempts = $3, next_attempt_at = $4, last_status_code = $5, last_error = $6, delivered_at = $7
+WHERE id = $1`, d.ID, d.Status, d.Attempts, d.NextAttemptAt, d.LastStatusCode, d.LastError, d.DeliveredAt)
 	return err
 }
 
-//	func updateTask(ctx context.Context, conn *pgxpool.Pool, task Task) error {
-//		_, err := conn.Exec(ctx, `
-//			UPDATE tasks
-//			SET name = $1, description = $2, interval = $3
-//			WHERE id = $6
-//			`, task.Name, task.Description, task.Interval.String(), task.ID)
-//		if err != nil {
-//			return err
-//		}
-//	}
-//
-//	func deleteTask(ctx context.Context, conn *pgxpool.Pool, id int) error {
-//		_, err := conn.Exec(ctx, `
-//			DELETE FROM tasks
-//			WHERE id = $1
-//			`, id)
-//		if err != nil {
-//			return err
-//		}
-//	}
-func getTask(ctx context.Context, conn *pgxpool.Pool, id int) (*Task, error) {
-	task := &Task{}
-	var interval string
-	err := conn.QueryRow(ctx, `
-		SELECT id, name, description, created_at, interval
-		FROM tasks
-		WHERE id = $1
-		`, id).Scan(&task.ID, &task.Name, &task.Description, &task.CreatedAt, &interval)
+// getMissedIntervalCandidates returns every task whose owner has an active
+// webhook subscribed to interval.missed, along with the owner.
+func getMissedIntervalCandidates(ctx context.Context, conn *pgxpool.Pool) ([]*MissedIntervalCandidate, error) {
+	rows, err := conn.Query(ctx, `
+SELECT t.id, t.user_id, t.name, t.description, t.created_at, t.interval,
+	u.id, u.username, u.timezone, u.created_at
+FROM tasks t
+JOIN users u ON u.id = t.user_id
+WHERE t.archived_at IS NULL
+AND u.disabled_at IS NULL
+AND EXISTS (
+	SELECT 1
+	FROM webhooks w
+	WHERE w.user_id = t.user_id
+	AND w.active = true
+	AND 'interval.missed' = ANY(w.events)
+)`)
 	if err != nil {
 		return nil, err
 	}
+	defer rows.Close()
 
-	task.Interval = fromString(interval)
+	candidates := []*MissedIntervalCandidate{}
+	for rows.Next() {
+		c := &MissedIntervalCandidate{Task: &Task{}, User: &User{}}
+		var interval string
+		err := rows.Scan(&c.Task.ID, &c.Task.UserID, &c.Task.Name, &c.Task.Description, &c.Task.CreatedAt, &interval,
+			&c.User.ID, &c.User.Username, &c.User.Timezone, &c.User.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		c.Task.Interval = fromString(interval)
 
-	return task, nil
+		candidates = append(candidates, c)
+	}
+
+	return candidates, rows.Err()
+}
+
+// upsertPushSubscription saves the subscription, replacing the keys and owner
+// of an existing subscription for the same endpoint.
+func upsertPushSubscription(ctx context.Context, conn *pgxpool.Pool, sub *PushSubscription) error {
+	_, err := conn.Exec(ctx, `
+INSERT INTO push_subscriptions (user_id, endpoint, p256dh, auth)
+VALUES ($1, $2, $3, $4)
+ON CONFLICT (endpoint) DO UPDATE
+SET user_id = EXCLUDED.user_id,
+	p256dh = EXCLUDED.p256dh,
+	auth = EXCLUDED.auth`, sub.UserID, sub.Endpoint, sub.P256dh, sub.Auth)
+	return err
+}
+
+func getPushSubscriptions(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*PushSubscription, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, user_id, endpoint, p256dh, auth, created_at
+FROM push_subscriptions
+WHERE user_id = $1`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []*PushSubscription{}
+	for rows.Next() {
+		sub := &PushSubscription{}
+		err := rows.Scan(&sub.ID, &sub.UserID, &sub.Endpoint, &sub.P256dh, &sub.Auth, &sub.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		subs = append(subs, sub)
+	}
+
+	return subs, rows.Err()
+}
+
+func deletePushSubscription(ctx context.Context, conn *pgxpool.Pool, userID int, endpoint string) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM push_subscriptions
+WHERE user_id = $1
+AND endpoint = $2`, userID, endpoint)
+	return err
+}
+
+func insertEmailVerification(ctx context.Context, conn *pgxpool.Pool, token string, userID int, email string, expiresAt time.Time) error {
+	_, err := conn.Exec(ctx, `
+INSERT INTO email_verifications (token, user_id, email, expires_at)
+VALUES ($1, $2, $3, $4)`, token, userID, email, expiresAt)
+	return err
+}
+
+// verifyEmail uses up the verification token and saves its address on the
+// user it was sent for. It returns pgx.ErrNoRows if the token does not exist
+// or has expired.
+func verifyEmail(ctx context.Context, conn *pgxpool.Pool, token string) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		var userID int
+		var email string
+		err := tx.QueryRow(ctx, `
+DELETE FROM email_verifications
+WHERE token = $1
+AND expires_at > CURRENT_TIMESTAMP
+RETURNING user_id, email`, token).Scan(&userID, &email)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.Exec(ctx, `
+UPDATE users
+SET email = $2, email_verified_at = CURRENT_TIMESTAMP
+WHERE id = $1`, userID, email)
+		return err
+	})
+}
+
+func deleteUserEmail(ctx context.Context, conn *pgxpool.Pool, userID int) error {
+	_, err := conn.Exec(ctx, `
+UPDATE users
+SET email = NULL, email_verified_at = NULL
+WHERE id = $1`, userID)
+	return err
+}
+
+// getDigestRecipients returns every user with a verified email address who
+// wants the weekly digest.
+func getDigestRecipients(ctx context.Context, conn *pgxpool.Pool) ([]*User, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, username, timezone, email, weekly_digest, is_admin, disabled_at, created_at
+FROM users
+WHERE email IS NOT NULL
+AND weekly_digest = true
+AND disabled_at IS NULL`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(&user.ID, &user.Username, &user.Timezone, &user.Email, &user.WeeklyDigest, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// claimDigest records that the digest for the week starting at weekStart is
+// being sent to the user. It reports false if it already was.
+func claimDigest(ctx context.Context, conn *pgxpool.Pool, userID int, weekStart time.Time) (bool, error) {
+	tag, err := conn.Exec(ctx, `
+INSERT INTO digests (user_id, week_start)
+VALUES ($1, $2)
+ON CONFLICT (user_id, week_start) DO NOTHING`, userID, weekStart)
+	if err != nil {
+		return false, err
+	}
+
+	return tag.RowsAffected() == 1, nil
+}
+
+func releaseDigest(ctx context.Context, conn *pgxpool.Pool, userID int, weekStart time.Time) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM digests
+WHERE user_id = $1
+AND week_start = $2`, userID, weekStart)
+	return err
+}
+
+func getCompletionTimes(ctx context.Context, conn *pgxpool.Pool, taskID int, start, end time.Time) ([]time.Time, error) {
+	rows, err := conn.Query(ctx, `
+SELECT completed_at
+FROM completions
+WHERE task_id = $1
+AND completed_at >= $2
+AND completed_at < $3
+ORDER BY completed_at`, taskID, start, end)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	times := []time.Time{}
+	for rows.Next() {
+		var t time.Time
+		if err := rows.Scan(&t); err != nil {
+			return nil, err
+		}
+
+		times = append(times, t)
+	}
+
+	return times, rows.Err()
+}
+
+// getCompletionHistory returns the completions of each task in since from
+// the time given for it on, oldest first.
+func getCompletionHistory(ctx context.Context, conn *pgxpool.Pool, since map[int]time.Time) (map[int][]time.Time, error) {
+	ids := make([]int, 0, len(since))
+	starts := make([]time.Time, 0, len(since))
+	for id, start := range since {
+		ids = append(ids, id)
+		starts = append(starts, start)
+	}
+
+	rows, err := conn.Query(ctx, `
+SELECT c.task_id, c.completed_at
+FROM unnest($1::integer[], $2::timestamptz[]) AS w (task_id, since)
+JOIN completions c ON c.task_id = w.task_id AND c.completed_at >= w.since
+ORDER BY c.task_id, c.completed_at`, ids, starts)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	history := make(map[int][]time.Time, len(since))
+	for rows.Next() {
+		var id int
+		var t time.Time
+		if err := rows.Scan(&id, &t); err != nil {
+			return nil, err
+		}
+
+		history[id] = append(history[id], t)
+	}
+
+	return history, rows.Err()
+}
+
+// streamExport calls fn for each completion of each of the user's tasks, in
+// the order of the user's list and then of completion, without loading the
+// history into memory. Tasks without completions are passed once with a nil
+// completedAt.
+func streamExport(ctx context.Context, conn *pgxpool.Pool, userID int, fn func(task *Task, completedAt *time.Time) error) error {
+	rows, err := conn.Query(ctx, `
+SELECT t.id, t.user_id, t.name, COALESCE(t.description, ''), t.created_at, t.interval, t.archived_at, t.group_id, c.completed_at
+FROM tasks t
+LEFT JOIN completions c ON c.task_id = t.id
+WHERE t.user_id = $1
+ORDER BY t.position, t.id, c.completed_at`, userID)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	var task *Task
+	for rows.Next() {
+		var t Task
+		var interval string
+		var completedAt *time.Time
+		err := rows.Scan(&t.ID, &t.UserID, &t.Name, &t.Description, &t.CreatedAt, &interval, &t.ArchivedAt, &t.GroupID, &completedAt)
+		if err != nil {
+			return err
+		}
+		if task == nil || task.ID != t.ID {
+			t.Interval = fromString(interval)
+			task = &t
+		}
+
+		if err := fn(task, completedAt); err != nil {
+			return err
+		}
+	}
+
+	return rows.Err()
+}
+
+// errImportChanged is returned by saveImport when a task it merges into was
+// deleted after the import was planned.
+var errImportChanged = errors.New("tasks changed during import")
+
+// errImportDryRun rolls back a dry run once everything has been inserted.
+var errImportDryRun = errors.New("import dry run")
+
+// saveImport creates the planned tasks and inserts their completions in a
+// single transaction. On a dry run the transaction is rolled back, so that
+// the import is checked against the database without keeping anything.
+func saveImport(ctx context.Context, conn *pgxpool.Pool, userID int, plan *importPlan, dryRun bool) error {
+	err := pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		merged := []int{}
+		for _, p := range plan.tasks {
+			if p.taskID != 0 {
+				merged = append(merged, p.taskID)
+			}
+		}
+		if len(merged) > 0 {
+			var locked int
+			err := tx.QueryRow(ctx, `
+SELECT count(*)
+FROM (
+	SELECT id
+	FROM tasks
+	WHERE id = ANY($1)
+	AND user_id = $2
+	FOR UPDATE
+) t`, merged, userID).Scan(&locked)
+			if err != nil {
+				return err
+			}
+			if locked != len(merged) {
+				return errImportChanged
+			}
+		}
+
+		rows := [][]any{}
+		groups := map[string]*int{}
+		for _, p := range plan.tasks {
+			if p.taskID == 0 {
+				if p.task.Group != "" && groups[p.task.Group] == nil {
+					var groupID int
+					err := tx.QueryRow(ctx, `
+INSERT INTO task_groups (user_id, name)
+VALUES ($1, $2)
+ON CONFLICT (user_id, name) DO UPDATE SET name = EXCLUDED.name
+RETURNING id`, userID, p.task.Group).Scan(&groupID)
+					if err != nil {
+						return err
+					}
+					groups[p.task.Group] = &groupID
+				}
+
+				err := tx.QueryRow(ctx, `
+INSERT INTO tasks (name, user_id, description, interval, created_at, archived_at, group_id, position)
+VALUES ($1, $2, $3, $4, $5, $6, $7, (SELECT COALESCE(MAX(position), 0) + 1 FROM tasks WHERE user_id = $2))
+RETURNING id`, p.task.Name, userID, p.task.Description, p.interval.String(), p.createdAt, p.task.ArchivedAt, groups[p.task.Group]).Scan(&p.taskID)
+				if err != nil {
+					return err
+				}
+			}
+
+			for _, c := range p.completions {
+				rows = append(rows, []any{p.taskID, c})
+			}
+		}
+
+		if _, err := tx.CopyFrom(ctx, pgx.Identifier{"completions"}, []string{"task_id", "completed_at"}, pgx.CopyFromRows(rows)); err != nil {
+			return err
+		}
+
+		if dryRun {
+			return errImportDryRun
+		}
+		return nil
+	})
+	if errors.Is(err, errImportDryRun) {
+		return nil
+	}
+	return err
+}
+
+func insertCalendarFeed(ctx context.Context, conn *pgxpool.Pool, feed *CalendarFeed) error {
+	return conn.QueryRow(ctx, `
+INSERT INTO calendar_feeds (user_id, token)
+VALUES ($1, $2)
+RETURNING id, created_at`, feed.UserID, feed.Token).Scan(&feed.ID, &feed.CreatedAt)
+}
+
+func getCalendarFeeds(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*CalendarFeed, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, user_id, token, last_used_at, created_at
+FROM calendar_feeds
+WHERE user_id = $1
+ORDER BY id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	feeds := []*CalendarFeed{}
+	for rows.Next() {
+		feed := &CalendarFeed{}
+		err := rows.Scan(&feed.ID, &feed.UserID, &feed.Token, &feed.LastUsedAt, &feed.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		feeds = append(feeds, feed)
+	}
+
+	return feeds, rows.Err()
+}
+
+// deleteCalendarFeed revokes the user's feed. It returns pgx.ErrNoRows if the
+// user has no such feed.
+func deleteCalendarFeed(ctx context.Context, conn *pgxpool.Pool, userID, id int) error {
+	return conn.QueryRow(ctx, `
+DELETE FROM calendar_feeds
+WHERE id = $1
+AND user_id = $2
+RETURNING id`, id, userID).Scan(&id)
+}
+
+// useCalendarFeed returns the user the feed token belongs to, recording that
+// the feed was fetched.
+func useCalendarFeed(ctx context.Context, conn *pgxpool.Pool, token string) (*User, error) {
+	var userID int
+	err := conn.QueryRow(ctx, `
+UPDATE calendar_feeds
+SET last_used_at = CURRENT_TIMESTAMP
+WHERE token = $1
+RETURNING user_id`, token).Scan(&userID)
+	if err != nil {
+		return nil, err
+	}
+
+	return getUserByID(ctx, conn, userID)
+}
+
+// getUsers returns every user, oldest first.
+func getUsers(ctx context.Context, conn *pgxpool.Pool) ([]*User, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, username, timezone, COALESCE(email, ''), weekly_digest, is_admin, disabled_at, created_at
+FROM users
+ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*User{}
+	for rows.Next() {
+		user := &User{}
+		err := rows.Scan(&user.ID, &user.Username, &user.Timezone, &user.Email, &user.WeeklyDigest, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+// updateUserPassword sets a new password and deletes the user's sessions, so
+// that anyone holding one has to log in with it.
+func updateUserPassword(ctx context.Context, conn *pgxpool.Pool, userID int, password string) error {
+	passwordHash, err := hashPassword(password)
+	if err != nil {
+		return err
+	}
+
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		if _, err := tx.Exec(ctx, `UPDATE users SET password = $2 WHERE id = $1`, userID, passwordHash); err != nil {
+			return err
+		}
+		_, err := tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+// deleteSessions deletes sessions created before before, only those of the
+// user if userID is not zero, and returns how many were deleted.
+func deleteSessions(ctx context.Context, conn *pgxpool.Pool, userID int, before time.Time) (int64, error) {
+	tag, err := conn.Exec(ctx, `
+DELETE FROM sessions
+WHERE created_at < $1
+AND ($2 = 0 OR user_id = $2)`, before, userID)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+// deleteUser deletes the user. Everything that belongs to them goes with
+// them through the foreign keys on the user.
+func deleteUser(ctx context.Context, conn *pgxpool.Pool, id int) error {
+	tag, err := conn.Exec(ctx, `
+DELETE FROM users
+WHERE id = $1`, id)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// grantAdmins makes the named users admins and returns how many were not
+// already.
+func grantAdmins(ctx context.Context, conn *pgxpool.Pool, usernames []string) (int64, error) {
+	tag, err := conn.Exec(ctx, `
+UPDATE users
+SET is_admin = true
+WHERE username = ANY($1)
+AND is_admin = false`, usernames)
+	if err != nil {
+		return 0, err
+	}
+
+	return tag.RowsAffected(), nil
+}
+
+func updateUserAdmin(ctx context.Context, conn *pgxpool.Pool, userID int, isAdmin bool) error {
+	tag, err := conn.Exec(ctx, `
+UPDATE users
+SET is_admin = $2
+WHERE id = $1`, userID, isAdmin)
+	if err != nil {
+		return err
+	}
+	if tag.RowsAffected() == 0 {
+		return pgx.ErrNoRows
+	}
+
+	return nil
+}
+
+// updateUserDisabled disables or enables the user. Disabling also deletes
+// their sessions, so they are logged out everywhere at once.
+func updateUserDisabled(ctx context.Context, conn *pgxpool.Pool, userID int, disabled bool) error {
+	return pgx.BeginFunc(ctx, conn, func(tx pgx.Tx) error {
+		tag, err := tx.Exec(ctx, `
+UPDATE users
+SET disabled_at = CASE WHEN $2 THEN COALESCE(disabled_at, CURRENT_TIMESTAMP) END
+WHERE id = $1`, userID, disabled)
+		if err != nil {
+			return err
+		}
+		if tag.RowsAffected() == 0 {
+			return pgx.ErrNoRows
+		}
+
+		if !disabled {
+			return nil
+		}
+		_, err = tx.Exec(ctx, `DELETE FROM sessions WHERE user_id = $1`, userID)
+		return err
+	})
+}
+
+// getAdminUsers returns every user with their activity, oldest first. A
+// user's last activity is the latest of their logins, new tasks and
+// completions.
+func getAdminUsers(ctx context.Context, conn *pgxpool.Pool) ([]*AdminUser, error) {
+	rows, err := conn.Query(ctx, `
+SELECT u.id, u.username, u.timezone, COALESCE(u.email, ''), u.weekly_digest, u.is_admin, u.disabled_at, u.created_at,
+	(SELECT count(*) FROM tasks t WHERE t.user_id = u.id),
+	(SELECT count(*) FROM completions c JOIN tasks t ON t.id = c.task_id WHERE t.user_id = u.id),
+	(SELECT count(*) FROM sessions s WHERE s.user_id = u.id),
+	GREATEST(
+		(SELECT max(s.created_at) FROM sessions s WHERE s.user_id = u.id),
+		(SELECT max(t.created_at) FROM tasks t WHERE t.user_id = u.id),
+		(SELECT max(c.completed_at) FROM completions c JOIN tasks t ON t.id = c.task_id WHERE t.user_id = u.id)
+	)
+FROM users u
+ORDER BY u.id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	users := []*AdminUser{}
+	for rows.Next() {
+		user := &AdminUser{User: &User{}}
+		err := rows.Scan(&user.ID, &user.Username, &user.Timezone, &user.Email, &user.WeeklyDigest, &user.IsAdmin, &user.DisabledAt, &user.CreatedAt,
+			&user.Tasks, &user.Completions, &user.Sessions, &user.LastActiveAt)
+		if err != nil {
+			return nil, err
+		}
+
+		users = append(users, user)
+	}
+
+	return users, rows.Err()
+}
+
+func getInstanceStats(ctx context.Context, conn *pgxpool.Pool) (*InstanceStats, error) {
+	stats := &InstanceStats{}
+	err := conn.QueryRow(ctx, `
+SELECT
+	(SELECT count(*) FROM users),
+	(SELECT count(*) FROM users WHERE is_admin = true),
+	(SELECT count(*) FROM users WHERE disabled_at IS NOT NULL),
+	(SELECT count(DISTINCT t.user_id) FROM completions c JOIN tasks t ON t.id = c.task_id WHERE c.completed_at > CURRENT_TIMESTAMP - INTERVAL '7 days'),
+	(SELECT count(*) FROM tasks),
+	(SELECT count(*) FROM completions),
+	(SELECT count(*) FROM completions WHERE completed_at > CURRENT_TIMESTAMP - INTERVAL '7 days'),
+	(SELECT count(*) FROM sessions),
+	pg_database_size(current_database())`).Scan(
+		&stats.Users, &stats.Admins, &stats.DisabledUsers, &stats.ActiveUsers,
+		&stats.Tasks, &stats.Completions, &stats.RecentCompletions, &stats.Sessions, &stats.DatabaseBytes)
+	if err != nil {
+		return nil, err
+	}
+
+	return stats, nil
+}
+
+func getTaskPauses(ctx context.Context, conn *pgxpool.Pool, taskID int) ([]*TaskPause, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, task_id, starts_on, ends_on, created_at
+FROM task_pauses
+WHERE task_id = $1
+ORDER BY starts_on, id`, taskID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTaskPauses(rows)
+}
+
+// getPausesByTask returns the pauses of each of the tasks, by task ID.
+func getPausesByTask(ctx context.Context, conn *pgxpool.Pool, taskIDs []int) (map[int][]*TaskPause, error) {
+	rows, err := conn.Query(ctx, `
+SELECT id, task_id, starts_on, ends_on, created_at
+FROM task_pauses
+WHERE task_id = ANY($1)
+ORDER BY task_id, starts_on, id`, taskIDs)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	pauses, err := scanTaskPauses(rows)
+	if err != nil {
+		return nil, err
+	}
+
+	byTask := make(map[int][]*TaskPause, len(taskIDs))
+	for _, p := range pauses {
+		byTask[p.TaskID] = append(byTask[p.TaskID], p)
+	}
+	return byTask, nil
+}
+
+// getUserPauses returns the pauses of every task of the user.
+func getUserPauses(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*TaskPause, error) {
+	rows, err := conn.Query(ctx, `
+SELECT p.id, p.task_id, p.starts_on, p.ends_on, p.created_at
+FROM task_pauses p
+JOIN tasks t ON t.id = p.task_id
+WHERE t.user_id = $1
+ORDER BY p.task_id, p.starts_on, p.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanTaskPauses(rows)
+}
+
+func scanTaskPauses(rows pgx.Rows) ([]*TaskPause, error) {
+	pauses := []*TaskPause{}
+	for rows.Next() {
+		p := &TaskPause{}
+		if err := rows.Scan(&p.ID, &p.TaskID, &p.StartsOn, &p.EndsOn, &p.CreatedAt); err != nil {
+			return nil, err
+		}
+
+		pauses = append(pauses, p)
+	}
+
+	return pauses, rows.Err()
+}
+
+func insertTaskPause(ctx context.Context, conn *pgxpool.Pool, p *TaskPause) error {
+	return conn.QueryRow(ctx, `
+INSERT INTO task_pauses (task_id, starts_on, ends_on)
+VALUES ($1, $2, $3)
+RETURNING id, created_at`, p.TaskID, p.StartsOn, p.EndsOn).Scan(&p.ID, &p.CreatedAt)
+}
+
+func deleteTaskPause(ctx context.Context, conn *pgxpool.Pool, taskID, id int) error {
+	var deleted int
+	return conn.QueryRow(ctx, `
+DELETE FROM task_pauses
+WHERE id = $1
+AND task_id = $2
+RETURNING id`, id, taskID).Scan(&deleted)
+}
+
+// pauseTask pauses the task from today until it is resumed, unless a pause
+// already covers today.
+func pauseTask(ctx context.Context, tx pgx.Tx, taskID int, today time.Time) error {
+	_, err := tx.Exec(ctx, `
+INSERT INTO task_pauses (task_id, starts_on)
+SELECT $1::int, $2::date
+WHERE NOT EXISTS (
+	SELECT 1
+	FROM task_pauses
+	WHERE task_id = $1
+	AND starts_on <= $2
+	AND (ends_on IS NULL OR ends_on >= $2)
+)`, taskID, today)
+	return err
+}
+
+// resumeTask ends the pauses covering today as of yesterday, deleting those
+// that only started today. Pauses planned for later are left alone.
+func resumeTask(ctx context.Context, tx pgx.Tx, taskID int, today time.Time) error {
+	_, err := tx.Exec(ctx, `
+DELETE FROM task_pauses
+WHERE task_id = $1
+AND starts_on = $2`, taskID, today)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.Exec(ctx, `
+UPDATE task_pauses
+SET ends_on = $2::date - 1
+WHERE task_id = $1
+AND starts_on < $2
+AND (ends_on IS NULL OR ends_on >= $2)`, taskID, today)
+	return err
+}
+
+func getTaskGroups(ctx context.Context, conn *pgxpool.Pool, userID int) ([]*TaskGroup, error) {
+	rows, err := conn.Query(ctx, `
+SELECT g.id, g.user_id, g.name, g.created_at, COUNT(t.id)
+FROM task_groups g
+LEFT JOIN tasks t ON t.group_id = g.id
+WHERE g.user_id = $1
+GROUP BY g.id
+ORDER BY lower(g.name), g.id`, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	groups := []*TaskGroup{}
+	for rows.Next() {
+		g := &TaskGroup{}
+		if err := rows.Scan(&g.ID, &g.UserID, &g.Name, &g.CreatedAt, &g.Tasks); err != nil {
+			return nil, err
+		}
+
+		groups = append(groups, g)
+	}
+
+	return groups, rows.Err()
+}
+
+func getTaskGroup(ctx context.Context, conn *pgxpool.Pool, id int) (*TaskGroup, error) {
+	g := &TaskGroup{}
+	err := conn.QueryRow(ctx, `
+SELECT g.id, g.user_id, g.name, g.created_at, COUNT(t.id)
+FROM task_groups g
+LEFT JOIN tasks t ON t.group_id = g.id
+WHERE g.id = $1
+GROUP BY g.id`, id).Scan(&g.ID, &g.UserID, &g.Name, &g.CreatedAt, &g.Tasks)
+	if err != nil {
+		return nil, err
+	}
+
+	return g, nil
+}
+
+func insertTaskGroup(ctx context.Context, conn *pgxpool.Pool, g *TaskGroup) error {
+	return conn.QueryRow(ctx, `
+INSERT INTO task_groups (user_id, name)
+VALUES ($1, $2)
+RETURNING id, created_at`, g.UserID, g.Name).Scan(&g.ID, &g.CreatedAt)
+}
+
+func updateTaskGroup(ctx context.Context, conn *pgxpool.Pool, g *TaskGroup) error {
+	_, err := conn.Exec(ctx, `
+UPDATE task_groups
+SET name = $1
+WHERE id = $2`, g.Name, g.ID)
+	return err
+}
+
+// deleteTaskGroup deletes the group, leaving its tasks without one.
+func deleteTaskGroup(ctx context.Context, conn *pgxpool.Pool, id int) error {
+	_, err := conn.Exec(ctx, `
+DELETE FROM task_groups
+WHERE id = $1`, id)
+	return err
 }
@@ -1,6 +1,14 @@
 package main
 
-import "time"
+import (
+	"cmp"
+	"context"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
 
 type Task struct {
 	ID          int
@@ -9,18 +17,226 @@ type Task struct {
 	Description string
 	CreatedAt   time.Time
 	Interval    Interval
+	// ArchivedAt is set while the task is archived, which hides it from the
+	// task list without losing its history.
+	ArchivedAt *time.Time
+	// Position is where the user placed the task in their list, lowest
+	// first.
+	Position int
+	GroupID  *int
 }
 
 type TaskResponse struct {
-	ID                 int                  `json:"id"`
-	Name               string               `json:"name"`
-	Description        string               `json:"description"`
-	CreatedAt          time.Time            `json:"created_at"`
-	Interval           string               `json:"interval"`
-	IntervalsMap       map[string]bool `json:"intervals_map"`
+	ID           int             `json:"id"`
+	Name         string          `json:"name"`
+	Description  string          `json:"description"`
+	CreatedAt    time.Time       `json:"created_at"`
+	Interval     string          `json:"interval"`
+	IntervalsMap map[string]bool `json:"intervals_map"`
+	ArchivedAt   *time.Time      `json:"archived_at"`
+	// Paused reports whether a pause covers the current interval.
+	Paused bool `json:"paused"`
+	// PausedIntervals are the keys of IntervalsMap whose interval overlaps a
+	// pause.
+	PausedIntervals []string `json:"paused_intervals"`
+	Streak          int      `json:"streak"`
+	// NextDue is the end of the current interval, or of the next one once
+	// the current interval is done or paused.
+	NextDue  time.Time `json:"next_due"`
+	Position int       `json:"position"`
+	GroupID  *int      `json:"group_id"`
+}
+
+// taskSorts are the orders of the task list that depend on completions, by
+// name. The rest are sorted by the database, see taskOrders.
+var taskSorts = map[string]func(a, b TaskResponse) int{
+	"next_due": func(a, b TaskResponse) int { return a.NextDue.Compare(b.NextDue) },
+	"streak":   func(a, b TaskResponse) int { return cmp.Compare(a.Streak, b.Streak) },
+}
+
+// sortTasks sorts responses by the named order, descending when the name
+// starts with a minus. The sort is stable, so ties keep the order the tasks
+// were given in. Orders the database sorts in are left alone.
+func sortTasks(responses []TaskResponse, sort string) {
+	name, desc := strings.CutPrefix(sort, "-")
+	compare, ok := taskSorts[name]
+	if !ok {
+		return
+	}
+	slices.SortStableFunc(responses, func(a, b TaskResponse) int {
+		if desc {
+			return compare(b, a)
+		}
+		return compare(a, b)
+	})
+}
+
+// streakWindow is how many intervals of history are loaded at first to
+// work out streaks. Tasks whose streak runs past it load twice as many
+// again until the streak ends, so only long streaks cost more.
+const streakWindow = 64
+
+// historyStart returns where the last n intervals of task up to now begin in
+// loc, or where its first interval begins if that is later.
+func historyStart(task *Task, now time.Time, loc *time.Location, n int) time.Time {
+	start, _ := task.Interval.bounds(now.Add(-task.Interval.toTime() * time.Duration(n-1)).In(loc))
+	created, _ := task.Interval.bounds(task.CreatedAt.In(loc))
+	if start.Before(created) {
+		return created
+	}
+	return start
+}
+
+// streak counts the intervals in a row, up to the one containing now, that
+// have a completion. Paused intervals are skipped, and the current interval
+// only counts once it is done so that it does not break the streak while it
+// is still open. completions only go back to since, so it also reports
+// whether the streak ended there rather than running on past it.
+func streak(task *Task, completions []time.Time, pauses []*TaskPause, now, since time.Time, loc *time.Location) (int, bool) {
+	done := make(map[int64]bool, len(completions))
+	for _, c := range completions {
+		start, _ := task.Interval.bounds(c.In(loc))
+		done[start.Unix()] = true
+	}
+
+	n := 0
+	start, end := task.Interval.bounds(now.In(loc))
+	for current := true; end.After(task.CreatedAt); current = false {
+		if start.Before(since) {
+			return n, false
+		}
+		switch {
+		case done[start.Unix()]:
+			n++
+		case current, paused(pauses, loc, start, end):
+		default:
+			return n, true
+		}
+		start, end = task.Interval.bounds(start.Add(-time.Nanosecond))
+	}
+	return n, true
 }
 
 type Completion struct {
 	TaskID      int
 	CompletedAt time.Time
 }
+
+// newTaskResponse builds the response for a single task, see
+// newTaskResponses.
+func newTaskResponse(ctx context.Context, conn *pgxpool.Pool, task *Task, limit int, loc *time.Location) (*TaskResponse, error) {
+	responses, err := newTaskResponses(ctx, conn, []*Task{task}, limit, loc)
+	if err != nil {
+		return nil, err
+	}
+	return &responses[0], nil
+}
+
+// newTaskResponses builds the responses for tasks, marking which of the last
+// limit intervals of each have a completion and which are paused. Pauses
+// and streaks are worked out in loc, the user's time zone. The pauses and
+// completions of every task are loaded together, with one more query each
+// time a streak runs past the history loaded so far.
+func newTaskResponses(ctx context.Context, conn *pgxpool.Pool, tasks []*Task, limit int, loc *time.Location) ([]TaskResponse, error) {
+	if len(tasks) == 0 {
+		return []TaskResponse{}, nil
+	}
+
+	ids := make([]int, len(tasks))
+	for i, task := range tasks {
+		ids[i] = task.ID
+	}
+	pauses, err := getPausesByTask(ctx, conn, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	window := max(limit, streakWindow)
+	var recent map[int][]time.Time
+	streaks := make(map[int]int, len(tasks))
+
+	for pending, n := tasks, window; len(pending) > 0; n *= 2 {
+		since := make(map[int]time.Time, len(pending))
+		for _, task := range pending {
+			since[task.ID] = historyStart(task, now, loc, n)
+		}
+
+		history, err := getCompletionHistory(ctx, conn, since)
+		if err != nil {
+			return nil, err
+		}
+		if recent == nil {
+			recent = history
+		}
+
+		var longer []*Task
+		for _, task := range pending {
+			s, ended := streak(task, history[task.ID], pauses[task.ID], now, since[task.ID], loc)
+			if !ended {
+				longer = append(longer, task)
+				continue
+			}
+			streaks[task.ID] = s
+		}
+		pending = longer
+	}
+
+	responses := make([]TaskResponse, len(tasks))
+	for i, task := range tasks {
+		responses[i] = taskResponse(task, recent[task.ID], pauses[task.ID], streaks[task.ID], limit, now, loc)
+	}
+	return responses, nil
+}
+
+// taskResponse builds the response for task from its completions, which
+// must go back at least limit intervals, and its pauses.
+func taskResponse(task *Task, completions []time.Time, pauses []*TaskPause, streak, limit int, now time.Time, loc *time.Location) TaskResponse {
+	layout := Layout
+	if task.Interval == Hourly {
+		layout = LayoutHourly
+	}
+	unit := task.Interval.toTime()
+	date := now.Add(-unit * time.Duration(limit-1))
+
+	intervalsMap := make(map[string]bool)
+	pausedIntervals := []string{}
+	for j := 0; j < limit; j++ {
+		t := date.Add(time.Duration(j) * unit)
+		timestamp := t.Format(layout)
+		intervalsMap[timestamp] = false
+
+		if start, end := task.Interval.bounds(t.In(loc)); paused(pauses, loc, start, end) {
+			pausedIntervals = append(pausedIntervals, timestamp)
+		}
+	}
+
+	for _, c := range completions {
+		if c.After(date) {
+			intervalsMap[c.Format(layout)] = true
+		}
+	}
+
+	start, end := task.Interval.bounds(now.In(loc))
+	current := paused(pauses, loc, start, end)
+	nextDue := end
+	if current || slices.ContainsFunc(completions, func(c time.Time) bool { return !c.Before(start) }) {
+		_, nextDue = task.Interval.bounds(end)
+	}
+
+	return TaskResponse{
+		ID:              task.ID,
+		Name:            task.Name,
+		Description:     task.Description,
+		CreatedAt:       task.CreatedAt,
+		Interval:        task.Interval.String(),
+		IntervalsMap:    intervalsMap,
+		ArchivedAt:      task.ArchivedAt,
+		Paused:          current,
+		PausedIntervals: pausedIntervals,
+		Streak:          streak,
+		NextDue:         nextDue,
+		Position:        task.Position,
+		GroupID:         task.GroupID,
+	}
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestStreak(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	task := &Task{Interval: Daily, CreatedAt: now.AddDate(0, 0, -30)}
+
+	// Done on each of the five days before today, but not the sixth.
+	var completions []time.Time
+	for d := 1; d <= 5; d++ {
+		completions = append(completions, now.AddDate(0, 0, -d))
+	}
+
+	if n, ended := streak(task, completions, nil, now, historyStart(task, now, time.UTC, 64), time.UTC); n != 5 || !ended {
+		t.Fatalf("got streak %d, ended %v, want 5 and true", n, ended)
+	}
+
+	// With only three days of history the streak outruns it.
+	since := historyStart(task, now, time.UTC, 4)
+	if n, ended := streak(task, completions, nil, now, since, time.UTC); n != 3 || ended {
+		t.Fatalf("got streak %d, ended %v, want 3 and false", n, ended)
+	}
+
+	// A pause bridges the missed day.
+	missed := now.AddDate(0, 0, -6)
+	pauses := []*TaskPause{{StartsOn: missed, EndsOn: &missed}}
+	completions = append(completions, now.AddDate(0, 0, -7))
+	if n, _ := streak(task, completions, pauses, now, historyStart(task, now, time.UTC, 64), time.UTC); n != 6 {
+		t.Fatalf("got streak %d across a pause, want 6", n)
+	}
+}
+
+func TestHistoryStart(t *testing.T) {
+	now := time.Date(2026, 3, 10, 12, 0, 0, 0, time.UTC)
+	task := &Task{Interval: Weekly, CreatedAt: now.AddDate(0, 0, -20)}
+
+	// The first week starts on the Monday before the task was created.
+	if got, want := historyStart(task, now, time.UTC, 64), time.Date(2026, 2, 16, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := historyStart(task, now, time.UTC, 2), time.Date(2026, 3, 2, 0, 0, 0, 0, time.UTC); !got.Equal(want) {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+}
@@ -23,6 +23,11 @@ type Session struct {
 	CreatedAt time.Time
 }
 
+type TokenResponse struct {
+	Token     string `json:"token"`
+	TokenType string `json:"token_type"`
+}
+
 func newToken() string {
 	b := make([]byte, 16)
 	_, _ = rand.Read(b)
@@ -32,9 +37,26 @@ func newToken() string {
 type UserKey string
 
 type User struct {
-	ID        int
-	Username  string
-	CreatedAt time.Time
+	ID       int
+	Username string
+	Timezone string
+	// Email is the user's verified email address, if any.
+	Email        string
+	WeeklyDigest bool
+	IsAdmin      bool
+	// DisabledAt is set while an admin has disabled the account.
+	DisabledAt *time.Time
+	CreatedAt  time.Time
+}
+
+// location returns the user's time zone, falling back to UTC if it is not
+// known.
+func (u *User) location() *time.Location {
+	loc, err := time.LoadLocation(u.Timezone)
+	if err != nil {
+		return time.UTC
+	}
+	return loc
 }
 
 func hashPassword(password string) (string, error) {
@@ -86,3 +108,28 @@ func (i Interval) toTime() time.Duration {
 		return 0
 	}
 }
+
+// bounds returns the start and end of the calendar interval containing t, in
+// t's location. Weeks start on Monday.
+func (i Interval) bounds(t time.Time) (time.Time, time.Time) {
+	y, m, d := t.Date()
+	loc := t.Location()
+
+	switch i {
+	case Hourly:
+		start := time.Date(y, m, d, t.Hour(), 0, 0, 0, loc)
+		return start, start.Add(time.Hour)
+	case Daily:
+		start := time.Date(y, m, d, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 1)
+	case Weekly:
+		offset := (int(t.Weekday()) + 6) % 7
+		start := time.Date(y, m, d-offset, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 0, 7)
+	case Monthly:
+		start := time.Date(y, m, 1, 0, 0, 0, 0, loc)
+		return start, start.AddDate(0, 1, 0)
+	default:
+		return t, t
+	}
+}
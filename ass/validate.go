@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/base64"
+	"net/mail"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	maxNameLength        = 255
+	maxDescriptionLength = 4096
+	maxURLLength         = 2048
+	// bcrypt ignores everything past the first 72 bytes of a password.
+	maxPasswordLength = 72
+)
+
+// FieldErrors maps a request field to a description of what is wrong with it.
+type FieldErrors map[string]string
+
+func (fe FieldErrors) add(field, message string) {
+	if _, ok := fe[field]; !ok {
+		fe[field] = message
+	}
+}
+
+func validateTask(t Task) FieldErrors {
+	fe := FieldErrors{}
+
+	if strings.TrimSpace(t.Name) == "" {
+		fe.add("name", "name is required")
+	} else if utf8.RuneCountInString(t.Name) > maxNameLength {
+		fe.add("name", "name must be at most 255 characters")
+	}
+
+	if utf8.RuneCountInString(t.Description) > maxDescriptionLength {
+		fe.add("description", "description must be at most 4096 characters")
+	}
+
+	if t.Interval < Hourly || t.Interval > Monthly {
+		fe.add("interval", "interval must be one of hourly, daily, weekly or monthly")
+	}
+
+	return fe
+}
+
+func validateCredentials(username, password string) FieldErrors {
+	fe := FieldErrors{}
+
+	if strings.TrimSpace(username) == "" {
+		fe.add("username", "username is required")
+	} else if utf8.RuneCountInString(username) > maxNameLength {
+		fe.add("username", "username must be at most 255 characters")
+	}
+
+	if password == "" {
+		fe.add("password", "password is required")
+	} else if len(password) > maxPasswordLength {
+		fe.add("password", "password must be at most 72 bytes")
+	}
+
+	return fe
+}
+
+func validateReminderSettings(task *Task, req ReminderSettingsRequest) (*ReminderSettings, FieldErrors) {
+	fe := FieldErrors{}
+	rs := &ReminderSettings{
+		TaskID:      task.ID,
+		Enabled:     req.Enabled,
+		LeadMinutes: req.LeadMinutes,
+	}
+
+	if rs.LeadMinutes == 0 {
+		rs.LeadMinutes = defaultLeadMinutes
+	}
+	if maxLead := int(task.Interval.toTime() / time.Minute); rs.LeadMinutes < 1 || rs.LeadMinutes > maxLead {
+		fe.add("lead_minutes", "lead_minutes must be between 1 and the length of the task interval")
+	}
+
+	if (req.QuietHoursStart == nil) != (req.QuietHoursEnd == nil) {
+		fe.add("quiet_hours_start", "quiet_hours_start and quiet_hours_end must be set together")
+		return rs, fe
+	}
+
+	if req.QuietHoursStart != nil {
+		start, err := parseMinuteOfDay(*req.QuietHoursStart)
+		if err != nil {
+			fe.add("quiet_hours_start", "quiet_hours_start must look like 22:00")
+		}
+		end, err := parseMinuteOfDay(*req.QuietHoursEnd)
+		if err != nil {
+			fe.add("quiet_hours_end", "quiet_hours_end must look like 07:00")
+		}
+		rs.QuietHoursStart = &start
+		rs.QuietHoursEnd = &end
+	}
+
+	return rs, fe
+}
+
+func validateTaskPause(task *Task, req TaskPauseRequest) (*TaskPause, FieldErrors) {
+	fe := FieldErrors{}
+	p := &TaskPause{TaskID: task.ID}
+
+	startsOn, err := time.Parse(time.DateOnly, req.StartsOn)
+	if err != nil {
+		fe.add("starts_on", "starts_on must be a date such as 2024-07-01")
+	}
+	p.StartsOn = startsOn
+
+	if req.EndsOn != nil {
+		endsOn, err := time.Parse(time.DateOnly, *req.EndsOn)
+		if err != nil {
+			fe.add("ends_on", "ends_on must be a date such as 2024-07-14")
+		} else if endsOn.Before(startsOn) {
+			fe.add("ends_on", "ends_on must not be before starts_on")
+		}
+		p.EndsOn = &endsOn
+	}
+
+	return p, fe
+}
+
+func validateTaskGroup(name string) FieldErrors {
+	fe := FieldErrors{}
+
+	if strings.TrimSpace(name) == "" {
+		fe.add("name", "name is required")
+	} else if utf8.RuneCountInString(name) > maxNameLength {
+		fe.add("name", "name must be at most 255 characters")
+	}
+
+	return fe
+}
+
+func validateTaskOrder(ids []int) FieldErrors {
+	fe := FieldErrors{}
+
+	if len(ids) == 0 {
+		fe.add("task_ids", "task_ids is required")
+	}
+
+	seen := make(map[int]bool, len(ids))
+	for _, id := range ids {
+		if seen[id] {
+			fe.add("task_ids", "task_ids must not repeat a task")
+			break
+		}
+		seen[id] = true
+	}
+
+	return fe
+}
+
+func validateTimezone(timezone string) FieldErrors {
+	fe := FieldErrors{}
+
+	if timezone == "" {
+		fe.add("timezone", "timezone is required")
+	} else if _, err := time.LoadLocation(timezone); err != nil || timezone == "Local" {
+		fe.add("timezone", "timezone must be an IANA time zone such as Europe/Berlin")
+	}
+
+	return fe
+}
+
+func validateWebhook(req WebhookRequest) FieldErrors {
+	fe := FieldErrors{}
+
+	if req.URL == "" {
+		fe.add("url", "url is required")
+	} else if u, err := url.Parse(req.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		fe.add("url", "url must be an absolute http or https URL")
+	} else if len(req.URL) > maxURLLength {
+		fe.add("url", "url must be at most 2048 characters")
+	} else if privateHost(u) {
+		fe.add("url", "url must not point to a loopback, private or link-local address")
+	}
+
+	if len(req.Events) == 0 {
+		fe.add("events", "events must name at least one event")
+	}
+	for _, event := range req.Events {
+		if !slices.Contains(webhookEvents, event) {
+			fe.add("events", "events must be task.created, task.updated, task.deleted, completion.created or interval.missed")
+		}
+	}
+
+	return fe
+}
+
+func validatePushSubscription(req PushSubscriptionRequest) FieldErrors {
+	fe := FieldErrors{}
+
+	if u, err := url.Parse(req.Endpoint); err != nil || u.Scheme != "https" || u.Host == "" {
+		fe.add("endpoint", "endpoint must be an https URL")
+	} else if len(req.Endpoint) > maxURLLength {
+		fe.add("endpoint", "endpoint must be at most 2048 characters")
+	} else if privateHost(u) {
+		fe.add("endpoint", "endpoint must not point to a loopback, private or link-local address")
+	}
+
+	if key, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Keys.P256dh, "=")); err != nil || len(key) != 65 {
+		fe.add("keys.p256dh", "keys.p256dh must be a base64url encoded P-256 public key")
+	}
+	if auth, err := base64.RawURLEncoding.DecodeString(strings.TrimRight(req.Keys.Auth, "=")); err != nil || len(auth) != 16 {
+		fe.add("keys.auth", "keys.auth must be a base64url encoded 16 byte secret")
+	}
+
+	return fe
+}
+
+func validateEmail(email string) FieldErrors {
+	fe := FieldErrors{}
+
+	if email == "" {
+		fe.add("email", "email is required")
+	} else if addr, err := mail.ParseAddress(email); err != nil || addr.Address != email {
+		fe.add("email", "email must be an address such as name@example.com")
+	} else if len(email) > maxNameLength {
+		fe.add("email", "email must be at most 255 characters")
+	}
+
+	return fe
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// checkFieldErrors fails unless fe has errors for exactly the fields in
+// want.
+func checkFieldErrors(t *testing.T, name string, fe FieldErrors, want ...string) {
+	t.Helper()
+	got := slices.Sorted(maps.Keys(fe))
+	slices.Sort(want)
+	if !slices.Equal(got, want) {
+		t.Errorf("%s: got errors for %q, want %q: %v", name, got, want, fe)
+	}
+}
+
+func TestValidateTask(t *testing.T) {
+	tests := []struct {
+		name string
+		task Task
+		want []string
+	}{
+		{"valid", Task{Name: "Stretch", Interval: Daily}, nil},
+		{"longest name", Task{Name: strings.Repeat("é", maxNameLength), Interval: Monthly}, nil},
+		{"empty name", Task{Interval: Daily}, []string{"name"}},
+		{"blank name", Task{Name: " \t\n", Interval: Daily}, []string{"name"}},
+		{"long name", Task{Name: strings.Repeat("a", maxNameLength+1), Interval: Daily}, []string{"name"}},
+		{"long description", Task{Name: "Stretch", Description: strings.Repeat("a", maxDescriptionLength+1), Interval: Daily}, []string{"description"}},
+		{"unknown interval", Task{Name: "Stretch", Interval: fromString("Yearly")}, []string{"interval"}},
+		{"everything wrong", Task{Description: strings.Repeat("a", maxDescriptionLength+1)}, []string{"name", "description", "interval"}},
+	}
+
+	for _, tt := range tests {
+		checkFieldErrors(t, tt.name, validateTask(tt.task), tt.want...)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	tests := []struct {
+		name               string
+		username, password string
+		want               []string
+	}{
+		{"valid", "alice", "correct horse", nil},
+		{"blank username", "  ", "correct horse", []string{"username"}},
+		{"long username", strings.Repeat("a", maxNameLength+1), "correct horse", []string{"username"}},
+		{"no password", "alice", "", []string{"password"}},
+		// The limit is in bytes since that is what bcrypt reads.
+		{"long password", "alice", strings.Repeat("é", maxPasswordLength/2+1), []string{"password"}},
+		{"nothing", "", "", []string{"username", "password"}},
+	}
+
+	for _, tt := range tests {
+		checkFieldErrors(t, tt.name, validateCredentials(tt.username, tt.password), tt.want...)
+	}
+}
+
+func TestValidateTaskGroup(t *testing.T) {
+	tests := []struct {
+		name  string
+		group string
+		want  []string
+	}{
+		{"valid", "Health", nil},
+		{"longest name", strings.Repeat("é", maxNameLength), nil},
+		{"empty", "", []string{"name"}},
+		{"blank", " \t ", []string{"name"}},
+		{"long", strings.Repeat("a", maxNameLength+1), []string{"name"}},
+	}
+
+	for _, tt := range tests {
+		checkFieldErrors(t, tt.name, validateTaskGroup(tt.group), tt.want...)
+	}
+}
+
+func TestValidateTaskOrder(t *testing.T) {
+	checkFieldErrors(t, "valid", validateTaskOrder([]int{3, 1, 2}))
+	checkFieldErrors(t, "empty", validateTaskOrder(nil), "task_ids")
+	checkFieldErrors(t, "repeated", validateTaskOrder([]int{1, 2, 1}), "task_ids")
+}
+
+func TestValidateTimezone(t *testing.T) {
+	checkFieldErrors(t, "valid", validateTimezone("Europe/Berlin"))
+	checkFieldErrors(t, "UTC", validateTimezone("UTC"))
+	checkFieldErrors(t, "empty", validateTimezone(""), "timezone")
+	checkFieldErrors(t, "unknown", validateTimezone("Mars/Olympus_Mons"), "timezone")
+	// Local is the server's zone rather than the user's.
+	checkFieldErrors(t, "Local", validateTimezone("Local"), "timezone")
+}
+
+func TestValidateEmail(t *testing.T) {
+	checkFieldErrors(t, "valid", validateEmail("alice@example.com"))
+	checkFieldErrors(t, "empty", validateEmail(""), "email")
+	checkFieldErrors(t, "not an address", validateEmail("alice"), "email")
+	checkFieldErrors(t, "with a display name", validateEmail("Alice <alice@example.com>"), "email")
+	checkFieldErrors(t, "long", validateEmail(strings.Repeat("a", maxNameLength)+"@example.com"), "email")
+}
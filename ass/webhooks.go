@@ -0,0 +1,586 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const (
+	EventTaskCreated       = "task.created"
+	EventTaskUpdated       = "task.updated"
+	EventTaskDeleted       = "task.deleted"
+	EventCompletionCreated = "completion.created"
+	EventIntervalMissed    = "interval.missed"
+	// EventPing is only sent by the ping endpoint and cannot be subscribed to.
+	EventPing = "ping"
+)
+
+var webhookEvents = []string{
+	EventTaskCreated,
+	EventTaskUpdated,
+	EventTaskDeleted,
+	EventCompletionCreated,
+	EventIntervalMissed,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryFailed    = "failed"
+)
+
+const (
+	webhookEventHeader     = "X-DIDT-Event"
+	webhookDeliveryHeader  = "X-DIDT-Delivery"
+	webhookSignatureHeader = "X-DIDT-Signature"
+)
+
+const (
+	// webhookBatchSize is the most deliveries the worker attempts per poll.
+	webhookBatchSize = 20
+	// webhookBaseBackoff is the wait after the first failed attempt; it
+	// doubles with each further attempt up to webhookMaxBackoff.
+	webhookBaseBackoff = 30 * time.Second
+	webhookMaxBackoff  = 6 * time.Hour
+	// missedCheckInterval is how often closed intervals are checked for
+	// interval.missed events.
+	missedCheckInterval = time.Minute
+	// deliveryLogLimit is how many deliveries the delivery log returns.
+	deliveryLogLimit = 50
+)
+
+// Webhook is a URL that receives the events it subscribed to, signed with
+// its secret.
+type Webhook struct {
+	ID        int
+	UserID    int
+	URL       string
+	Secret    string
+	Events    []string
+	Active    bool
+	CreatedAt time.Time
+}
+
+// WebhookDelivery is one event queued for a webhook, along with the outcome
+// of the latest attempt to deliver it.
+type WebhookDelivery struct {
+	ID             int
+	WebhookID      int
+	Event          string
+	EventKey       string
+	Payload        []byte
+	Status         string
+	Attempts       int
+	NextAttemptAt  time.Time
+	LastStatusCode *int
+	LastError      *string
+	CreatedAt      time.Time
+	DeliveredAt    *time.Time
+}
+
+// MissedIntervalCandidate is a task checked for interval.missed events.
+type MissedIntervalCandidate struct {
+	Task *Task
+	User *User
+}
+
+type WebhookRequest struct {
+	URL    string   `json:"url"`
+	Events []string `json:"events"`
+}
+
+type WebhookResponse struct {
+	ID        int       `json:"id"`
+	URL       string    `json:"url"`
+	Events    []string  `json:"events"`
+	Active    bool      `json:"active"`
+	CreatedAt time.Time `json:"created_at"`
+	// Secret is only returned when the webhook is created.
+	Secret string `json:"secret,omitempty"`
+}
+
+type WebhookDeliveryResponse struct {
+	ID             int        `json:"id"`
+	Event          string     `json:"event"`
+	Status         string     `json:"status"`
+	Attempts       int        `json:"attempts"`
+	NextAttemptAt  *time.Time `json:"next_attempt_at"`
+	LastStatusCode *int       `json:"last_status_code"`
+	LastError      *string    `json:"last_error"`
+	CreatedAt      time.Time  `json:"created_at"`
+	DeliveredAt    *time.Time `json:"delivered_at"`
+}
+
+// WebhookPayload is the body POSTed to a webhook.
+type WebhookPayload struct {
+	Event     string    `json:"event"`
+	CreatedAt time.Time `json:"created_at"`
+	Data      any       `json:"data"`
+}
+
+type TaskEventData struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	Interval    string    `json:"interval"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type CompletionEventData struct {
+	Task        TaskEventData `json:"task"`
+	CompletedAt time.Time     `json:"completed_at"`
+}
+
+type IntervalMissedEventData struct {
+	Task          TaskEventData `json:"task"`
+	IntervalStart time.Time     `json:"interval_start"`
+	IntervalEnd   time.Time     `json:"interval_end"`
+}
+
+func newTaskEventData(task *Task) TaskEventData {
+	return TaskEventData{
+		ID:          task.ID,
+		Name:        task.Name,
+		Description: task.Description,
+		Interval:    task.Interval.String(),
+		CreatedAt:   task.CreatedAt,
+	}
+}
+
+func newCompletionEventData(task *Task, c *Completion) CompletionEventData {
+	return CompletionEventData{
+		Task:        newTaskEventData(task),
+		CompletedAt: c.CompletedAt,
+	}
+}
+
+func newWebhookResponse(hook *Webhook) WebhookResponse {
+	return WebhookResponse{
+		ID:        hook.ID,
+		URL:       hook.URL,
+		Events:    hook.Events,
+		Active:    hook.Active,
+		CreatedAt: hook.CreatedAt,
+	}
+}
+
+func newWebhookDeliveryResponse(d *WebhookDelivery) WebhookDeliveryResponse {
+	resp := WebhookDeliveryResponse{
+		ID:             d.ID,
+		Event:          d.Event,
+		Status:         d.Status,
+		Attempts:       d.Attempts,
+		LastStatusCode: d.LastStatusCode,
+		LastError:      d.LastError,
+		CreatedAt:      d.CreatedAt,
+		DeliveredAt:    d.DeliveredAt,
+	}
+	if d.Status == DeliveryPending {
+		resp.NextAttemptAt = &d.NextAttemptAt
+	}
+	return resp
+}
+
+func newWebhookPayload(event string, data any) ([]byte, error) {
+	return json.Marshal(WebhookPayload{
+		Event:     event,
+		CreatedAt: time.Now().UTC(),
+		Data:      data,
+	})
+}
+
+// emitEvent queues event for every active webhook of the user subscribed to
+// it. Failing to queue an event must not fail the request that caused it, so
+// errors are only logged.
+func emitEvent(ctx context.Context, conn *pgxpool.Pool, userID int, event string, data any) {
+	emitEventOnce(ctx, conn, userID, event, event+":"+newToken(), data)
+}
+
+// emitEventOnce is emitEvent for events that may be noticed more than once.
+// The event is queued at most once per webhook for each key.
+func emitEventOnce(ctx context.Context, conn *pgxpool.Pool, userID int, event, key string, data any) {
+	payload, err := newWebhookPayload(event, data)
+	if err != nil {
+		loggerFrom(ctx).Error("Unable to encode webhook payload", "event", event, "error", err.Error())
+		return
+	}
+
+	if err := enqueueWebhookDeliveries(ctx, conn, userID, event, key, payload); err != nil {
+		loggerFrom(ctx).Error("Unable to queue webhook deliveries", "event", event, "error", err.Error())
+	}
+}
+
+// signWebhook returns the signature header for body sent at t. Receivers
+// compute HMAC-SHA256 over "<t>.<body>" with the webhook secret and compare
+// it to v1, rejecting old timestamps to prevent replays.
+func signWebhook(secret string, t time.Time, body []byte) string {
+	ts := strconv.FormatInt(t.Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts))
+	mac.Write([]byte("."))
+	mac.Write(body)
+
+	return fmt.Sprintf("t=%s,v1=%s", ts, hex.EncodeToString(mac.Sum(nil)))
+}
+
+// webhookBackoff returns how long to wait before retrying a delivery that has
+// failed attempts times.
+func webhookBackoff(attempts int) time.Duration {
+	backoff := webhookBaseBackoff
+	for i := 1; i < attempts; i++ {
+		backoff *= 2
+		if backoff >= webhookMaxBackoff {
+			return webhookMaxBackoff
+		}
+	}
+	return backoff
+}
+
+// sendWebhook POSTs the delivery to the webhook and returns the response
+// status code. Any status other than 2xx is an error. The response body is
+// never kept, as the delivery log would otherwise let users read responses
+// from servers they can reach but not we.
+func sendWebhook(ctx context.Context, client *http.Client, hook *Webhook, d *WebhookDelivery) (int, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, hook.URL, bytes.NewReader(d.Payload))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "DidIDoThat-Webhook/1")
+	req.Header.Set(webhookEventHeader, d.Event)
+	req.Header.Set(webhookDeliveryHeader, strconv.Itoa(d.ID))
+	req.Header.Set(webhookSignatureHeader, signWebhook(hook.Secret, time.Now(), d.Payload))
+
+	res, err := client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer res.Body.Close()
+
+	_, _ = io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return res.StatusCode, fmt.Errorf("webhook responded %d", res.StatusCode)
+	}
+
+	return res.StatusCode, nil
+}
+
+// attemptDelivery sends the delivery once and records the outcome on d,
+// scheduling a retry or giving up after maxAttempts. Only the status code is
+// recorded when the webhook responded; the error is kept when it did not.
+func attemptDelivery(ctx context.Context, client *http.Client, hook *Webhook, d *WebhookDelivery, maxAttempts int) {
+	status, err := sendWebhook(ctx, client, hook, d)
+	now := time.Now()
+
+	d.Attempts++
+	d.LastStatusCode = nil
+	d.LastError = nil
+	if status != 0 {
+		d.LastStatusCode = &status
+	}
+
+	if err != nil && status == 0 {
+		msg := err.Error()
+		d.LastError = &msg
+	}
+
+	switch {
+	case err == nil:
+		d.Status = DeliveryDelivered
+		d.DeliveredAt = &now
+	case d.Attempts >= maxAttempts:
+		d.Status = DeliveryFailed
+	default:
+		d.Status = DeliveryPending
+		d.NextAttemptAt = now.Add(webhookBackoff(d.Attempts))
+	}
+
+	metrics.webhookDeliveries.Inc(d.Status)
+}
+
+// deliveryFailureAttrs returns the log attributes of a failed attempt, with
+// the status code when the webhook responded and the error when it did not.
+func deliveryFailureAttrs(hook *Webhook, d *WebhookDelivery) []any {
+	attrs := []any{"webhook_id", hook.ID, "delivery_id", d.ID, "attempts", d.Attempts}
+	if d.LastStatusCode != nil {
+		attrs = append(attrs, "status_code", *d.LastStatusCode)
+	}
+	if d.LastError != nil {
+		attrs = append(attrs, "error", *d.LastError)
+	}
+	return attrs
+}
+
+// runWebhooks delivers queued webhook events every cfg.WebhookPollInterval
+// and checks for missed intervals until ctx is cancelled.
+func runWebhooks(ctx context.Context, cfg *Config, conn *pgxpool.Pool) {
+	client := newOutboundClient(cfg.WebhookTimeout)
+
+	poll := time.NewTicker(cfg.WebhookPollInterval)
+	defer poll.Stop()
+	missed := time.NewTicker(missedCheckInterval)
+	defer missed.Stop()
+
+	for {
+		if err := deliverWebhooks(ctx, cfg, conn, client); err != nil {
+			logger.Error("Unable to deliver webhooks", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-poll.C:
+		case <-missed.C:
+			if err := checkMissedIntervals(ctx, conn, time.Now()); err != nil {
+				logger.Error("Unable to check missed intervals", "error", err.Error())
+			}
+		}
+	}
+}
+
+// deliverWebhooks attempts every delivery that is due. Claimed deliveries are
+// leased for longer than an attempt can take so that other instances skip
+// them.
+func deliverWebhooks(ctx context.Context, cfg *Config, conn *pgxpool.Pool, client *http.Client) error {
+	deliveries, err := claimWebhookDeliveries(ctx, conn, webhookBatchSize, 2*cfg.WebhookTimeout)
+	if err != nil {
+		return err
+	}
+
+	for _, d := range deliveries {
+		hook, err := getWebhook(ctx, conn, d.WebhookID)
+		if err != nil {
+			return err
+		}
+
+		attemptDelivery(ctx, client, hook, d, cfg.WebhookMaxAttempts)
+		if d.Status != DeliveryDelivered {
+			logger.Warn("Unable to deliver webhook", deliveryFailureAttrs(hook, d)...)
+		}
+
+		if err := updateWebhookDelivery(ctx, conn, d); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkMissedIntervals queues interval.missed for each task whose previous
+// interval closed without a completion and was not paused. Only the most
+// recent interval is checked, so intervals that closed while the server was
+// down are not reported.
+func checkMissedIntervals(ctx context.Context, conn *pgxpool.Pool, now time.Time) error {
+	candidates, err := getMissedIntervalCandidates(ctx, conn)
+	if err != nil {
+		return err
+	}
+
+	for _, c := range candidates {
+		current, _ := c.Task.Interval.bounds(now.In(c.User.location()))
+		start, end := c.Task.Interval.bounds(current.Add(-time.Nanosecond))
+
+		if c.Task.CreatedAt.After(start) {
+			continue
+		}
+
+		done, err := hasCompletionBetween(ctx, conn, c.Task.ID, start, end)
+		if err != nil {
+			return err
+		}
+		if done {
+			continue
+		}
+
+		pauses, err := getTaskPauses(ctx, conn, c.Task.ID)
+		if err != nil {
+			return err
+		}
+		if paused(pauses, c.User.location(), start, end) {
+			continue
+		}
+
+		key := fmt.Sprintf("%s:%d:%d", EventIntervalMissed, c.Task.ID, start.Unix())
+		emitEventOnce(ctx, conn, c.User.ID, EventIntervalMissed, key, IntervalMissedEventData{
+			Task:          newTaskEventData(c.Task),
+			IntervalStart: start,
+			IntervalEnd:   end,
+		})
+	}
+
+	return nil
+}
+
+// webhookFromPath loads the webhook named by the webhookId path value,
+// writing an error response and returning false if it does not exist or
+// belongs to another user.
+func webhookFromPath(w http.ResponseWriter, r *http.Request, conn *pgxpool.Pool) (*Webhook, bool) {
+	user := r.Context().Value(UserKey("user")).(*User)
+
+	webhookID, err := strconv.Atoi(r.PathValue("webhookId"))
+	if err != nil {
+		writeFieldErrors(w, FieldErrors{"webhook_id": "webhook_id must be an integer"})
+		return nil, false
+	}
+
+	hook, err := getWebhook(r.Context(), conn, webhookID)
+	if err != nil {
+		writeStoreError(w, r, err, "Unable to get webhook")
+		return nil, false
+	}
+	if hook.UserID != user.ID {
+		writeError(w, http.StatusNotFound, CodeNotFound, "resource not found")
+		return nil, false
+	}
+
+	return hook, true
+}
+
+func handleGetWebhooks(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		hooks, err := getWebhooks(r.Context(), conn, user.ID)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get webhooks")
+			return
+		}
+
+		responses := make([]WebhookResponse, len(hooks))
+		for i, hook := range hooks {
+			responses[i] = newWebhookResponse(hook)
+		}
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+func handleCreateWebhook(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user := r.Context().Value(UserKey("user")).(*User)
+
+		var body WebhookRequest
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			writeError(w, http.StatusBadRequest, CodeBadRequest, "request body must be valid JSON")
+			loggerFrom(r.Context()).Error("Unable to decode request body", "error", err.Error())
+			return
+		}
+
+		if fe := validateWebhook(body); len(fe) > 0 {
+			writeFieldErrors(w, fe)
+			return
+		}
+
+		hook := &Webhook{
+			UserID: user.ID,
+			URL:    body.URL,
+			Secret: newToken() + newToken(),
+			Events: body.Events,
+			Active: true,
+		}
+		if err := insertWebhook(r.Context(), conn, hook); err != nil {
+			writeStoreError(w, r, err, "Unable to insert webhook")
+			return
+		}
+
+		resp := newWebhookResponse(hook)
+		resp.Secret = hook.Secret
+
+		w.Header().Set("Location", fmt.Sprintf("/api/webhooks/%d", hook.ID))
+		writeJSON(w, http.StatusCreated, resp)
+	}
+}
+
+func handleDeleteWebhook(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := webhookFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		if err := deleteWebhook(r.Context(), conn, hook.ID); err != nil {
+			writeStoreError(w, r, err, "Unable to delete webhook")
+			return
+		}
+
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// handleGetWebhookDeliveries returns the most recent deliveries to the
+// webhook, newest first.
+func handleGetWebhookDeliveries(conn *pgxpool.Pool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := webhookFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		deliveries, err := getWebhookDeliveries(r.Context(), conn, hook.ID, deliveryLogLimit)
+		if err != nil {
+			writeStoreError(w, r, err, "Unable to get webhook deliveries")
+			return
+		}
+
+		responses := make([]WebhookDeliveryResponse, len(deliveries))
+		for i, d := range deliveries {
+			responses[i] = newWebhookDeliveryResponse(d)
+		}
+
+		writeJSON(w, http.StatusOK, responses)
+	}
+}
+
+// handlePingWebhook sends a ping event to the webhook straight away and
+// returns the outcome. A failed ping is retried like any other delivery.
+func handlePingWebhook(cfg *Config, conn *pgxpool.Pool) http.HandlerFunc {
+	client := newOutboundClient(cfg.WebhookTimeout)
+
+	return func(w http.ResponseWriter, r *http.Request) {
+		hook, ok := webhookFromPath(w, r, conn)
+		if !ok {
+			return
+		}
+
+		payload, err := newWebhookPayload(EventPing, map[string]int{"webhook_id": hook.ID})
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, CodeInternal, "Unable to encode webhook payload")
+			loggerFrom(r.Context()).Error("Unable to encode webhook payload", "error", err.Error())
+			return
+		}
+
+		// The delivery is leased so the worker does not send it as well.
+		d := &WebhookDelivery{
+			WebhookID:     hook.ID,
+			Event:         EventPing,
+			EventKey:      EventPing + ":" + newToken(),
+			Payload:       payload,
+			NextAttemptAt: time.Now().Add(2 * cfg.WebhookTimeout),
+		}
+		if err := insertWebhookDelivery(r.Context(), conn, d); err != nil {
+			writeStoreError(w, r, err, "Unable to insert webhook delivery")
+			return
+		}
+
+		attemptDelivery(r.Context(), client, hook, d, cfg.WebhookMaxAttempts)
+
+		if err := updateWebhookDelivery(r.Context(), conn, d); err != nil {
+			writeStoreError(w, r, err, "Unable to update webhook delivery")
+			return
+		}
+
+		writeJSON(w, http.StatusOK, newWebhookDeliveryResponse(d))
+	}
+}
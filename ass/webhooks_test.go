@@ -0,0 +1,175 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// verifyWebhookSignature checks header the way a receiver would.
+func verifyWebhookSignature(secret, header string, body []byte) bool {
+	ts, sig, ok := strings.Cut(header, ",v1=")
+	ts, ok2 := strings.CutPrefix(ts, "t=")
+	if !ok || !ok2 {
+		return false
+	}
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(ts + "." + string(body)))
+	want := hex.EncodeToString(mac.Sum(nil))
+	return hmac.Equal([]byte(sig), []byte(want))
+}
+
+func TestSignWebhook(t *testing.T) {
+	at := time.Unix(1700000000, 0)
+	header := signWebhook("secret", at, []byte(`{"event":"ping"}`))
+
+	if !strings.HasPrefix(header, "t=1700000000,v1=") {
+		t.Fatalf("got %q", header)
+	}
+	if !verifyWebhookSignature("secret", header, []byte(`{"event":"ping"}`)) {
+		t.Fatal("signature does not verify")
+	}
+	if verifyWebhookSignature("other", header, []byte(`{"event":"ping"}`)) {
+		t.Fatal("signature verifies with the wrong secret")
+	}
+}
+
+func TestWebhookBackoff(t *testing.T) {
+	tests := []struct {
+		attempts int
+		want     time.Duration
+	}{
+		{1, 30 * time.Second},
+		{2, time.Minute},
+		{3, 2 * time.Minute},
+		{10, 512 * 30 * time.Second},
+		{11, webhookMaxBackoff},
+		{100, webhookMaxBackoff},
+	}
+	for _, tt := range tests {
+		if got := webhookBackoff(tt.attempts); got != tt.want {
+			t.Errorf("webhookBackoff(%d) = %v, want %v", tt.attempts, got, tt.want)
+		}
+	}
+}
+
+// webhookReceiver is an httptest server that checks each delivery's headers
+// and answers with status.
+func webhookReceiver(t *testing.T, secret string, status *int) *httptest.Server {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			t.Error(err)
+		}
+		if !verifyWebhookSignature(secret, r.Header.Get(webhookSignatureHeader), body) {
+			t.Errorf("bad signature %q", r.Header.Get(webhookSignatureHeader))
+		}
+		if r.Header.Get(webhookEventHeader) != EventPing || r.Header.Get(webhookDeliveryHeader) != "7" {
+			t.Errorf("got headers %v", r.Header)
+		}
+		w.WriteHeader(*status)
+		_, _ = w.Write([]byte("a body that must not be kept"))
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestAttemptDelivery(t *testing.T) {
+	status := http.StatusOK
+	srv := webhookReceiver(t, "secret", &status)
+	hook := &Webhook{ID: 3, URL: srv.URL, Secret: "secret"}
+	newDelivery := func() *WebhookDelivery {
+		return &WebhookDelivery{ID: 7, WebhookID: hook.ID, Event: EventPing, Payload: []byte(`{"event":"ping"}`), Status: DeliveryPending}
+	}
+
+	t.Run("delivered", func(t *testing.T) {
+		status = http.StatusNoContent
+		d := newDelivery()
+		attemptDelivery(context.Background(), srv.Client(), hook, d, 3)
+
+		if d.Status != DeliveryDelivered || d.DeliveredAt == nil || d.Attempts != 1 {
+			t.Fatalf("got status %s, delivered at %v after %d attempts", d.Status, d.DeliveredAt, d.Attempts)
+		}
+		if d.LastStatusCode == nil || *d.LastStatusCode != http.StatusNoContent || d.LastError != nil {
+			t.Fatalf("got status code %v and error %v", d.LastStatusCode, d.LastError)
+		}
+	})
+
+	t.Run("retried with backoff", func(t *testing.T) {
+		status = http.StatusServiceUnavailable
+		d := newDelivery()
+		before := time.Now()
+		attemptDelivery(context.Background(), srv.Client(), hook, d, 3)
+
+		if d.Status != DeliveryPending || d.Attempts != 1 {
+			t.Fatalf("got status %s after %d attempts", d.Status, d.Attempts)
+		}
+		if d.LastStatusCode == nil || *d.LastStatusCode != http.StatusServiceUnavailable || d.LastError != nil {
+			t.Fatalf("got status code %v and error %v", d.LastStatusCode, d.LastError)
+		}
+		if wait := d.NextAttemptAt.Sub(before); wait < webhookBackoff(1) || wait > webhookBackoff(1)+time.Minute {
+			t.Fatalf("next attempt in %v, want %v", wait, webhookBackoff(1))
+		}
+
+		attrs := deliveryFailureAttrs(hook, d)
+		if !slices.Contains(attrs, any("status_code")) || slices.Contains(attrs, any("error")) {
+			t.Fatalf("got log attributes %v", attrs)
+		}
+
+		attemptDelivery(context.Background(), srv.Client(), hook, d, 3)
+		if wait := d.NextAttemptAt.Sub(before); d.Attempts != 2 || wait < webhookBackoff(2) {
+			t.Fatalf("second retry in %v after %d attempts, want %v", wait, d.Attempts, webhookBackoff(2))
+		}
+	})
+
+	t.Run("gives up after the last attempt", func(t *testing.T) {
+		status = http.StatusBadRequest
+		d := newDelivery()
+		for i := 0; i < 3; i++ {
+			attemptDelivery(context.Background(), srv.Client(), hook, d, 3)
+		}
+
+		if d.Status != DeliveryFailed || d.Attempts != 3 {
+			t.Fatalf("got status %s after %d attempts", d.Status, d.Attempts)
+		}
+	})
+
+	t.Run("unreachable", func(t *testing.T) {
+		closed := httptest.NewServer(http.NotFoundHandler())
+		closed.Close()
+		d := newDelivery()
+		attemptDelivery(context.Background(), closed.Client(), &Webhook{ID: 4, URL: closed.URL, Secret: "secret"}, d, 3)
+
+		if d.Status != DeliveryPending || d.LastStatusCode != nil || d.LastError == nil {
+			t.Fatalf("got status %s, status code %v and error %v", d.Status, d.LastStatusCode, d.LastError)
+		}
+		if attrs := deliveryFailureAttrs(hook, d); !slices.Contains(attrs, any("error")) {
+			t.Fatalf("got log attributes %v", attrs)
+		}
+	})
+}
+
+func TestSendWebhookDiscardsBody(t *testing.T) {
+	status := http.StatusInternalServerError
+	srv := webhookReceiver(t, "secret", &status)
+	hook := &Webhook{ID: 3, URL: srv.URL, Secret: "secret"}
+
+	got, err := sendWebhook(context.Background(), srv.Client(), hook, &WebhookDelivery{ID: 7, Event: EventPing, Payload: []byte(`{}`)})
+	if got != status || err == nil {
+		t.Fatalf("got %d, %v", got, err)
+	}
+	if strings.Contains(err.Error(), "body") || err.Error() != "webhook responded "+strconv.Itoa(status) {
+		t.Fatalf("error %q includes more than the status", err)
+	}
+}
@@ -0,0 +1,17 @@
+// Shows the reminders the server sends with Web Push.
+self.addEventListener('push', (event) => {
+  const { title, body, url, tag } = event.data ? event.data.json() : {};
+
+  event.waitUntil(
+    self.registration.showNotification(title || 'Did I Do That?', {
+      body,
+      tag,
+      data: { url: url || '/' }
+    })
+  );
+});
+
+self.addEventListener('notificationclick', (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});